@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrUnknownAgent = errors.New("unknown agent")
+
+type RegisterAgentInput struct {
+	JoinToken string
+	Name      string
+	Host      string
+	Labels    map[string]string
+	Version   string
+	// push, the default, or pull
+	Mode     string
+	Capacity int
+}
+
+type AgentHeartbeatInput struct {
+	Version  string
+	Capacity int
+	Running  int
+	DiskInfo types.DiskInfo
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PutAgentJoinToken replaces the project's join token, agents registered with the previous one keep their own tokens
+func (a *Api) PutAgentJoinToken() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutAgentJoinTokenResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// agents joining with the token receive the project's jobs and the secrets they reference
+		if !hasRole(project, userId, adminRoles) {
+			ctx.JSON(http.StatusForbidden, PutAgentJoinTokenResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+			return
+		}
+
+		token, err := randomToken()
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutAgentJoinTokenResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.UpdateAgentJoinToken(ctx, pid, hashToken(token))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutAgentJoinTokenResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		// the token is only ever returned here
+		ctx.JSON(http.StatusOK, PutAgentJoinTokenResponse{Payload: &PutAgentJoinTokenResponsePayload{Token: token}})
+	}
+}
+
+// RegisterAgent registers an agent with a join token and hands it the token its heartbeats are sent with
+func (a *Api) RegisterAgent() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input RegisterAgentInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, RegisterAgentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if input.JoinToken == "" || input.Name == "" {
+			ctx.JSON(http.StatusBadRequest, RegisterAgentResponse{Code: types.CodeClientError, Msg: "joinToken and name are required"})
+			return
+		}
+
+		if input.Mode == "" {
+			input.Mode = repository.AgentPush
+		}
+
+		if input.Mode != repository.AgentPush && input.Mode != repository.AgentPull {
+			ctx.JSON(http.StatusBadRequest, RegisterAgentResponse{Code: types.CodeClientError, Msg: "mode must be push or pull"})
+			return
+		}
+
+		project, err := a.repo.GetProjectByAgentJoinToken(ctx, hashToken(input.JoinToken))
+
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, RegisterAgentResponse{Code: types.CodeClientError, Msg: "invalid join token"})
+			return
+		}
+
+		var currentTokenHash string
+		if current := ctx.GetHeader("X-Agent-Token"); current != "" {
+			currentTokenHash = hashToken(current)
+		}
+
+		token, err := randomToken()
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, RegisterAgentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		agent, err := a.repo.RegisterAgent(ctx, &repository.RegisterAgentInput{
+			ProjectId: project.Id,
+			Name:      input.Name,
+			Host:      input.Host,
+			Labels:    input.Labels,
+			Version:   input.Version,
+			Mode:      input.Mode,
+			Capacity:  input.Capacity,
+			TokenHash: hashToken(token),
+			// an agent registering again proves it is the one holding the name with its current token
+			CurrentTokenHash: currentTokenHash,
+			StaleBefore:      time.Now().UTC().Add(-a.agentOfflineAfter),
+		})
+
+		if err == repository.ErrAgentAlive {
+			ctx.JSON(http.StatusConflict, RegisterAgentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, RegisterAgentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, RegisterAgentResponse{Payload: &RegisterAgentResponsePayload{Id: agent.Id, ProjectId: project.Id, Token: token, HeartbeatSecond: int(a.agentHeartbeat.Seconds())}})
+	}
+}
+
+// PutAgentHeartbeat records a heartbeat of the agent authenticated by X-Agent-Token
+func (a *Api) PutAgentHeartbeat() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input AgentHeartbeatInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutAgentHeartbeatResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.UpdateAgentHeartbeat(ctx, &repository.AgentHeartbeatInput{
+			TokenHash: hashToken(ctx.GetHeader("X-Agent-Token")),
+			Version:   input.Version,
+			Capacity:  input.Capacity,
+			Running:   input.Running,
+			DiskInfo:  input.DiskInfo,
+		})
+
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, PutAgentHeartbeatResponse{Code: types.CodeClientError, Msg: "unknown agent"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PutAgentHeartbeatResponse{})
+	}
+}
+
+func (a *Api) GetAgents() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetAgentsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		agents, err := a.repo.GetAgents(ctx, repository.GetAgentsInput{ProjectId: pid, Status: ctx.Query("status")})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetAgentsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetAgentsResponse{Payload: agents})
+	}
+}
+
+func (a *Api) DeleteAgent() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteAgentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.DeleteAgent(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteAgentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, DeleteAgentResponse{})
+	}
+}
+
+// WatchAgents marks agents offline once they missed the configured number of heartbeats
+func (a *Api) WatchAgents() {
+	for range time.Tick(a.agentHeartbeat) {
+		deadline := time.Now().UTC().Add(-a.agentOfflineAfter)
+
+		n, err := a.repo.MarkAgentsOffline(context.Background(), deadline)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if n > 0 {
+			log.Printf("%d agent(s) went offline", n)
+		}
+	}
+}
+
+// projectAgent checks the agent authenticated by X-Agent-Token belongs to the project
+func (a *Api) projectAgent(ctx *gin.Context, projectId primitive.ObjectID) error {
+	agent, err := a.repo.GetAgentByToken(ctx, hashToken(ctx.GetHeader("X-Agent-Token")))
+	if err != nil {
+		return ErrUnknownAgent
+	}
+
+	if agent.ProjectId != projectId {
+		return errors.New("agent does not belong to the pipeline's project")
+	}
+
+	return nil
+}
+
+// agentRun returns the agent authenticated by X-Agent-Token with the run it reports on, the agent must belong to the
+// run's project and the task to the run's pipeline
+func (a *Api) agentRun(ctx *gin.Context, runId, taskId primitive.ObjectID) (*repository.Agent, *repository.Run, error) {
+	agent, err := a.repo.GetAgentByToken(ctx, hashToken(ctx.GetHeader("X-Agent-Token")))
+	if err != nil {
+		return nil, nil, ErrUnknownAgent
+	}
+
+	run, err := a.repo.GetRun(ctx, runId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if agent.ProjectId != run.ProjectId {
+		return nil, nil, errors.New("agent does not belong to the run's project")
+	}
+
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, t := range pl.Tasks {
+		if t.Id == taskId {
+			return agent, run, nil
+		}
+	}
+
+	return nil, nil, errors.New("task is not part of the run's pipeline")
+}
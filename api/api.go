@@ -1,28 +1,77 @@
 package api
 
 import (
+	"context"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 	authHelper "github.com/more-than-code/auth-helper"
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/envelope"
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
+	"github.com/more-than-code/deploybot-service-api/logstore"
+	"github.com/more-than-code/deploybot-service-api/notify"
+	"github.com/more-than-code/deploybot-service-api/registry"
 	"github.com/more-than-code/deploybot-service-api/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Config struct {
-	MinuteAt       int    `envconfig:"AT_TTL_MINUTE"`
-	HourAt         int    `envconfig:"AT_TTL_HOUR"`
-	DayAt          int    `envconfig:"AT_TTL_DAY"`
-	MinuteRt       int    `envconfig:"RT_TTL_MINUTE"`
-	HourRt         int    `envconfig:"RT_TTL_HOUR"`
-	DayRt          int    `envconfig:"RT_TTL_DAY"`
-	Secret         []byte `envconfig:"TOKEN_SECRET_KEY"`
-	GoogleClientId string `envconfig:"GOOGLE_CLIENT_ID"`
+	MinuteAt             int    `envconfig:"AT_TTL_MINUTE"`
+	HourAt               int    `envconfig:"AT_TTL_HOUR"`
+	DayAt                int    `envconfig:"AT_TTL_DAY"`
+	MinuteRt             int    `envconfig:"RT_TTL_MINUTE"`
+	HourRt               int    `envconfig:"RT_TTL_HOUR"`
+	DayRt                int    `envconfig:"RT_TTL_DAY"`
+	Secret               []byte `envconfig:"TOKEN_SECRET_KEY"`
+	GoogleClientId       string `envconfig:"GOOGLE_CLIENT_ID"`
+	AgentHeartbeatSecond int    `envconfig:"AGENT_HEARTBEAT_SECOND" default:"30"`
+	// agents are offline after missing this many heartbeats
+	AgentMissedHeartbeats int `envconfig:"AGENT_MISSED_HEARTBEATS" default:"3"`
+	// servers whose disk is fuller than this raise an alert
+	DiskAlertPercent  float64 `envconfig:"DISK_ALERT_PERCENT" default:"90"`
+	UsageRetentionDay int     `envconfig:"USAGE_RETENTION_DAY" default:"30"`
+	// pull agents lose jobs they stop renewing for this long
+	JobLeaseSecond   int `envconfig:"JOB_LEASE_SECOND" default:"60"`
+	JobWaitMaxSecond int `envconfig:"JOB_WAIT_MAX_SECOND" default:"30"`
+	// runs are canceled once a task without a timeout of its own runs this long
+	TaskTimeoutMinute int `envconfig:"TASK_TIMEOUT_MINUTE" default:"60"`
+	// member runs without a user, started with the service key or by git, are checked as against the roles of
+	// protected environments; without it such runs cannot target them
+	ServiceUserId string `envconfig:"SERVICE_USER_ID"`
+	// lets registries reached over plain http, e.g. on a private network, be logged in to
+	AllowInsecureRegistries bool `envconfig:"REGISTRY_ALLOW_INSECURE"`
 }
 
 type Api struct {
-	repo           *repository.Repository
+	repo       *repository.Repository
+	dispatcher *dispatcher.Dispatcher
+	notifier   *notify.Notifier
+	// master keys of the project secrets
+	keyring  *envelope.Keyring
+	logStore logstore.Store
+	events   *eventHub
+	maskers  *maskerCache
+	registry *registry.Client
+	// commit status reporters keyed by git provider name
+	statusReporters map[string]gitprovider.StatusReporter
+	statusReports   *statusQueue
+	// hosts the git api urls of projects may point to
+	gitApiHosts    map[string]bool
 	atHelper       *authHelper.Helper
 	rtHelper       *authHelper.Helper
 	googleClientId string
+	// agents are expected to send a heartbeat this often
+	agentHeartbeat    time.Duration
+	agentOfflineAfter time.Duration
+	diskAlertPercent  float64
+	usageRetention    time.Duration
+	jobLease          time.Duration
+	jobWaitMax        int
+	taskTimeout       time.Duration
+	serviceUserId     primitive.ObjectID
+	// registry logins may be sent over plain http
+	allowInsecureRegistries bool
 }
 
 type TaskFilter struct {
@@ -45,5 +94,40 @@ func NewApi() *Api {
 	if err != nil {
 		panic(err)
 	}
-	return &Api{repo: r, atHelper: athelper, rtHelper: rthelper, googleClientId: cfg.GoogleClientId}
+	a := &Api{repo: r, dispatcher: dispatcher.NewDispatcher(r), statusReporters: gitprovider.NewStatusReporters(), atHelper: athelper, rtHelper: rthelper, googleClientId: cfg.GoogleClientId}
+	a.dispatcher.OnDead = a.handleDeadDelivery
+	a.dispatcher.Route = a.routeDelivery
+	a.dispatcher.Prepare = func(ctx context.Context, msg *repository.OutboxMessage) ([]byte, error) {
+		return a.resolveSecrets(ctx, msg, msg.Host)
+	}
+	a.dispatcher.OpenSecret = a.openWebhookSecret
+	a.notifier = notify.NewNotifier(r)
+	a.registry = registry.NewClient()
+
+	a.keyring, err = envelope.NewKeyring()
+	if err != nil {
+		panic(err)
+	}
+	a.logStore = newLogStore(r)
+	a.events = newEventHub()
+	a.maskers = newMaskerCache()
+	a.statusReports = &statusQueue{pending: map[primitive.ObjectID][]string{}}
+	a.gitApiHosts = gitprovider.ApiHosts()
+	a.agentHeartbeat = time.Duration(cfg.AgentHeartbeatSecond) * time.Second
+	a.agentOfflineAfter = time.Duration(cfg.AgentHeartbeatSecond*cfg.AgentMissedHeartbeats) * time.Second
+	a.diskAlertPercent = cfg.DiskAlertPercent
+	a.usageRetention = time.Duration(cfg.UsageRetentionDay) * 24 * time.Hour
+	a.jobLease = time.Duration(cfg.JobLeaseSecond) * time.Second
+	a.jobWaitMax = cfg.JobWaitMaxSecond
+	a.taskTimeout = time.Duration(cfg.TaskTimeoutMinute) * time.Minute
+	a.allowInsecureRegistries = cfg.AllowInsecureRegistries
+
+	if cfg.ServiceUserId != "" {
+		a.serviceUserId, err = primitive.ObjectIDFromHex(cfg.ServiceUserId)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return a
 }
@@ -0,0 +1,408 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/pattern"
+	"github.com/more-than-code/deploybot-service-api/registry"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrUnknownMatrixKey = errors.New("unknown matrix key")
+
+var digestRegex = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+
+type ArtifactReport struct {
+	Name       string
+	Tag        string
+	Digest     string
+	Size       int64
+	Provenance repository.ArtifactProvenance
+}
+
+type PostArtifactsInput struct {
+	RunId     primitive.ObjectID
+	TaskId    primitive.ObjectID
+	MatrixKey string
+	Artifacts []ArtifactReport
+}
+
+// PostArtifacts records the images a task built, the agent authenticated by X-Agent-Token is their builder
+func (a *Api) PostArtifacts() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostArtifactsInput
+		err := ctx.BindJSON(&input)
+
+		if err == nil {
+			err = validateArtifacts(input.Artifacts)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		agent, run, err := a.agentRun(ctx, input.RunId, input.TaskId)
+
+		if err == ErrUnknownAgent {
+			ctx.JSON(http.StatusUnauthorized, PostArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusForbidden, PostArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err = checkMatrixKey(run, input.TaskId, input.MatrixKey); err != nil {
+			ctx.JSON(http.StatusBadRequest, PostArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		for _, r := range input.Artifacts {
+			artifact := repository.Artifact{
+				ProjectId:  run.ProjectId,
+				PipelineId: run.PipelineId,
+				TaskId:     input.TaskId,
+				RunId:      run.Id,
+				MatrixKey:  input.MatrixKey,
+				Name:       r.Name,
+				Tag:        r.Tag,
+				Digest:     r.Digest,
+				Size:       r.Size,
+				Provenance: r.Provenance,
+			}
+
+			if artifact.Provenance.Builder == "" {
+				artifact.Provenance.Builder = agent.Name
+			}
+
+			if run.Trigger != nil {
+				artifact.CommitSha = run.Trigger.CommitSha
+				artifact.Ref = run.Trigger.Ref
+			}
+
+			if err = a.repo.SaveArtifact(ctx, &artifact); err != nil {
+				ctx.JSON(http.StatusInternalServerError, PostArtifactsResponse{Code: types.CodeServerError, Msg: err.Error()})
+				return
+			}
+		}
+
+		ctx.JSON(http.StatusOK, PostArtifactsResponse{})
+	}
+}
+
+func (a *Api) GetArtifacts() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetArtifactsInput{
+			ProjectId: pid,
+			Name:      ctx.Query("name"),
+			Tag:       ctx.Query("tag"),
+			Digest:    ctx.Query("digest"),
+			CommitSha: ctx.Query("commitSha"),
+		}
+		input.PipelineId, _ = primitive.ObjectIDFromHex(ctx.Query("pipelineId"))
+		input.RunId, _ = primitive.ObjectIDFromHex(ctx.Query("runId"))
+		input.Limit, _ = strconv.ParseInt(ctx.Query("limit"), 10, 64)
+
+		artifacts, err := a.repo.GetArtifacts(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetArtifactsResponse{Payload: artifacts})
+	}
+}
+
+func (a *Api) GetArtifact() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		artifact, err := a.repo.GetArtifact(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetArtifactResponse{Payload: artifact})
+	}
+}
+
+func (a *Api) DeleteArtifact() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteArtifactResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.DeleteArtifacts(ctx, pid, []primitive.ObjectID{id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteArtifactResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, DeleteArtifactResponse{})
+	}
+}
+
+// PostArtifactsGc applies the project's retention policy now, with dryRun=true it only returns what would be collected
+func (a *Api) PostArtifactsGc() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+		dryRun, _ := strconv.ParseBool(ctx.Query("dryRun"))
+
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		collected, err := a.collectProjectArtifacts(ctx, project, dryRun)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetArtifactsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetArtifactsResponse{Payload: collected})
+	}
+}
+
+// CollectArtifacts applies the artifact retention policies of the projects
+func (a *Api) CollectArtifacts(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx := context.Background()
+
+		projects, err := a.repo.GetArtifactRetentionProjects(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for i := range projects {
+			collected, err := a.collectProjectArtifacts(ctx, &projects[i], false)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			if len(collected) > 0 {
+				log.Printf("collected %d artifacts of project %s", len(collected), projects[i].Id.Hex())
+			}
+		}
+	}
+}
+
+func (a *Api) collectProjectArtifacts(ctx context.Context, project *repository.Project, dryRun bool) ([]repository.Artifact, error) {
+	artifacts, err := a.repo.GetArtifacts(ctx, repository.GetArtifactsInput{ProjectId: project.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	// every deployment of the history is a rollback target, not only the current ones
+	images, deployedArtifacts, err := a.repo.GetDeployedRefs(ctx, project.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	collected := collectArtifacts(artifacts, project.ArtifactRetention, deployedRefs(images, deployedArtifacts), time.Now().UTC())
+	if dryRun || len(collected) == 0 {
+		return collected, nil
+	}
+
+	logins := map[string]registry.Login{}
+
+	// a manifest is only deleted from the registry when neither a kept artifact nor a deployment points to it,
+	// through its digest or through a tag
+	var inUse map[string]bool
+	if project.ArtifactRetention.PruneRegistry {
+		dropped := map[primitive.ObjectID]bool{}
+		for _, c := range collected {
+			dropped[c.Id] = true
+		}
+
+		var refs []string
+		for _, artifact := range artifacts {
+			if !dropped[artifact.Id] {
+				refs = append(refs, artifactRef(artifact))
+			}
+		}
+
+		inUse, err = a.manifestsInUse(ctx, project, collected, append(refs, images...), logins)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []primitive.ObjectID
+	var deleted []repository.Artifact
+	for _, c := range collected {
+		if project.ArtifactRetention.PruneRegistry {
+			// the record is kept for the next collection to retry
+			if err := a.pruneImage(ctx, project, c, inUse, logins); err != nil {
+				log.Println(artifactRef(c), err)
+				continue
+			}
+		}
+
+		ids = append(ids, c.Id)
+		deleted = append(deleted, c)
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	_, err = a.repo.DeleteArtifacts(ctx, project.Id, ids)
+
+	return deleted, err
+}
+
+// collectArtifacts returns the artifacts, ordered newest first, the retention policy drops;
+// deployed artifacts and kept tags are never dropped
+func collectArtifacts(artifacts []repository.Artifact, policy repository.ArtifactRetention, deployed map[string]bool, now time.Time) []repository.Artifact {
+	if policy.KeepLast <= 0 && policy.MaxAgeDays <= 0 {
+		return nil
+	}
+
+	cutoff := now.AddDate(0, 0, -policy.MaxAgeDays)
+	seen := map[string]int{}
+
+	var collected []repository.Artifact
+	for _, artifact := range artifacts {
+		n := seen[artifact.Name]
+		seen[artifact.Name]++
+
+		if artifactDeployed(artifact, deployed) || (artifact.Tag != "" && pattern.MatchAny(policy.KeepTags, artifact.Tag)) {
+			continue
+		}
+
+		beyondLast := policy.KeepLast <= 0 || n >= policy.KeepLast
+		expired := policy.MaxAgeDays <= 0 || artifact.CreatedAt.Time().Before(cutoff)
+
+		if beyondLast && expired {
+			collected = append(collected, artifact)
+		}
+	}
+
+	return collected
+}
+
+// deployedRefs returns the set of image and artifact references deployments name
+func deployedRefs(lists ...[]string) map[string]bool {
+	refs := map[string]bool{}
+	for _, list := range lists {
+		for _, ref := range list {
+			if ref != "" {
+				refs[ref] = true
+			}
+		}
+	}
+
+	return refs
+}
+
+func artifactDeployed(artifact repository.Artifact, deployed map[string]bool) bool {
+	refs := []string{artifact.Id.Hex()}
+	if artifact.Tag != "" {
+		refs = append(refs, artifact.Name+":"+artifact.Tag)
+	}
+	if artifact.Digest != "" {
+		refs = append(refs, artifact.Digest, artifact.Name+"@"+artifact.Digest)
+	}
+	if artifact.Tag != "" && artifact.Digest != "" {
+		refs = append(refs, artifact.Name+":"+artifact.Tag+"@"+artifact.Digest)
+	}
+
+	for _, ref := range refs {
+		if deployed[ref] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkMatrixKey makes sure artifacts of a matrix task belong to one of its executions in the run, and others to none
+func checkMatrixKey(run *repository.Run, taskId primitive.ObjectID, key string) error {
+	matrix := false
+	for _, e := range run.Matrix {
+		if e.TaskId != taskId {
+			continue
+		}
+
+		if e.Key == key {
+			return nil
+		}
+		matrix = true
+	}
+
+	if !matrix && key == "" {
+		return nil
+	}
+
+	return fmt.Errorf("%w %q for task %s", ErrUnknownMatrixKey, key, taskId.Hex())
+}
+
+func validateArtifacts(artifacts []ArtifactReport) error {
+	for _, r := range artifacts {
+		if r.Name == "" {
+			return errors.New("artifact name is required")
+		}
+
+		if r.Tag == "" && r.Digest == "" {
+			return fmt.Errorf("artifact %s has neither a tag nor a digest", r.Name)
+		}
+
+		if r.Digest != "" && !digestRegex.MatchString(r.Digest) {
+			return fmt.Errorf("artifact %s has an invalid digest %q", r.Name, r.Digest)
+		}
+	}
+
+	return nil
+}
+
+func validateArtifactRetention(policy *repository.ArtifactRetention) error {
+	if policy.KeepLast < 0 || policy.MaxAgeDays < 0 {
+		return errors.New("artifact retention cannot be negative")
+	}
+
+	return pattern.Validate(policy.KeepTags...)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	artifact := func(name, tag string, age int) repository.Artifact {
+		return repository.Artifact{Id: primitive.NewObjectID(), Name: name, Tag: tag, CreatedAt: primitive.NewDateTimeFromTime(now.AddDate(0, 0, -age))}
+	}
+
+	// newest first, as the repository returns them
+	artifacts := []repository.Artifact{
+		artifact("app", "1.4.0", 1),
+		artifact("worker", "0.2.0", 2),
+		artifact("app", "1.3.0", 10),
+		artifact("app", "v1.2.0", 20),
+		artifact("app", "1.1.0", 40),
+		artifact("app", "1.0.0", 60),
+	}
+	deployed := deployedRefs([]string{"app:1.0.0"}, nil)
+
+	tags := func(collected []repository.Artifact) []string {
+		var tags []string
+		for _, a := range collected {
+			tags = append(tags, a.Name+":"+a.Tag)
+		}
+		return tags
+	}
+
+	cases := []struct {
+		policy   repository.ArtifactRetention
+		expected []string
+	}{
+		{repository.ArtifactRetention{}, nil},
+		{repository.ArtifactRetention{KeepLast: 2}, []string{"app:v1.2.0", "app:1.1.0"}},
+		{repository.ArtifactRetention{KeepLast: 2, KeepTags: []string{"v*"}}, []string{"app:1.1.0"}},
+		{repository.ArtifactRetention{MaxAgeDays: 15}, []string{"app:v1.2.0", "app:1.1.0"}},
+		{repository.ArtifactRetention{KeepLast: 3, MaxAgeDays: 15}, []string{"app:1.1.0"}},
+		{repository.ArtifactRetention{KeepLast: 1, MaxAgeDays: 30}, []string{"app:1.1.0"}},
+	}
+
+	for _, c := range cases {
+		collected := tags(collectArtifacts(artifacts, c.policy, deployed, now))
+		if len(collected) != len(c.expected) {
+			t.Fatal(c.policy, collected)
+		}
+		for i := range collected {
+			if collected[i] != c.expected[i] {
+				t.Fatal(c.policy, collected)
+			}
+		}
+	}
+}
+
+func TestValidateArtifacts(t *testing.T) {
+	digest := "sha256:4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+
+	if err := validateArtifacts([]ArtifactReport{{Name: "app", Tag: "1.0.0"}, {Name: "app", Digest: digest}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []ArtifactReport{{Tag: "1.0.0"}, {Name: "app"}, {Name: "app", Digest: "sha256:abc"}} {
+		if validateArtifacts([]ArtifactReport{r}) == nil {
+			t.Fatal(r)
+		}
+	}
+}
+
+func TestCheckMatrixKey(t *testing.T) {
+	matrixTask, plainTask := primitive.NewObjectID(), primitive.NewObjectID()
+	run := &repository.Run{Matrix: []repository.MatrixExecution{
+		{TaskId: matrixTask, Key: "arch=amd64"},
+		{TaskId: matrixTask, Key: "arch=arm64"},
+	}}
+
+	if err := checkMatrixKey(run, matrixTask, "arch=arm64"); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkMatrixKey(run, plainTask, ""); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		taskId primitive.ObjectID
+		key    string
+	}{{matrixTask, ""}, {matrixTask, "arch=riscv64"}, {plainTask, "arch=amd64"}} {
+		if err := checkMatrixKey(run, c.taskId, c.key); !errors.Is(err, ErrUnknownMatrixKey) {
+			t.Errorf("expected %v for key %q, got %v", ErrUnknownMatrixKey, c.key, err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrRunRejected = errors.New("pipeline or its concurrency group is already running")
+
+func slotKeys(pl *repository.Pipeline) []string {
+	keys := []string{repository.PipelineSlotKey(pl.Id)}
+
+	if pl.Concurrency.Group != "" {
+		keys = append(keys, repository.GroupSlotKey(pl.ProjectId, pl.Concurrency.Group))
+	}
+
+	return keys
+}
+
+// acquireSlots takes every concurrency slot of the pipeline for a run, or none of them
+func (a *Api) acquireSlots(ctx context.Context, pl *repository.Pipeline, runId primitive.ObjectID) (bool, error) {
+	for _, key := range slotKeys(pl) {
+		ok, err := a.repo.AcquireConcurrencySlot(ctx, key, runId, pl.Id)
+
+		if err != nil || !ok {
+			a.repo.ReleaseConcurrencySlots(ctx, runId)
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// checkWebhookSecrets refuses runs with a task pinned to a push agent that no secret could sign the delivery for, the
+// same secrets deliveries are signed with; label routed tasks only get their host on delivery and are checked there
+func (a *Api) checkWebhookSecrets(ctx context.Context, pl *repository.Pipeline) error {
+	checked := map[string]bool{}
+
+	for _, t := range pl.Tasks {
+		if t.WebhookHost == "" || checked[t.WebhookHost] {
+			continue
+		}
+		checked[t.WebhookHost] = true
+
+		if a.isPullJob(ctx, pl.ProjectId, t.WebhookHost, nil) {
+			continue
+		}
+
+		signed, err := a.dispatcher.HasSecret(ctx, pl.ProjectId, t.WebhookHost)
+		if err != nil {
+			return err
+		}
+
+		if !signed {
+			return fmt.Errorf("%w for host %s of project %s", dispatcher.ErrNoWebhookSecret, t.WebhookHost, pl.ProjectId.Hex())
+		}
+	}
+
+	return nil
+}
+
+// startRun creates a run for a pipeline, targeting env when not nil, and applies the pipeline's concurrency policy when it cannot start right away
+func (a *Api) startRun(ctx context.Context, pl *repository.Pipeline, trigger *repository.RunTrigger, env *repository.Environment) (*repository.Run, error) {
+	if err := a.checkWebhookSecrets(ctx, pl); err != nil {
+		return nil, err
+	}
+
+	input := repository.CreateRunInput{PipelineId: pl.Id, ProjectId: pl.ProjectId, Status: repository.RunQueued, ConcurrencyGroup: pl.Concurrency.Group, Trigger: trigger}
+	if env != nil {
+		input.EnvironmentId = env.Id
+		input.Environment = env.Name
+	}
+
+	queue, err := a.repo.GetRunQueue(ctx, repository.GetRunQueueInput{PipelineId: pl.Id, ProjectId: pl.ProjectId, ConcurrencyGroup: pl.Concurrency.Group})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := a.repo.CreateRun(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	// runs already waiting go first
+	acquired := false
+	if len(queue) == 0 {
+		acquired, err = a.acquireSlots(ctx, pl, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !acquired {
+		switch pl.Concurrency.Policy {
+		case repository.ConcurrencyReject:
+			a.repo.UpdateRunStatus(ctx, repository.UpdateRunStatusInput{RunId: id, Run: struct{ Status string }{Status: repository.RunCanceled}})
+			a.reportRunStatus(id, repository.RunCanceled)
+			return nil, ErrRunRejected
+		case repository.ConcurrencyCancel:
+			a.cancelHolders(ctx, pl)
+
+			// canceled holders dequeue the oldest queued run, which may be this one
+			if run, err := a.repo.GetRun(ctx, id); err == nil && run.Status != repository.RunQueued {
+				return run, nil
+			}
+
+			acquired, err = a.acquireSlots(ctx, pl, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !acquired {
+		a.repo.CreateRunEvent(ctx, id, repository.RunEvent{Type: repository.RunEventQueued})
+		a.reportRunStatus(id, repository.RunQueued)
+		return a.repo.GetRun(ctx, id)
+	}
+
+	started, err := a.repo.StartQueuedRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := a.repo.GetRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// a run that finished meanwhile may have dequeued this one already
+	if started {
+		a.beginRun(ctx, run, pl)
+	}
+
+	return run, nil
+}
+
+func (a *Api) beginRun(ctx context.Context, run *repository.Run, pl *repository.Pipeline) {
+	a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventStarted})
+	a.reportRunStatus(run.Id, repository.RunInProgress)
+
+	if a.gateEnvironment(ctx, run) {
+		return
+	}
+
+	a.startRootTasks(ctx, run, pl)
+}
+
+func (a *Api) startRootTasks(ctx context.Context, run *repository.Run, pl *repository.Pipeline) {
+	if isRollback(run) {
+		a.startRollback(ctx, run, pl)
+		return
+	}
+
+	tasks := rootTasks(pl)
+	if len(tasks) == 0 {
+		a.finishRun(ctx, run, pl.Id, repository.RunDone)
+		return
+	}
+
+	go a.startTasks(context.Background(), run, pl, tasks)
+}
+
+// cancelHolders cancels the runs holding the pipeline's concurrency slots
+func (a *Api) cancelHolders(ctx context.Context, pl *repository.Pipeline) {
+	slots, err := a.repo.GetConcurrencySlots(ctx, slotKeys(pl))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// a run holding both the pipeline and the group slot is canceled once
+	canceled := map[primitive.ObjectID]bool{}
+
+	for _, s := range slots {
+		if canceled[s.RunId] {
+			continue
+		}
+		canceled[s.RunId] = true
+
+		run, err := a.repo.GetRun(ctx, s.RunId)
+		if err != nil {
+			log.Println(err)
+			a.repo.ReleaseConcurrencySlots(ctx, s.RunId)
+			continue
+		}
+
+		a.cancelRun(ctx, run)
+	}
+}
+
+// cancelRun stops a run: its undelivered stream webhooks and pull jobs are canceled and the run is finished like
+// any other, which releases its slots and dequeues the next run
+func (a *Api) cancelRun(ctx context.Context, run *repository.Run) {
+	if repository.IsRunFinished(run.Status) {
+		return
+	}
+
+	if err := a.repo.CancelOutboxMessages(ctx, run.Id, primitive.NilObjectID); err != nil {
+		log.Println(err)
+	}
+
+	a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventCanceled})
+	a.finishRun(ctx, run, run.PipelineId, repository.RunCanceled)
+}
+
+// WatchRunTimeouts cancels runs with a task past its timeout, so a run whose agent never reports gives its
+// concurrency slots back
+func (a *Api) WatchRunTimeouts(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx := context.Background()
+
+		runs, err := a.repo.GetTimedOutRuns(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for i := range runs {
+			event := repository.RunEvent{Type: repository.RunEventTimedOut}
+			if overdue := overdueTask(&runs[i], time.Now().UTC()); overdue != nil {
+				event.TaskId = overdue.TaskId
+			}
+
+			a.repo.CreateRunEvent(ctx, runs[i].Id, event)
+			a.cancelRun(ctx, &runs[i])
+		}
+	}
+}
+
+// dequeue starts the oldest queued run that can take its slots after a run of the pipeline or its group finished,
+// finishRun calls it for every way a run ends
+func (a *Api) dequeue(ctx context.Context, finished *repository.Run) {
+	queue, err := a.repo.GetRunQueue(ctx, repository.GetRunQueueInput{PipelineId: finished.PipelineId, ProjectId: finished.ProjectId, ConcurrencyGroup: finished.ConcurrencyGroup})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range queue {
+		run := &queue[i]
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		acquired, err := a.acquireSlots(ctx, pl, run.Id)
+		if err != nil || !acquired {
+			continue
+		}
+
+		started, err := a.repo.StartQueuedRun(ctx, run.Id)
+		if err != nil || !started {
+			a.repo.ReleaseConcurrencySlots(ctx, run.Id)
+			continue
+		}
+
+		a.beginRun(ctx, run, pl)
+		return
+	}
+}
+
+func rootTasks(pl *repository.Pipeline) []repository.Task {
+	var tasks []repository.Task
+
+	for _, t := range pl.Tasks {
+		if t.UpstreamTaskId.IsZero() {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks
+}
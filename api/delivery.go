@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (a *Api) RunDispatcher() {
+	a.dispatcher.Run()
+}
+
+func (a *Api) GetDeliveries() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeliveriesResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetOutboxMessagesInput{ProjectId: pid}
+
+		status, exists := ctx.GetQuery("status")
+		if exists && status != "" {
+			input.Status = &status
+		}
+
+		if runId, err := primitive.ObjectIDFromHex(ctx.Query("runId")); err == nil {
+			input.RunId = &runId
+		}
+
+		if plId, err := primitive.ObjectIDFromHex(ctx.Query("pipelineId")); err == nil {
+			input.PipelineId = &plId
+		}
+
+		output, err := a.repo.GetOutboxMessages(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeliveriesResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetDeliveriesResponse{Payload: output})
+	}
+}
+
+func (a *Api) GetDelivery() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		msg, err := a.repo.GetOutboxMessage(ctx, id)
+
+		if err == nil {
+			_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: msg.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeliveryResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetDeliveryResponse{Payload: msg})
+	}
+}
+
+func (a *Api) RedriveDelivery() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		msg, err := a.repo.GetOutboxMessage(ctx, id)
+
+		if err == nil {
+			_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: msg.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutRedriveDeliveryResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		redriven, err := a.repo.RedriveOutboxMessage(ctx, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutRedriveDeliveryResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		if !redriven {
+			ctx.JSON(http.StatusBadRequest, PutRedriveDeliveryResponse{Code: types.CodeClientError, Msg: "only dead deliveries can be redriven"})
+			return
+		}
+
+		a.reopenRun(ctx, msg)
+		a.dispatcher.Notify()
+
+		ctx.JSON(http.StatusOK, PutRedriveDeliveryResponse{})
+	}
+}
+
+// handleDeadDelivery fails the task whose stream webhook could not be delivered, so the run does not stall silently
+func (a *Api) handleDeadDelivery(ctx context.Context, msg *repository.OutboxMessage) {
+	a.repo.CreateRunEvent(ctx, msg.RunId, repository.RunEvent{Type: repository.RunEventDispatchFailed, TaskId: msg.TaskId, MatrixKey: msg.MatrixKey})
+
+	a.failTask(ctx, repository.UpdateTaskStatusInput{PipelineId: msg.PipelineId, TaskId: msg.TaskId, RunId: msg.RunId, MatrixKey: msg.MatrixKey})
+}
+
+// reopenRun brings a run that failed on a dead delivery back in progress before the delivery is retried
+func (a *Api) reopenRun(ctx context.Context, msg *repository.OutboxMessage) {
+	a.repo.CreateRunEvent(ctx, msg.RunId, repository.RunEvent{Type: repository.RunEventDispatchRedriven, TaskId: msg.TaskId, MatrixKey: msg.MatrixKey})
+
+	run, err := a.repo.GetRun(ctx, msg.RunId)
+	if err != nil || run.Status != repository.RunFailed {
+		return
+	}
+
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+	if err != nil {
+		return
+	}
+
+	// the retried task gets its full timeout again
+	for _, t := range pl.Tasks {
+		if t.Id == msg.TaskId {
+			a.repo.OpenRunTasks(ctx, run.Id, []primitive.ObjectID{t.Id}, taskDeadlines([]repository.Task{t}, a.taskTimeout, time.Now().UTC()))
+		}
+	}
+
+	a.repo.UpdateRunStatus(ctx, repository.UpdateRunStatusInput{RunId: run.Id, Run: struct{ Status string }{Status: repository.RunInProgress}})
+	a.reportRunStatus(run.Id, repository.RunInProgress)
+	a.acquireSlots(ctx, pl, run.Id)
+
+	if msg.MatrixKey == "" {
+		a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: msg.PipelineId, TaskId: msg.TaskId, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskPending}})
+	}
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNoDeployTask = errors.New("the deployed task is no longer a deploy task of the pipeline")
+
+// outputs deploy tasks report what they deployed with
+const (
+	outputImage    = "image"
+	outputArtifact = "artifact"
+	outputServer   = "server"
+)
+
+func (a *Api) GetDeployments() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		input, err := a.deploymentsInput(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeploymentsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input.Limit, _ = strconv.ParseInt(ctx.Query("limit"), 10, 64)
+
+		deployments, err := a.repo.GetDeployments(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeploymentsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetDeploymentsResponse{Payload: deployments})
+	}
+}
+
+// GetCurrentDeployments returns what every deploy task last deployed to each environment
+func (a *Api) GetCurrentDeployments() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		input, err := a.deploymentsInput(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeploymentsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		deployments, err := a.repo.GetCurrentDeployments(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDeploymentsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetDeploymentsResponse{Payload: deployments})
+	}
+}
+
+// PostRollback starts a run that re-runs the deploy task of a previous deployment with the outputs it was deployed with
+func (a *Api) PostRollback() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+		userId := repository.GetUserFromContext(ctx).Id
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		d, err := a.repo.GetDeployment(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: d.PipelineId})
+
+		if err == nil && deployTask(pl, d.TaskId) == nil {
+			err = ErrNoDeployTask
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		trigger := repository.RunTrigger{Type: repository.RunTriggerRollback, UserId: userId, DeploymentId: d.Id, Ref: d.Ref, CommitSha: d.CommitSha}
+		env, err := a.runEnvironment(ctx, pl, d.Environment, &trigger)
+
+		if err == ErrEnvironmentProtected {
+			ctx.JSON(http.StatusForbidden, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		run, err := a.startRun(context.Background(), pl, &trigger, env)
+
+		if err == ErrRunRejected {
+			ctx.JSON(http.StatusConflict, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if errors.Is(err, dispatcher.ErrNoWebhookSecret) {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostRunResponse{Payload: run})
+	}
+}
+
+// deploymentsInput reads the project, and the optional environment and pipeline filters, of a deployments query
+func (a *Api) deploymentsInput(ctx *gin.Context) (repository.GetDeploymentsInput, error) {
+	pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+	input := repository.GetDeploymentsInput{ProjectId: pid}
+
+	_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+	if err != nil {
+		return input, err
+	}
+
+	if hex, ok := ctx.GetQuery("environmentId"); ok {
+		envId, _ := primitive.ObjectIDFromHex(hex)
+		input.EnvironmentId = &envId
+	}
+
+	if hex := ctx.Query("pipelineId"); hex != "" {
+		plId, _ := primitive.ObjectIDFromHex(hex)
+		input.PipelineId = &plId
+	}
+
+	return input, nil
+}
+
+func deployTask(pl *repository.Pipeline, taskId primitive.ObjectID) *repository.Task {
+	for i, t := range pl.Tasks {
+		if t.Id == taskId && t.Type == repository.TaskTypeDeploy {
+			return &pl.Tasks[i]
+		}
+	}
+
+	return nil
+}
+
+// recordDeployment records a deploy task, or one of its matrix executions, that finished successfully
+func (a *Api) recordDeployment(ctx context.Context, run *repository.Run, pl *repository.Pipeline, input repository.UpdateTaskStatusInput) {
+	t := deployTask(pl, input.TaskId)
+	if t == nil {
+		return
+	}
+
+	d := newDeployment(run, pl, t, input.MatrixKey, input.Task.Outputs)
+
+	// the delivered image is pinned to the digest that was deployed, rollbacks restore exactly that
+	host, image := a.delivery(ctx, run.Id, t.Id, input.MatrixKey)
+	if d.Server == "" {
+		d.Server = host
+	}
+	if image != "" {
+		d.Image = image
+	}
+
+	_, err := a.repo.CreateDeployment(ctx, d)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func newDeployment(run *repository.Run, pl *repository.Pipeline, t *repository.Task, matrixKey string, outputs map[string]string) *repository.Deployment {
+	d := &repository.Deployment{
+		ProjectId:     pl.ProjectId,
+		PipelineId:    pl.Id,
+		TaskId:        t.Id,
+		TaskName:      t.Name,
+		MatrixKey:     matrixKey,
+		EnvironmentId: run.EnvironmentId,
+		Environment:   run.Environment,
+		RunId:         run.Id,
+		Image:         outputs[outputImage],
+		Artifact:      outputs[outputArtifact],
+		Server:        outputs[outputServer],
+		Outputs:       outputs,
+		RunOutputs:    map[string]map[string]string{},
+	}
+
+	for id, o := range run.Outputs {
+		if id != t.Id.Hex() {
+			d.RunOutputs[id] = o
+		}
+	}
+
+	for _, e := range run.Matrix {
+		if e.TaskId == t.Id && e.Key == matrixKey {
+			d.Matrix = e.Values
+		}
+	}
+
+	if tr := run.Trigger; tr != nil {
+		d.TriggerType = tr.Type
+		d.TriggeredBy = tr.UserId
+		d.Author = tr.Author
+		d.CommitSha = tr.CommitSha
+		d.Ref = tr.Ref
+		d.RollbackOf = tr.DeploymentId
+	}
+
+	return d
+}
+
+// delivery returns the server the task's stream webhook was delivered to, or the pull agent that claimed it,
+// and the pinned image it named
+func (a *Api) delivery(ctx context.Context, runId, taskId primitive.ObjectID, matrixKey string) (string, string) {
+	msg, err := a.repo.GetTaskDelivery(ctx, runId, taskId, matrixKey)
+	if err != nil {
+		return "", ""
+	}
+
+	image := deliveredImage(msg.Body)
+
+	if msg.Host != "" {
+		return msg.Host, image
+	}
+
+	if n := len(msg.Attempts); n > 0 && msg.Attempts[n-1].Host != "" {
+		return msg.Attempts[n-1].Host, image
+	}
+
+	if msg.ClaimedBy.IsZero() {
+		return "", image
+	}
+
+	agent, err := a.repo.GetAgent(ctx, msg.ClaimedBy)
+	if err != nil {
+		return "", image
+	}
+
+	if agent.Host != "" {
+		return agent.Host, image
+	}
+
+	return agent.Name, image
+}
+
+// startRollback restores the outputs of the deployment a rollback run targets and re-runs its deploy task alone
+func (a *Api) startRollback(ctx context.Context, run *repository.Run, pl *repository.Pipeline) {
+	d, err := a.repo.GetDeployment(ctx, pl.ProjectId, run.Trigger.DeploymentId)
+
+	var t *repository.Task
+	if err == nil {
+		if t = deployTask(pl, d.TaskId); t == nil {
+			err = ErrNoDeployTask
+		}
+	}
+
+	if err != nil {
+		log.Println(err)
+		a.finishRun(ctx, run, pl.Id, repository.RunFailed)
+		return
+	}
+
+	if run.Outputs == nil {
+		run.Outputs = map[string]map[string]string{}
+	}
+	for id, o := range d.RunOutputs {
+		taskId, _ := primitive.ObjectIDFromHex(id)
+		a.repo.UpdateRunOutputs(ctx, run.Id, taskId, o)
+		run.Outputs[id] = o
+	}
+
+	// the recorded image is deployed as it was, a moved tag must not change what a rollback restores
+	task := *t
+	if d.Image != "" && configImage(task.Config) != "" {
+		task.Config = withConfigImage(task.Config, d.Image)
+	}
+
+	// opened like the tasks of other runs, so a rollback whose agent never reports times out and frees its slots
+	err = a.repo.OpenRunTasks(ctx, run.Id, []primitive.ObjectID{t.Id}, taskDeadlines([]repository.Task{task}, a.taskTimeout, time.Now().UTC()))
+	if err != nil {
+		log.Println(err)
+		a.finishRun(ctx, run, pl.Id, repository.RunFailed)
+		return
+	}
+
+	a.updatePipelineStatus(ctx, pl.Id, types.PipelineBusy)
+
+	if d.MatrixKey == "" {
+		go a.dispatchTask(context.Background(), run, pl, task, nil, "")
+		return
+	}
+
+	// only the execution that was deployed is restored
+	e := repository.MatrixExecution{TaskId: t.Id, Key: d.MatrixKey, Values: d.Matrix, Status: types.TaskPending}
+	err = a.repo.CreateMatrixExecutions(ctx, run.Id, []repository.MatrixExecution{e})
+	if err != nil {
+		log.Println(err)
+		a.finishRun(ctx, run, pl.Id, repository.RunFailed)
+		return
+	}
+
+	a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: t.Id, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskInProgress}})
+
+	go a.dispatchTask(context.Background(), run, pl, task, e.Values, e.Key)
+}
+
+func isRollback(run *repository.Run) bool {
+	return run.Trigger != nil && run.Trigger.Type == repository.RunTriggerRollback
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewDeployment(t *testing.T) {
+	build := repository.Task{Id: primitive.NewObjectID(), Name: "build"}
+	deploy := repository.Task{Id: primitive.NewObjectID(), Name: "deploy", Type: repository.TaskTypeDeploy}
+	pl := &repository.Pipeline{Id: primitive.NewObjectID(), ProjectId: primitive.NewObjectID(), Tasks: []repository.Task{build, deploy}}
+
+	rollbackOf := primitive.NewObjectID()
+	run := &repository.Run{
+		Id:          primitive.NewObjectID(),
+		Environment: "production",
+		Trigger:     &repository.RunTrigger{Type: repository.RunTriggerRollback, CommitSha: "abc123", DeploymentId: rollbackOf},
+		Outputs: map[string]map[string]string{
+			build.Id.Hex():  {"tag": "1.2.0"},
+			deploy.Id.Hex(): {"image": "registry.example.com/app:1.3.0"},
+		},
+		Matrix: []repository.MatrixExecution{{TaskId: deploy.Id, Key: "region=eu", Values: map[string]string{"region": "eu"}}},
+	}
+
+	d := newDeployment(run, pl, deployTask(pl, deploy.Id), "region=eu", map[string]string{"image": "registry.example.com/app:1.2.0", "server": "eu-1"})
+
+	if d.Image != "registry.example.com/app:1.2.0" || d.Server != "eu-1" || d.Environment != "production" || d.CommitSha != "abc123" || d.RollbackOf != rollbackOf {
+		t.Fatal(d)
+	}
+
+	// the deploy task's own outputs are reported again on rollback
+	if !reflect.DeepEqual(d.RunOutputs, map[string]map[string]string{build.Id.Hex(): {"tag": "1.2.0"}}) {
+		t.Fatal(d.RunOutputs)
+	}
+
+	if d.Matrix["region"] != "eu" {
+		t.Fatal(d.Matrix)
+	}
+
+	if deployTask(pl, build.Id) != nil {
+		t.Fatal("build is not a deploy task")
+	}
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (a *Api) handleTaskStatus(ctx context.Context, input repository.UpdateTaskStatusInput) {
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: input.PipelineId})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	run, err := a.taskRun(ctx, pl, input.RunId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventTaskStatus, TaskId: input.TaskId, MatrixKey: input.MatrixKey, Status: input.Task.Status})
+
+	// a pull agent is done with its job once the task settled, its lease must not hand it to another agent
+	switch input.Task.Status {
+	case types.TaskDone, types.TaskFailed, types.TaskCanceled:
+		a.repo.CompleteTaskJobs(ctx, run.Id, input.TaskId, input.MatrixKey)
+	}
+
+	// late reports of a canceled run must not move the pipeline on
+	if repository.IsRunFinished(run.Status) {
+		return
+	}
+
+	if input.Task.Status == types.TaskDone {
+		a.recordDeployment(ctx, run, pl, input)
+	}
+
+	if input.MatrixKey != "" {
+		a.handleMatrixStatus(ctx, run, pl, input)
+		return
+	}
+
+	if input.Task.Status == types.TaskDone && len(input.Task.Outputs) > 0 {
+		a.repo.UpdateRunOutputs(ctx, run.Id, input.TaskId, input.Task.Outputs)
+
+		if run.Outputs == nil {
+			run.Outputs = map[string]map[string]string{}
+		}
+		run.Outputs[input.TaskId.Hex()] = input.Task.Outputs
+	}
+
+	switch input.Task.Status {
+	case types.TaskDone:
+		a.advancePipeline(ctx, run, pl, input.TaskId)
+	case types.TaskInProgress:
+		a.updatePipelineStatus(ctx, pl.Id, types.PipelineBusy)
+	case types.TaskFailed:
+		a.finishRun(ctx, run, pl.Id, repository.RunFailed)
+	case types.TaskCanceled:
+		a.finishRun(ctx, run, pl.Id, repository.RunCanceled)
+	default:
+		a.updatePipelineStatus(ctx, pl.Id, types.PipelineIdle)
+	}
+}
+
+// advancePipeline starts the auto-run tasks downstream of a finished task, and closes the run once no task of it is
+// left running, so sibling branches of a fan-out keep the run open until the last one finishes
+func (a *Api) advancePipeline(ctx context.Context, run *repository.Run, pl *repository.Pipeline, taskId primitive.ObjectID) {
+	// a rollback only re-runs the deploy task
+	if isRollback(run) {
+		a.finishRun(ctx, run, pl.Id, repository.RunDone)
+		return
+	}
+
+	// downstream tasks are opened before the finished one is closed, so the run never looks settled in between
+	if tasks := downstreamTasks(pl, taskId); len(tasks) > 0 {
+		a.startTasks(ctx, run, pl, tasks)
+	}
+
+	updated, err := a.repo.CloseRunTask(ctx, run.Id, taskId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(updated.OpenTasks) == 0 {
+		a.finishRun(ctx, updated, pl.Id, repository.RunDone)
+	}
+}
+
+func (a *Api) startTasks(ctx context.Context, run *repository.Run, pl *repository.Pipeline, tasks []repository.Task) {
+	pStatus := types.PipelineIdle
+
+	ids := make([]primitive.ObjectID, 0, len(tasks))
+	for _, t := range tasks {
+		ids = append(ids, t.Id)
+	}
+
+	if err := a.repo.OpenRunTasks(ctx, run.Id, ids, taskDeadlines(tasks, a.taskTimeout, time.Now().UTC())); err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, t := range tasks {
+		if t.Type == repository.TaskTypeApproval {
+			a.requestApproval(ctx, run, pl.Id, t)
+			pStatus = types.PipelineBusy
+			continue
+		}
+
+		if t.Matrix != nil && len(t.Matrix.Axes) > 0 {
+			a.dispatchMatrix(ctx, run, pl, t)
+			continue
+		}
+
+		a.dispatchTask(ctx, run, pl, t, nil, "")
+	}
+
+	a.updatePipelineStatus(ctx, pl.Id, pStatus)
+}
+
+// dispatchTask queues the stream webhook of a task in the outbox, the dispatcher takes care of delivery
+func (a *Api) dispatchTask(ctx context.Context, run *repository.Run, pl *repository.Pipeline, t repository.Task, matrix map[string]string, matrixKey string) {
+	outputs := upstreamOutputs(run, pl, t)
+
+	arguments, err := a.runArguments(ctx, run, pl)
+
+	var nonce string
+	if err == nil {
+		nonce, err = randomToken()
+	}
+
+	// secrets are referenced by the arguments and the config template only, never by what gets merged into them
+	marked := make([]string, 0, len(arguments))
+	for _, arg := range arguments {
+		marked = append(marked, markSecretRefs(arg, nonce))
+	}
+	arguments = marked
+
+	config, missing := renderConfig(mapConfigStrings(t.Config, func(v string) string { return markSecretRefs(v, nonce) }), outputs, matrix)
+
+	// a task must not run with empty values in place of outputs, e.g. deploy an image without a tag
+	if err == nil && len(missing) > 0 {
+		err = fmt.Errorf("task %s: %w: %s", t.Name, ErrMissingOutput, strings.Join(missing, ", "))
+	}
+
+	if err == nil && t.Type == repository.TaskTypeDeploy {
+		config, err = a.pinImage(ctx, run, t, config)
+	}
+
+	if err != nil {
+		log.Println(err)
+		a.failTask(ctx, repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: t.Id, RunId: run.Id, MatrixKey: matrixKey})
+		return
+	}
+
+	body, _ := json.Marshal(StreamWebhook{Payload: StreamWebhookPayload{
+		StreamWebhookPayload: types.StreamWebhookPayload{PipelineId: types.ObjectId(pl.Id), TaskId: types.ObjectId(t.Id), Arguments: arguments},
+		RunId:                run.Id,
+		Environment:          run.Environment,
+		Trigger:              run.Trigger,
+		Config:               config,
+		Outputs:              outputs,
+		Matrix:               matrix,
+		MatrixKey:            matrixKey,
+	}})
+
+	input := repository.CreateOutboxMessageInput{
+		ProjectId:     pl.ProjectId,
+		RunId:         run.Id,
+		PipelineId:    pl.Id,
+		TaskId:        t.Id,
+		MatrixKey:     matrixKey,
+		EnvironmentId: run.EnvironmentId,
+		Body:          string(body),
+		SecretNonce:   nonce,
+	}
+
+	// an explicit host overrides label routing
+	if t.WebhookHost != "" {
+		input.Host = t.WebhookHost
+		input.Url = dispatcher.StreamWebhookUrl(t.WebhookHost)
+	} else {
+		input.AgentLabels = t.AgentLabels
+	}
+
+	input.Pull = a.isPullJob(ctx, pl.ProjectId, input.Host, input.AgentLabels)
+
+	_, err = a.dispatcher.Enqueue(ctx, &input)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// failTask fails a task, or one execution of a matrix task, as if its agent had reported the failure
+func (a *Api) failTask(ctx context.Context, input repository.UpdateTaskStatusInput) {
+	input.Task = repository.UpdateTaskStatusInputTask{Status: types.TaskFailed}
+
+	if input.MatrixKey == "" {
+		a.repo.UpdateTaskStatus(ctx, &input)
+	}
+
+	a.handleTaskStatus(ctx, input)
+}
+
+func (a *Api) requestApproval(ctx context.Context, run *repository.Run, pipelineId primitive.ObjectID, t repository.Task) {
+	approval := repository.Approval{TaskId: t.Id, RequiredApprovers: 1}
+
+	if t.Approval != nil {
+		approval.Roles = t.Approval.Roles
+		if t.Approval.RequiredApprovers > 1 {
+			approval.RequiredApprovers = t.Approval.RequiredApprovers
+		}
+	}
+
+	if t.Timeout > 0 {
+		approval.ExpiresAt = primitive.NewDateTimeFromTime(time.Now().UTC().Add(time.Duration(t.Timeout) * time.Minute))
+	}
+
+	created, err := a.repo.CreateApproval(ctx, repository.CreateApprovalInput{RunId: run.Id, Approval: approval})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// a run canceled or failed meanwhile is not brought back to awaiting approval
+	if !created {
+		return
+	}
+
+	a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pipelineId, TaskId: t.Id, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskInProgress}})
+	a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventApprovalRequested, TaskId: t.Id})
+	a.reportRunStatus(run.Id, repository.RunAwaitingApproval)
+	a.notifyRun(run.Id, repository.RunAwaitingApproval)
+}
+
+// finishRun closes a run once, late or concurrent reports of the same run finishing are ignored
+func (a *Api) finishRun(ctx context.Context, run *repository.Run, pipelineId primitive.ObjectID, status string) {
+	finished, err := a.repo.FinishRun(ctx, run.Id, status)
+	if err != nil || !finished {
+		return
+	}
+
+	a.repo.CancelApprovals(ctx, run.Id)
+	a.reportRunStatus(run.Id, status)
+	a.notifyRun(run.Id, status)
+	a.repo.ReleaseConcurrencySlots(ctx, run.Id)
+	a.updatePipelineStatus(ctx, pipelineId, types.PipelineIdle)
+	a.dequeue(ctx, run)
+}
+
+func (a *Api) updatePipelineStatus(ctx context.Context, pipelineId primitive.ObjectID, status string) {
+	a.repo.UpdatePipelineStatus(ctx, repository.UpdatePipelineStatusInput{PipelineId: pipelineId, Pipeline: struct{ Status string }{Status: status}})
+}
+
+// taskDeadlines are the deadlines of tasks started at now, those without a timeout of their own get the fallback;
+// approvals expire on their own and are left out
+func taskDeadlines(tasks []repository.Task, fallback time.Duration, now time.Time) []repository.TaskDeadline {
+	var deadlines []repository.TaskDeadline
+
+	for _, t := range tasks {
+		if t.Type == repository.TaskTypeApproval {
+			continue
+		}
+
+		timeout := time.Duration(t.Timeout) * time.Minute
+		if timeout <= 0 {
+			timeout = fallback
+		}
+
+		deadlines = append(deadlines, repository.TaskDeadline{TaskId: t.Id, Deadline: primitive.NewDateTimeFromTime(now.Add(timeout))})
+	}
+
+	return deadlines
+}
+
+// overdueTask returns the open task of a run whose deadline passed first, nil when none did
+func overdueTask(run *repository.Run, now time.Time) *repository.TaskDeadline {
+	var overdue *repository.TaskDeadline
+
+	for i, d := range run.TaskDeadlines {
+		if d.Deadline.Time().After(now) {
+			continue
+		}
+
+		if overdue == nil || d.Deadline < overdue.Deadline {
+			overdue = &run.TaskDeadlines[i]
+		}
+	}
+
+	return overdue
+}
+
+func downstreamTasks(pl *repository.Pipeline, taskId primitive.ObjectID) []repository.Task {
+	var tasks []repository.Task
+
+	for _, t := range pl.Tasks {
+		if t.UpstreamTaskId == taskId && t.AutoRun {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTaskDeadlines(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tasks := []repository.Task{
+		{Id: primitive.NewObjectID(), Name: "build", Timeout: 20},
+		{Id: primitive.NewObjectID(), Name: "test"},
+		{Id: primitive.NewObjectID(), Name: "approve", Type: repository.TaskTypeApproval, Timeout: 600},
+	}
+
+	deadlines := taskDeadlines(tasks, time.Hour, now)
+	if len(deadlines) != 2 {
+		t.Fatalf("expected approvals to be left out, got %v", deadlines)
+	}
+
+	if deadlines[0].TaskId != tasks[0].Id || !deadlines[0].Deadline.Time().Equal(now.Add(20*time.Minute)) {
+		t.Errorf("expected the task timeout, got %v", deadlines[0])
+	}
+
+	if deadlines[1].TaskId != tasks[1].Id || !deadlines[1].Deadline.Time().Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the fallback timeout, got %v", deadlines[1])
+	}
+}
+
+func TestOverdueTask(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) primitive.DateTime { return primitive.NewDateTimeFromTime(now.Add(d)) }
+
+	// a branch still running while another waits for approval
+	run := &repository.Run{Status: repository.RunAwaitingApproval, TaskDeadlines: []repository.TaskDeadline{
+		{TaskId: primitive.NewObjectID(), Deadline: at(time.Minute)},
+		{TaskId: primitive.NewObjectID(), Deadline: at(-time.Minute)},
+		{TaskId: primitive.NewObjectID(), Deadline: at(-time.Hour)},
+	}}
+
+	if overdue := overdueTask(run, now); overdue == nil || overdue.TaskId != run.TaskDeadlines[2].TaskId {
+		t.Fatalf("expected the task overdue first, got %v", overdue)
+	}
+
+	if overdue := overdueTask(run, now.Add(-2*time.Hour)); overdue != nil {
+		t.Fatalf("expected no overdue task, got %v", overdue)
+	}
+}
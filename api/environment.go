@@ -0,0 +1,395 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
+	"github.com/more-than-code/deploybot-service-api/pattern"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrEnvironmentProtected = errors.New("run not allowed by the environment's protection rules")
+
+// environment gates are approvals without a task
+var environmentGate = primitive.NilObjectID
+
+func (a *Api) PostEnvironment() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input repository.CreateEnvironmentInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: input.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = validateEnvironment(input.Name, &input.Protection)
+		if err == nil {
+			if _, e := a.repo.GetEnvironmentByName(ctx, input.ProjectId, input.Name); e == nil {
+				err = fmt.Errorf("environment %s already exists", input.Name)
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		id, err := a.repo.CreateEnvironment(ctx, &input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostEnvironmentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostEnvironmentResponse{Payload: &PostEnvironmentResponsePayload{Id: id}})
+	}
+}
+
+func (a *Api) GetEnvironments() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetEnvironmentsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		envs, err := a.repo.GetEnvironments(ctx, pid)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetEnvironmentsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetEnvironmentsResponse{Payload: envs})
+	}
+}
+
+func (a *Api) PatchEnvironment() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var env repository.UpdateEnvironment
+		err := ctx.BindJSON(&env)
+
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		current, err := a.repo.GetEnvironment(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// members the rules hold back must not be able to lift them, nor change what protected runs get
+		if (env.Protection != nil && !hasRole(project, userId, adminRoles)) || !canChangeEnvironment(project, userId, current) {
+			ctx.JSON(http.StatusForbidden, PatchEnvironmentResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+			return
+		}
+
+		name, protection := current.Name, current.Protection
+		if env.Name != nil {
+			name = *env.Name
+		}
+		if env.Protection != nil {
+			protection = *env.Protection
+		}
+
+		err = validateEnvironment(name, &protection)
+
+		if err == nil && name != current.Name {
+			if _, e := a.repo.GetEnvironmentByName(ctx, pid, name); e == nil {
+				err = fmt.Errorf("environment %s already exists", name)
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.UpdateEnvironment(ctx, repository.UpdateEnvironmentInput{Id: id, ProjectId: pid, Environment: env})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchEnvironmentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		if env.Variables != nil {
+			a.maskers.invalidate(pid)
+		}
+
+		ctx.JSON(http.StatusOK, PatchEnvironmentResponse{})
+	}
+}
+
+func (a *Api) DeleteEnvironment() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		var env *repository.Environment
+		if err == nil {
+			env, err = a.repo.GetEnvironment(ctx, pid, id)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteEnvironmentResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if !canChangeEnvironment(project, userId, env) {
+			ctx.JSON(http.StatusForbidden, DeleteEnvironmentResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+			return
+		}
+
+		// the scoped secrets go first, a failure leaves the environment in place to delete again
+		secrets, err := a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: pid, EnvironmentId: id})
+
+		for _, s := range secrets {
+			var deleted bool
+			if deleted, err = a.repo.DeleteSecret(ctx, pid, id, s.Name); err != nil {
+				break
+			}
+
+			if deleted {
+				a.auditSecret(ctx, &repository.SecretAudit{ProjectId: pid, EnvironmentId: id, SecretName: s.Name, Action: repository.SecretAuditDeleted, UserId: userId})
+			}
+		}
+
+		if err == nil {
+			err = a.repo.DeleteEnvironment(ctx, pid, id)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteEnvironmentResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, DeleteEnvironmentResponse{})
+	}
+}
+
+func validateEnvironment(name string, protection *repository.EnvironmentProtection) error {
+	if name == "" {
+		return errors.New("environment name is required")
+	}
+
+	if protection.RequiredApprovers < 0 {
+		return errors.New("required approvers cannot be negative")
+	}
+
+	return pattern.Validate(protection.Branches...)
+}
+
+// runEnvironment resolves the environment a run targets, the named one or the pipeline's default,
+// and checks the trigger against its protection rules; runs without an environment return nil
+func (a *Api) runEnvironment(ctx context.Context, pl *repository.Pipeline, name string, trigger *repository.RunTrigger) (*repository.Environment, error) {
+	if name == "" {
+		name = pl.Environment
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	env, err := a.repo.GetEnvironmentByName(ctx, pl.ProjectId, name)
+	if err != nil {
+		return nil, fmt.Errorf("environment %s: %w", name, err)
+	}
+
+	p := env.Protection
+
+	if !branchAllowed(&p, pl, trigger) {
+		return nil, ErrEnvironmentProtected
+	}
+
+	if len(p.Roles) > 0 {
+		// runs without a member are checked as the service user, and refused when there is none
+		userId := trigger.UserId
+		if userId.IsZero() {
+			userId = a.serviceUserId
+		}
+
+		if userId.IsZero() {
+			return nil, ErrEnvironmentProtected
+		}
+
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pl.ProjectId, UserId: userId})
+		if err != nil || !hasRole(project, userId, p.Roles) {
+			return nil, ErrEnvironmentProtected
+		}
+	}
+
+	return env, nil
+}
+
+// branchAllowed checks the branch a run builds against the branch rules of an environment. Pull request runs
+// build code that is on no branch yet, under a head ref their author names, so they never pass branch rules
+func branchAllowed(p *repository.EnvironmentProtection, pl *repository.Pipeline, trigger *repository.RunTrigger) bool {
+	if len(p.Branches) == 0 {
+		return true
+	}
+
+	if trigger.Type == repository.RunTriggerGit && trigger.Kind == gitprovider.EventPullRequest {
+		return false
+	}
+
+	return pattern.MatchAny(p.Branches, runBranch(pl, trigger))
+}
+
+// runBranch is the branch a run builds, the pushed one for git triggers and the watched one otherwise
+func runBranch(pl *repository.Pipeline, trigger *repository.RunTrigger) string {
+	if trigger.Type == repository.RunTriggerGit {
+		return trigger.Branch
+	}
+
+	return pl.BranchWatched
+}
+
+// roles allowed to change project-level settings other members are bound by
+var adminRoles = []types.Role{types.RoleOwner, types.RoleAdmin}
+
+var ErrAdminRequired = errors.New("only project owners and admins may do this")
+
+// canChangeEnvironment reports whether a member may change an environment, its variables or its scoped secrets,
+// protected ones are left to owners and admins
+func canChangeEnvironment(project *repository.Project, userId primitive.ObjectID, env *repository.Environment) bool {
+	return !isProtected(&env.Protection) || hasRole(project, userId, adminRoles)
+}
+
+// isProtected reports whether an environment has any rule a member could be held back by
+func isProtected(p *repository.EnvironmentProtection) bool {
+	return len(p.Roles) > 0 || len(p.Branches) > 0 || p.RequiredApprovers > 0
+}
+
+func hasRole(project *repository.Project, userId primitive.ObjectID, roles []types.Role) bool {
+	for _, m := range project.Members {
+		if m.UserId != userId {
+			continue
+		}
+
+		for _, r := range roles {
+			if m.Role == r {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// gateEnvironment holds a run targeting an environment that requires approvals until they are given,
+// it reports whether the run is held
+func (a *Api) gateEnvironment(ctx context.Context, run *repository.Run) bool {
+	if run.EnvironmentId.IsZero() {
+		return false
+	}
+
+	env, err := a.repo.GetEnvironment(ctx, run.ProjectId, run.EnvironmentId)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if env.Protection.RequiredApprovers == 0 {
+		return false
+	}
+
+	approval := repository.Approval{TaskId: environmentGate, Roles: env.Protection.ApproverRoles, RequiredApprovers: env.Protection.RequiredApprovers}
+
+	created, err := a.repo.CreateApproval(ctx, repository.CreateApprovalInput{RunId: run.Id, Approval: approval})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	// a run that finished meanwhile has nothing left to start
+	if !created {
+		return true
+	}
+
+	a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventApprovalRequested})
+	a.reportRunStatus(run.Id, repository.RunAwaitingApproval)
+	a.notifyRun(run.Id, repository.RunAwaitingApproval)
+
+	return true
+}
+
+// mergeArguments overlays the environment variables on the KEY=VALUE pipeline arguments,
+// arguments that are no assignment are kept as they are
+func mergeArguments(arguments []string, variables map[string]string) []string {
+	merged := make([]string, 0, len(arguments)+len(variables))
+	seen := map[string]bool{}
+
+	for _, arg := range arguments {
+		k, _, ok := strings.Cut(arg, "=")
+		if v, override := variables[k]; ok && override {
+			arg = k + "=" + v
+			seen[k] = true
+		}
+		merged = append(merged, arg)
+	}
+
+	keys := make([]string, 0, len(variables))
+	for k := range variables {
+		if !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		merged = append(merged, k+"="+variables[k])
+	}
+
+	return merged
+}
+
+// runArguments returns the arguments tasks of a run receive, merged with the variables of its environment
+func (a *Api) runArguments(ctx context.Context, run *repository.Run, pl *repository.Pipeline) ([]string, error) {
+	if run.EnvironmentId.IsZero() {
+		return pl.Arguments, nil
+	}
+
+	env, err := a.repo.GetEnvironment(ctx, run.ProjectId, run.EnvironmentId)
+	if err != nil {
+		return nil, fmt.Errorf("environment %s: %w", run.Environment, err)
+	}
+
+	return mergeArguments(pl.Arguments, env.Variables), nil
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMergeArguments(t *testing.T) {
+	arguments := []string{"REPLICAS=1", "--verbose", "API_URL=http://localhost"}
+	variables := map[string]string{"API_URL": "https://staging.example.com", "TOKEN": "${{ secrets.TOKEN }}", "DEBUG": "false"}
+
+	merged := mergeArguments(arguments, variables)
+	expected := []string{"REPLICAS=1", "--verbose", "API_URL=https://staging.example.com", "DEBUG=false", "TOKEN=${{ secrets.TOKEN }}"}
+
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatal(merged)
+	}
+
+	if merged := mergeArguments(arguments, nil); !reflect.DeepEqual(merged, arguments) {
+		t.Fatal(merged)
+	}
+}
+
+func TestIsProtected(t *testing.T) {
+	if isProtected(&repository.EnvironmentProtection{}) {
+		t.Error("expected an environment without rules to be unprotected")
+	}
+
+	for _, p := range []repository.EnvironmentProtection{{Branches: []string{"main"}}, {RequiredApprovers: 1}, {Roles: []types.Role{types.RoleAdmin}}} {
+		if !isProtected(&p) {
+			t.Errorf("expected %+v to be protected", p)
+		}
+	}
+}
+
+func TestBranchAllowed(t *testing.T) {
+	p := &repository.EnvironmentProtection{Branches: []string{"main"}}
+	pl := &repository.Pipeline{BranchWatched: "main"}
+
+	push := &repository.RunTrigger{Type: repository.RunTriggerGit, Kind: gitprovider.EventPush, Branch: "main"}
+	if !branchAllowed(p, pl, push) {
+		t.Error("expected a push to main to be allowed")
+	}
+
+	feature := &repository.RunTrigger{Type: repository.RunTriggerGit, Kind: gitprovider.EventPush, Branch: "feature"}
+	if branchAllowed(p, pl, feature) {
+		t.Error("expected a push to another branch to be refused")
+	}
+
+	// a fork can name its head ref after the protected branch
+	pr := &repository.RunTrigger{Type: repository.RunTriggerGit, Kind: gitprovider.EventPullRequest, Branch: "main", TargetBranch: "main", PullRequest: 7}
+	if branchAllowed(p, pl, pr) {
+		t.Error("expected a pull request whose head ref matches the protected branch to be refused")
+	}
+
+	if !branchAllowed(&repository.EnvironmentProtection{}, pl, pr) {
+		t.Error("expected pull requests to reach environments without branch rules")
+	}
+
+	if !branchAllowed(p, pl, &repository.RunTrigger{Type: repository.RunTriggerManual}) {
+		t.Error("expected manual runs to be checked against the watched branch")
+	}
+}
+
+func TestCanChangeEnvironment(t *testing.T) {
+	admin, member := primitive.NewObjectID(), primitive.NewObjectID()
+	project := &repository.Project{Members: []repository.Member{{UserId: admin, Role: types.RoleAdmin}, {UserId: member, Role: types.RoleMember}}}
+
+	open := &repository.Environment{Name: "staging"}
+	protected := &repository.Environment{Name: "production", Protection: repository.EnvironmentProtection{Branches: []string{"main"}}}
+
+	if !canChangeEnvironment(project, member, open) {
+		t.Error("expected members to change unprotected environments")
+	}
+
+	if canChangeEnvironment(project, member, protected) {
+		t.Error("expected members to be kept from changing protected environments")
+	}
+
+	if !canChangeEnvironment(project, admin, protected) {
+		t.Error("expected admins to change protected environments")
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	EventPipelineStatus    = "PIPELINE_STATUS"
+	EventTaskStatus        = "TASK_STATUS"
+	EventRunCreated        = "RUN_CREATED"
+	EventRunStatus         = "RUN_STATUS"
+	EventDispatchDelivered = "DISPATCH_DELIVERED"
+	EventDispatchDead      = "DISPATCH_DEAD"
+)
+
+// StatusEvent is a status transition pushed to dashboards
+type StatusEvent struct {
+	Type       string             `json:"type"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	PipelineId primitive.ObjectID `json:"pipelineId"`
+	RunId      primitive.ObjectID `json:"runId,omitempty"`
+	TaskId     primitive.ObjectID `json:"taskId,omitempty"`
+	MatrixKey  string             `json:"matrixKey,omitempty"`
+	Status     string             `json:"status"`
+	At         time.Time          `json:"at"`
+}
+
+type eventFilter struct {
+	projectId  primitive.ObjectID
+	pipelineId primitive.ObjectID
+}
+
+func (f eventFilter) match(ev StatusEvent) bool {
+	if !f.pipelineId.IsZero() {
+		return ev.PipelineId == f.pipelineId
+	}
+
+	return ev.ProjectId == f.projectId
+}
+
+// eventHub fans status events out to the streams connected to this replica
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan StatusEvent]eventFilter
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[chan StatusEvent]eventFilter{}}
+}
+
+func (h *eventHub) subscribe(f eventFilter) chan StatusEvent {
+	ch := make(chan StatusEvent, 64)
+
+	h.mu.Lock()
+	h.subs[ch] = f
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan StatusEvent) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// publish never blocks, a client too slow to keep up misses events
+func (h *eventHub) publish(ev StatusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, f := range h.subs {
+		if !f.match(ev) {
+			continue
+		}
+
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// statusEvents derives the status events of a change of the pipelines, runs or outbox collections
+func statusEvents(change *repository.ChangeEvent) []StatusEvent {
+	now := time.Now().UTC()
+	updated := change.UpdateDescription.UpdatedFields
+
+	var events []StatusEvent
+
+	switch change.Ns.Coll {
+	case "pipelines":
+		var pl repository.Pipeline
+		if change.OperationType != "update" || bson.Unmarshal(change.FullDocument, &pl) != nil {
+			return nil
+		}
+
+		for field, value := range updated {
+			status, _ := value.(string)
+
+			if field == "status" {
+				events = append(events, StatusEvent{Type: EventPipelineStatus, ProjectId: pl.ProjectId, PipelineId: pl.Id, Status: status, At: now})
+				continue
+			}
+
+			// positional updates are reported as tasks.<index>.status
+			parts := strings.Split(field, ".")
+			if len(parts) != 3 || parts[0] != "tasks" || parts[2] != "status" {
+				continue
+			}
+
+			i, err := strconv.Atoi(parts[1])
+			if err != nil || i >= len(pl.Tasks) {
+				continue
+			}
+
+			events = append(events, StatusEvent{Type: EventTaskStatus, ProjectId: pl.ProjectId, PipelineId: pl.Id, TaskId: pl.Tasks[i].Id, Status: status, At: now})
+		}
+	case "runs":
+		var run repository.Run
+		if bson.Unmarshal(change.FullDocument, &run) != nil {
+			return nil
+		}
+
+		ev := StatusEvent{ProjectId: run.ProjectId, PipelineId: run.PipelineId, RunId: run.Id, Status: run.Status, At: now}
+
+		switch {
+		case change.OperationType == "insert":
+			ev.Type = EventRunCreated
+		case updated["status"] != nil:
+			ev.Type = EventRunStatus
+			ev.Status, _ = updated["status"].(string)
+		default:
+			return nil
+		}
+
+		events = append(events, ev)
+	case "outbox":
+		var msg repository.OutboxMessage
+		if updated["status"] == nil || bson.Unmarshal(change.FullDocument, &msg) != nil {
+			return nil
+		}
+
+		ev := StatusEvent{ProjectId: msg.ProjectId, PipelineId: msg.PipelineId, RunId: msg.RunId, TaskId: msg.TaskId, MatrixKey: msg.MatrixKey, At: now}
+		ev.Status, _ = updated["status"].(string)
+
+		switch ev.Status {
+		case repository.OutboxDelivered:
+			ev.Type = EventDispatchDelivered
+		case repository.OutboxDead:
+			ev.Type = EventDispatchDead
+		default:
+			return nil
+		}
+
+		events = append(events, ev)
+	}
+
+	return events
+}
+
+// WatchEvents follows the database change stream and publishes status events to this replica's streams,
+// resuming where it left off after an error
+func (a *Api) WatchEvents() {
+	var resumeToken bson.Raw
+
+	for {
+		ctx := context.Background()
+
+		stream, err := a.repo.WatchStatusChanges(ctx, resumeToken)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for stream.Next(ctx) {
+			var change repository.ChangeEvent
+			if err := stream.Decode(&change); err != nil {
+				log.Println(err)
+				continue
+			}
+
+			for _, ev := range statusEvents(&change) {
+				a.events.publish(ev)
+			}
+
+			resumeToken = stream.ResumeToken()
+		}
+
+		if err := stream.Err(); err != nil {
+			log.Println(err)
+		}
+
+		stream.Close(ctx)
+		time.Sleep(time.Second)
+	}
+}
+
+// StreamEvents pushes the status events of a project, or of one pipeline, as server-sent events
+func (a *Api) StreamEvents() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var f eventFilter
+		f.projectId, _ = primitive.ObjectIDFromHex(ctx.Query("projectId"))
+		f.pipelineId, _ = primitive.ObjectIDFromHex(ctx.Query("pipelineId"))
+
+		if !f.pipelineId.IsZero() {
+			pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: f.pipelineId})
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, GetPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+			f.projectId = pl.ProjectId
+		}
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: f.projectId, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ch := a.events.subscribe(f)
+		defer a.events.unsubscribe(ch)
+
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+		ctx.Writer.Flush()
+
+		keepalive := time.NewTicker(logStreamKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(ctx.Writer, ": keepalive\n\n")
+			case ev := <-ch:
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(ctx.Writer, "event: %s\ndata: %s\n\n", ev.Type, data)
+			}
+
+			ctx.Writer.Flush()
+		}
+	}
+}
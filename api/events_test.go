@@ -0,0 +1,33 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStatusEvents(t *testing.T) {
+	pl := repository.Pipeline{Id: primitive.NewObjectID(), ProjectId: primitive.NewObjectID(), Tasks: []repository.Task{{Id: primitive.NewObjectID()}, {Id: primitive.NewObjectID()}}}
+	doc, _ := bson.Marshal(pl)
+
+	change := &repository.ChangeEvent{OperationType: "update", FullDocument: doc}
+	change.Ns.Coll = "pipelines"
+	change.UpdateDescription.UpdatedFields = bson.M{"tasks.1.status": "DONE", "tasks.1.updatedat": primitive.DateTime(0)}
+
+	events := statusEvents(change)
+	if len(events) != 1 || events[0].Type != EventTaskStatus || events[0].TaskId != pl.Tasks[1].Id || events[0].Status != "DONE" {
+		t.Fatal(events)
+	}
+
+	hub := newEventHub()
+	mine := hub.subscribe(eventFilter{pipelineId: pl.Id})
+	other := hub.subscribe(eventFilter{projectId: primitive.NewObjectID()})
+
+	hub.publish(events[0])
+
+	if len(mine) != 1 || len(other) != 0 {
+		t.Fatal(len(mine), len(other))
+	}
+}
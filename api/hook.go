@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
+	"github.com/more-than-code/deploybot-service-api/pattern"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PostGitWebhook receives push, tag and pull request webhooks of a git provider and starts the matching auto-run pipelines of the project
+func (a *Api) PostGitWebhook() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		provider, err := gitprovider.Get(ctx.Param("provider"))
+
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, PostGitWebhookResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		pid, _ := primitive.ObjectIDFromHex(ctx.Param("projectId"))
+		project, err := a.repo.GetProjectById(ctx, pid)
+
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, PostGitWebhookResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostGitWebhookResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		secret, err := a.openGitWebhookSecret(project)
+
+		if err != nil {
+			log.Println(err)
+		}
+
+		if secret == "" || provider.Verify(ctx.Request.Header, body, secret) != nil {
+			ctx.JSON(http.StatusUnauthorized, PostGitWebhookResponse{Code: types.CodeClientError, Msg: gitprovider.ErrInvalidSignature.Error()})
+			return
+		}
+
+		events, err := provider.Parse(ctx.Request.Header, body)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostGitWebhookResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		var runIds []primitive.ObjectID
+		for _, ev := range events {
+			ids, err := a.triggerPipelines(context.Background(), project.Id, ev)
+
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, PostGitWebhookResponse{Code: types.CodeServerError, Msg: err.Error()})
+				return
+			}
+
+			runIds = append(runIds, ids...)
+		}
+
+		ctx.JSON(http.StatusOK, PostGitWebhookResponse{Payload: &PostGitWebhookResponsePayload{RunIds: runIds}})
+	}
+}
+
+// triggerPipelines starts a run of every auto-run pipeline of the project watching the event's repository and ref
+func (a *Api) triggerPipelines(ctx context.Context, projectId primitive.ObjectID, ev gitprovider.Event) ([]primitive.ObjectID, error) {
+	pipelines, err := a.matchPipelines(ctx, projectId, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	trigger := repository.RunTrigger{
+		Type:         repository.RunTriggerGit,
+		Provider:     ev.Provider,
+		Kind:         ev.Kind,
+		Repo:         ev.Repo,
+		Ref:          ev.Ref,
+		Branch:       ev.Branch,
+		Tag:          ev.Tag,
+		CommitSha:    ev.CommitSha,
+		Author:       ev.Author,
+		Message:      ev.Message,
+		PullRequest:  ev.PullRequest,
+		TargetBranch: ev.TargetBranch,
+	}
+
+	var runIds []primitive.ObjectID
+	for i := range pipelines {
+		env, err := a.runEnvironment(ctx, &pipelines[i], "", &trigger)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		run, err := a.startRun(ctx, &pipelines[i], &trigger, env)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		runIds = append(runIds, run.Id)
+	}
+
+	return runIds, nil
+}
+
+func (a *Api) matchPipelines(ctx context.Context, projectId primitive.ObjectID, ev gitprovider.Event) ([]repository.Pipeline, error) {
+	autoRun := true
+	output, err := a.repo.GetPipelines(ctx, repository.GetPipelinesInput{ProjectId: projectId, AutoRun: &autoRun})
+	if err != nil {
+		return nil, err
+	}
+
+	var pipelines []repository.Pipeline
+	for _, pl := range output.Items {
+		if ev.MatchesRepo(pl.RepoWatched) && refMatches(&pl, ev) && pathsMatch(&pl, ev) {
+			pipelines = append(pipelines, pl)
+		}
+	}
+
+	return pipelines, nil
+}
+
+// refMatches evaluates the pipeline's branch and tag patterns, BranchWatched counting as one more branch pattern
+func refMatches(pl *repository.Pipeline, ev gitprovider.Event) bool {
+	f := pl.RefFilter
+
+	branches := f.Branches
+	if pl.BranchWatched != "" {
+		branches = append([]string{pl.BranchWatched}, branches...)
+	}
+
+	switch ev.Kind {
+	case gitprovider.EventPullRequest:
+		// branch patterns select the target branch of pull requests
+		return pl.PullRequests && pattern.Filter(branches, f.BranchesIgnore, ev.TargetBranch)
+	case gitprovider.EventTag:
+		// without any filter a pipeline follows every ref, tags included
+		if len(f.Tags) == 0 && len(f.TagsIgnore) == 0 {
+			return len(branches) == 0 && len(f.BranchesIgnore) == 0
+		}
+		return pattern.Filter(f.Tags, f.TagsIgnore, ev.Tag)
+	default:
+		return pattern.Filter(branches, f.BranchesIgnore, ev.Branch)
+	}
+}
+
+// pathsMatch reports whether the push changed a file selected by the pipeline's path patterns,
+// tags and pushes whose changed files are unknown run regardless
+func pathsMatch(pl *repository.Pipeline, ev gitprovider.Event) bool {
+	f := pl.PathFilter
+
+	if ev.Kind == gitprovider.EventTag || ev.ChangedFiles == nil || len(f.Paths)+len(f.PathsIgnore) == 0 {
+		return true
+	}
+
+	for _, file := range ev.ChangedFiles {
+		if pattern.Filter(f.Paths, f.PathsIgnore, file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validatePathFilter(f *repository.PathFilter) error {
+	if f == nil {
+		return nil
+	}
+
+	return pattern.Validate(append(append([]string{}, f.Paths...), f.PathsIgnore...)...)
+}
+
+func validateRefFilter(branchWatched string, f *repository.RefFilter) error {
+	patterns := []string{}
+	if branchWatched != "" {
+		patterns = append(patterns, branchWatched)
+	}
+
+	if f != nil {
+		patterns = append(patterns, f.Branches...)
+		patterns = append(patterns, f.BranchesIgnore...)
+		patterns = append(patterns, f.Tags...)
+		patterns = append(patterns, f.TagsIgnore...)
+	}
+
+	return pattern.Validate(patterns...)
+}
+
+// GetPipelineMatches is a dry run of a git webhook, listing the pipelines a push of the ref would start,
+// the changed files of the push can be given as repeated file query parameters
+func (a *Api) GetPipelineMatches() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+		ref := ctx.Query("ref")
+
+		if !strings.HasPrefix(ref, "refs/") {
+			ref = "refs/heads/" + ref
+		}
+
+		ev := gitprovider.Event{Repo: ctx.Query("repo")}
+		ev.SetRef(ref)
+
+		if files, ok := ctx.GetQueryArray("file"); ok {
+			ev.ChangedFiles = files
+		}
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		var pipelines []repository.Pipeline
+		if err == nil {
+			pipelines, err = a.matchPipelines(ctx, pid, ev)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetPipelinesResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetPipelinesResponse{Payload: &repository.GetPipelinesOutput{TotalCount: len(pipelines), Items: pipelines}})
+	}
+}
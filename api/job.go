@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// how often a long poll looks for new jobs
+const jobPollInterval = time.Second
+
+// Job is a task handed to a pull agent, its payload is what push agents receive as stream webhook
+type Job struct {
+	Id          primitive.ObjectID `json:"id"`
+	RunId       primitive.ObjectID `json:"runId"`
+	PipelineId  primitive.ObjectID `json:"pipelineId"`
+	TaskId      primitive.ObjectID `json:"taskId"`
+	MatrixKey   string             `json:"matrixKey"`
+	Payload     json.RawMessage    `json:"payload"`
+	LeaseSecond int                `json:"leaseSecond"`
+}
+
+// GetJob claims the next job of the pull agent authenticated by X-Agent-Token, waiting up to the wait query
+// parameter in seconds for one; the agent must renew the lease while the job runs or it goes to another agent
+func (a *Api) GetJob() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		agent, err := a.repo.GetAgentByToken(ctx, hashToken(ctx.GetHeader("X-Agent-Token")))
+
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, GetJobResponse{Code: types.CodeClientError, Msg: "unknown agent"})
+			return
+		}
+
+		wait, _ := strconv.Atoi(ctx.Query("wait"))
+		if wait > a.jobWaitMax {
+			wait = a.jobWaitMax
+		}
+		deadline := time.Now().Add(time.Duration(wait) * time.Second)
+
+		input := repository.ClaimJobInput{ProjectId: agent.ProjectId, AgentId: agent.Id, Host: agent.Host, Labels: agent.Labels, Lease: a.jobLease}
+
+		for {
+			msg, err := a.dispatcher.ClaimJob(ctx, input)
+
+			if err == nil {
+				payload, err := a.resolveSecrets(ctx, msg, agent.Host)
+
+				if err != nil {
+					// the lease runs out and the job is claimed again, by then the secret may exist
+					ctx.JSON(http.StatusBadRequest, GetJobResponse{Code: types.CodeServerError, Msg: err.Error()})
+					return
+				}
+
+				ctx.JSON(http.StatusOK, GetJobResponse{Payload: &Job{
+					Id:          msg.Id,
+					RunId:       msg.RunId,
+					PipelineId:  msg.PipelineId,
+					TaskId:      msg.TaskId,
+					MatrixKey:   msg.MatrixKey,
+					Payload:     json.RawMessage(payload),
+					LeaseSecond: int(a.jobLease.Seconds()),
+				}})
+				return
+			}
+
+			if err != mongo.ErrNoDocuments {
+				ctx.JSON(http.StatusBadRequest, GetJobResponse{Code: types.CodeServerError, Msg: err.Error()})
+				return
+			}
+
+			if !time.Now().Add(jobPollInterval).Before(deadline) {
+				ctx.JSON(http.StatusOK, GetJobResponse{})
+				return
+			}
+
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-time.After(jobPollInterval):
+			}
+		}
+	}
+}
+
+// PutJobLease extends the lease of a running job, 409 tells the agent the job was handed to another agent
+func (a *Api) PutJobLease() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.updateJob(ctx, func(id, agentId primitive.ObjectID) (bool, error) {
+			return a.repo.RenewJobLease(ctx, id, agentId, a.jobLease)
+		})
+	}
+}
+
+// PutJobComplete releases a finished job, reporting the final task status does the same
+func (a *Api) PutJobComplete() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.updateJob(ctx, func(id, agentId primitive.ObjectID) (bool, error) {
+			return a.repo.CompleteJob(ctx, id, agentId)
+		})
+	}
+}
+
+func (a *Api) updateJob(ctx *gin.Context, update func(id, agentId primitive.ObjectID) (bool, error)) {
+	agent, err := a.repo.GetAgentByToken(ctx, hashToken(ctx.GetHeader("X-Agent-Token")))
+
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, PutJobResponse{Code: types.CodeClientError, Msg: "unknown agent"})
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+	held, err := update(id, agent.Id)
+
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, PutJobResponse{Code: types.CodeServerError, Msg: err.Error()})
+		return
+	}
+
+	if !held {
+		ctx.JSON(http.StatusConflict, PutJobResponse{Code: types.CodeClientError, Msg: "job is not held by this agent"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, PutJobResponse{LeaseSecond: int(a.jobLease.Seconds())})
+}
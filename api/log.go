@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/logstore"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// largest log slice returned at once
+const maxLogRead = 1 << 20
+
+// a chunk is stored right after its byte range is reserved, a range still missing this long after a later chunk
+// was stored belongs to a failed upload and is skipped
+const logGapGrace = 30 * time.Second
+
+type PostLogsInput struct {
+	RunId     primitive.ObjectID
+	TaskId    primitive.ObjectID
+	MatrixKey string
+	Lines     []string
+}
+
+// LogOutput is a slice of a task log, NextOffset is where reading continues
+type LogOutput struct {
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"nextOffset"`
+	Size       int64  `json:"size"`
+	Content    string `json:"content"`
+}
+
+// PostLogs appends log lines the agent authenticated by X-Agent-Token sends for a task of a run as a new chunk
+func (a *Api) PostLogs() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostLogsInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostLogsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if len(input.Lines) == 0 {
+			ctx.JSON(http.StatusOK, PostLogsResponse{})
+			return
+		}
+
+		_, run, err := a.agentRun(ctx, input.RunId, input.TaskId)
+		if err == ErrUnknownAgent {
+			ctx.JSON(http.StatusUnauthorized, PostLogsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusForbidden, PostLogsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// secrets are masked before storing, so neither reads nor streams ever see them
+		masker, err := a.cachedLogMasker(ctx, run, input.TaskId)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostLogsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		// a private key printed across chunks stays masked until its end marker
+		ref := repository.LogRef{RunId: input.RunId, TaskId: input.TaskId, MatrixKey: input.MatrixKey}
+		open, err := a.repo.GetLogMaskBlock(ctx, ref)
+
+		if err == nil {
+			var left string
+			input.Lines, left = masker.MaskLines(input.Lines, open)
+			err = a.appendLog(ctx, ref, []byte(strings.Join(input.Lines, "\n")+"\n"), len(input.Lines))
+
+			if err == nil && left != open {
+				err = a.repo.SetLogMaskBlock(ctx, ref, left)
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostLogsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostLogsResponse{})
+	}
+}
+
+// appendLog stores the chunk before reserving its byte range, so a failed store reserves nothing; a failed chunk
+// insert leaves a hole readers skip once it outlived logGapGrace
+func (a *Api) appendLog(ctx context.Context, ref repository.LogRef, data []byte, lines int) error {
+	key := fmt.Sprintf("%s/%s/%s", ref.RunId.Hex(), ref.TaskId.Hex(), primitive.NewObjectID().Hex())
+	if ref.MatrixKey != "" {
+		key = fmt.Sprintf("%s/%s/%x/%s", ref.RunId.Hex(), ref.TaskId.Hex(), ref.MatrixKey, primitive.NewObjectID().Hex())
+	}
+
+	if err := a.logStore.Put(ctx, key, data); err != nil {
+		return err
+	}
+
+	seq, offset, err := a.repo.ReserveLogChunk(ctx, ref, int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	return a.repo.CreateLogChunk(ctx, &repository.LogChunk{
+		RunId:     ref.RunId,
+		TaskId:    ref.TaskId,
+		MatrixKey: ref.MatrixKey,
+		Seq:       seq,
+		Offset:    offset,
+		End:       offset + int64(len(data)),
+		Lines:     lines,
+		Key:       key,
+	})
+}
+
+// GetLogs returns a task log from a byte offset, or its last lines with tail
+func (a *Api) GetLogs() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ref, err := a.authorizedLogRef(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetLogsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		offset, _ := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+		tail, _ := strconv.Atoi(ctx.Query("tail"))
+
+		var output *LogOutput
+		if tail > 0 {
+			output, err = a.tailLog(ctx, ref, tail)
+		} else {
+			output, err = a.readLog(ctx, ref, offset, maxLogRead)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetLogsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetLogsResponse{Payload: output})
+	}
+}
+
+// authorizedLogRef reads the log named by the runId, taskId and matrixKey query parameters of a run of the user's projects
+func (a *Api) authorizedLogRef(ctx *gin.Context) (repository.LogRef, error) {
+	runId, _ := primitive.ObjectIDFromHex(ctx.Query("runId"))
+	taskId, _ := primitive.ObjectIDFromHex(ctx.Query("taskId"))
+
+	run, err := a.repo.GetRun(ctx, runId)
+	if err != nil {
+		return repository.LogRef{}, err
+	}
+
+	_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: run.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+	if err != nil {
+		return repository.LogRef{}, err
+	}
+
+	return repository.LogRef{RunId: runId, TaskId: taskId, MatrixKey: ctx.Query("matrixKey")}, nil
+}
+
+// readLog reads up to limit bytes from the offset, stopping at a chunk that is not stored yet unless the hole
+// is older than logGapGrace
+func (a *Api) readLog(ctx context.Context, ref repository.LogRef, offset int64, limit int) (*LogOutput, error) {
+	size, err := a.repo.GetLogSize(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > size {
+		offset = size
+	}
+
+	chunks, err := a.repo.GetLogChunks(ctx, ref, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	pos := offset
+
+	for _, c := range chunks {
+		if buf.Len() >= limit {
+			break
+		}
+
+		if c.Offset > pos {
+			if time.Since(c.CreatedAt.Time()) < logGapGrace {
+				break
+			}
+			pos = c.Offset
+		}
+
+		data, err := a.logStore.Get(ctx, c.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		data = data[pos-c.Offset:]
+		if rest := limit - buf.Len(); len(data) > rest {
+			data = data[:rest]
+		}
+
+		buf.Write(data)
+		pos += int64(len(data))
+	}
+
+	return &LogOutput{Offset: offset, NextOffset: pos, Size: size, Content: buf.String()}, nil
+}
+
+func (a *Api) tailLog(ctx context.Context, ref repository.LogRef, lines int) (*LogOutput, error) {
+	chunks, err := a.repo.GetLastLogChunks(ctx, ref, lines)
+	if err != nil || len(chunks) == 0 {
+		return &LogOutput{}, err
+	}
+
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		data, err := a.logStore.Get(ctx, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+
+	end := chunks[len(chunks)-1].End
+	content := tailLines(buf.Bytes(), lines)
+
+	return &LogOutput{Offset: end - int64(len(content)), NextOffset: end, Size: end, Content: string(content)}, nil
+}
+
+// tailLines returns the last n lines of newline terminated data
+func tailLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+
+	return data
+}
+
+func newLogStore(repo *repository.Repository) logstore.Store {
+	store, err := logstore.NewStore(repo.LogBucket)
+	if err != nil {
+		panic(err)
+	}
+
+	return store
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"testing"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTailLines(t *testing.T) {
+	data := []byte("one\ntwo\nthree\n")
+
+	for n, want := range map[int]string{1: "three\n", 2: "two\nthree\n", 3: "one\ntwo\nthree\n", 5: "one\ntwo\nthree\n"} {
+		if got := string(tailLines(data, n)); got != want {
+			t.Fatal(n, got)
+		}
+	}
+}
+
+func TestTaskFinished(t *testing.T) {
+	taskId := primitive.NewObjectID()
+	ref := repository.LogRef{TaskId: taskId}
+
+	run := &repository.Run{Status: repository.RunInProgress, History: []repository.RunEvent{
+		{Type: repository.RunEventTaskStatus, TaskId: taskId, Status: types.TaskInProgress},
+	}}
+	if taskFinished(run, ref) {
+		t.Fatal("running task reported finished")
+	}
+
+	run.History = append(run.History, repository.RunEvent{Type: repository.RunEventTaskStatus, TaskId: taskId, MatrixKey: "os=linux", Status: types.TaskDone})
+	if taskFinished(run, ref) {
+		t.Fatal("matrix execution settled the task")
+	}
+
+	run.History = append(run.History, repository.RunEvent{Type: repository.RunEventTaskStatus, TaskId: taskId, Status: types.TaskFailed})
+	if !taskFinished(run, ref) {
+		t.Fatal("failed task not finished")
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+const (
+	logStreamPoll      = time.Second
+	logStreamKeepalive = 15 * time.Second
+)
+
+// taskFinished reports whether the task of the log settled in the run, or the run itself ended
+func taskFinished(run *repository.Run, ref repository.LogRef) bool {
+	if repository.IsRunFinished(run.Status) {
+		return true
+	}
+
+	for i := len(run.History) - 1; i >= 0; i-- {
+		ev := run.History[i]
+		if ev.Type != repository.RunEventTaskStatus || ev.TaskId != ref.TaskId || ev.MatrixKey != ref.MatrixKey {
+			continue
+		}
+
+		return ev.Status == types.TaskDone || ev.Status == types.TaskFailed || ev.Status == types.TaskCanceled
+	}
+
+	return false
+}
+
+// writeSse writes one server-sent event, its id is the byte offset to resume from
+func writeSse(w io.Writer, event string, id int64, data string) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\n", id, event)
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// StreamLogs follows a task log as server-sent events until the task settles, like docker logs -f.
+// Clients resume from the offset query parameter or the Last-Event-ID header after reconnecting
+func (a *Api) StreamLogs() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ref, err := a.authorizedLogRef(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetLogsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		offset, _ := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+		if id := ctx.GetHeader("Last-Event-ID"); id != "" {
+			offset, _ = strconv.ParseInt(id, 10, 64)
+		}
+
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+
+		keepalive := time.Now()
+
+		for {
+			// read the run first so lines written before the final status are not missed
+			run, err := a.repo.GetRun(ctx, ref.RunId)
+			if err != nil {
+				writeSse(ctx.Writer, "error", offset, err.Error())
+				return
+			}
+			finished := taskFinished(run, ref)
+
+			for {
+				output, err := a.readLog(ctx, ref, offset, maxLogRead)
+				if err != nil {
+					writeSse(ctx.Writer, "error", offset, err.Error())
+					return
+				}
+
+				if output.Content == "" {
+					break
+				}
+
+				offset = output.NextOffset
+				writeSse(ctx.Writer, "log", offset, output.Content)
+				keepalive = time.Now()
+			}
+
+			if finished {
+				writeSse(ctx.Writer, "end", offset, run.Status)
+				ctx.Writer.Flush()
+				return
+			}
+
+			if time.Since(keepalive) >= logStreamKeepalive {
+				fmt.Fprint(ctx.Writer, ": keepalive\n\n")
+				keepalive = time.Now()
+			}
+
+			ctx.Writer.Flush()
+
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case <-time.After(logStreamPoll):
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/mask"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maskerTtl bounds how long a cached masker is used, other api instances do not see this one's invalidations
+const maskerTtl = 5 * time.Minute
+
+type maskerKey struct {
+	runId  primitive.ObjectID
+	taskId primitive.ObjectID
+}
+
+type cachedMasker struct {
+	projectId primitive.ObjectID
+	masker    *mask.Masker
+	expiresAt time.Time
+}
+
+// maskerCache keeps the masker of each task log being written, so log chunks do not open the referenced secrets again
+type maskerCache struct {
+	mu      sync.Mutex
+	entries map[maskerKey]cachedMasker
+	// bumped by every invalidation of a project, so a masker built meanwhile is not cached
+	generations map[primitive.ObjectID]uint64
+}
+
+func newMaskerCache() *maskerCache {
+	return &maskerCache{entries: map[maskerKey]cachedMasker{}, generations: map[primitive.ObjectID]uint64{}}
+}
+
+// get returns the cached masker of a task log, or nil with the generation a masker built now is cached under
+func (c *maskerCache) get(key maskerKey, projectId primitive.ObjectID, now time.Time) (*mask.Masker, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok && now.Before(e.expiresAt) {
+		return e.masker, 0
+	}
+
+	return nil, c.generations[projectId]
+}
+
+// put caches a masker unless its project was invalidated since the masker was built, expired entries are dropped
+func (c *maskerCache) put(key maskerKey, projectId primitive.ObjectID, generation uint64, masker *mask.Masker, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[projectId] != generation {
+		return
+	}
+
+	for k, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedMasker{projectId: projectId, masker: masker, expiresAt: now.Add(maskerTtl)}
+}
+
+// invalidate drops the maskers of a project, after its secrets or masking rules changed
+func (c *maskerCache) invalidate(projectId primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[projectId]++
+
+	for k, e := range c.entries {
+		if e.projectId == projectId {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// cachedLogMasker returns the cached masker of a task log, building it on the first chunk
+func (a *Api) cachedLogMasker(ctx context.Context, run *repository.Run, taskId primitive.ObjectID) (*mask.Masker, error) {
+	key := maskerKey{runId: run.Id, taskId: taskId}
+	now := time.Now()
+
+	masker, generation := a.maskers.get(key, run.ProjectId, now)
+	if masker != nil {
+		return masker, nil
+	}
+
+	masker, err := a.logMasker(ctx, run, taskId)
+	if err != nil {
+		return nil, err
+	}
+
+	a.maskers.put(key, run.ProjectId, generation, masker, now)
+
+	return masker, nil
+}
+
+// logMasker builds the masker of a task log from the project rules and the secrets passed to the pipeline and task
+func (a *Api) logMasker(ctx context.Context, run *repository.Run, taskId primitive.ObjectID) (*mask.Masker, error) {
+	project, err := a.repo.GetProjectById(ctx, run.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := project.LogMasking
+	secretNames := cfg.SecretNames
+	if len(secretNames) == 0 {
+		secretNames = mask.DefaultSecretNames
+	}
+
+	var config interface{}
+	for _, t := range pl.Tasks {
+		if t.Id == taskId {
+			config = t.Config
+		}
+	}
+
+	arguments, err := a.runArguments(ctx, run, pl)
+	if err != nil {
+		arguments = pl.Arguments
+	}
+
+	values := mask.SecretValues(arguments, config, secretNames)
+
+	// values of referenced secrets, whatever the names they are passed under
+	rawConfig, _ := json.Marshal(config)
+	values = append(values, a.referencedSecretValues(ctx, run.ProjectId, run.EnvironmentId, strings.Join(arguments, "\n"), string(rawConfig))...)
+
+	return mask.New(values, cfg.Patterns, cfg.DisabledRules)
+}
+
+func validateLogMasking(cfg *repository.LogMasking) error {
+	for _, name := range cfg.DisabledRules {
+		if !mask.IsRule(name) {
+			return fmt.Errorf("unknown masking rule %q", name)
+		}
+	}
+
+	return mask.Validate(cfg.Patterns)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/mask"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMaskerCache(t *testing.T) {
+	c := newMaskerCache()
+	pid := primitive.NewObjectID()
+	key := maskerKey{runId: primitive.NewObjectID(), taskId: primitive.NewObjectID()}
+	now := time.Now()
+
+	masker, _ := mask.New([]string{"s3cr3t-value"}, nil, nil)
+
+	cached, generation := c.get(key, pid, now)
+	if cached != nil {
+		t.Fatal("expected an empty cache")
+	}
+
+	c.put(key, pid, generation, masker, now)
+
+	if cached, _ := c.get(key, pid, now.Add(time.Minute)); cached != masker {
+		t.Fatal("expected the masker to be cached")
+	}
+
+	if cached, _ := c.get(key, pid, now.Add(maskerTtl)); cached != nil {
+		t.Error("expected an expired masker to be rebuilt")
+	}
+
+	// a secret rotated while a masker was being built keeps that masker out of the cache
+	c.invalidate(pid)
+
+	if cached, _ := c.get(key, pid, now); cached != nil {
+		t.Fatal("expected the masker to be invalidated")
+	}
+
+	c.put(key, pid, generation, masker, now)
+
+	if cached, _ := c.get(key, pid, now); cached != nil {
+		t.Error("expected a masker built before the invalidation not to be cached")
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// expandMatrix returns every combination of the axes, ordered by axis name and then by value position
+func expandMatrix(axes map[string][]string) []map[string]string {
+	names := make([]string, 0, len(axes))
+	for name, values := range axes {
+		if len(values) == 0 {
+			return nil
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combos := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, v := range axes[name] {
+				c := map[string]string{name: v}
+				for k, cv := range combo {
+					c[k] = cv
+				}
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+
+	return combos
+}
+
+// matrixKey identifies a matrix execution, e.g. arch=arm64,env=prod
+func matrixKey(values map[string]string) string {
+	pairs := make([]string, 0, len(values))
+	for k, v := range values {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// characters output references cannot address
+var outputNameUnsafe = regexp.MustCompile(`[^\w-]`)
+
+// matrixOutputName is the name the output of one matrix execution is merged under, the execution's values follow the
+// name in the order of their axes, e.g. digest_arm64_prod for arch=arm64,env=prod
+func matrixOutputName(name string, values map[string]string) string {
+	axes := make([]string, 0, len(values))
+	for k := range values {
+		axes = append(axes, k)
+	}
+	sort.Strings(axes)
+
+	parts := []string{name}
+	for _, k := range axes {
+		parts = append(parts, outputNameUnsafe.ReplaceAllString(values[k], "-"))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+func (a *Api) dispatchMatrix(ctx context.Context, run *repository.Run, pl *repository.Pipeline, t repository.Task) {
+	combos := expandMatrix(t.Matrix.Axes)
+
+	executions := make([]repository.MatrixExecution, 0, len(combos))
+	for _, values := range combos {
+		executions = append(executions, repository.MatrixExecution{TaskId: t.Id, Key: matrixKey(values), Values: values, Status: types.TaskPending})
+	}
+
+	err := a.repo.CreateMatrixExecutions(ctx, run.Id, executions)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: t.Id, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskInProgress}})
+
+	for _, e := range executions {
+		a.dispatchTask(ctx, run, pl, t, e.Values, e.Key)
+	}
+}
+
+// handleMatrixStatus settles the parent task once all of its executions finish, or on the first failure with fail-fast
+func (a *Api) handleMatrixStatus(ctx context.Context, run *repository.Run, pl *repository.Pipeline, input repository.UpdateTaskStatusInput) {
+	updated, err := a.repo.UpdateMatrixExecutionStatus(ctx, repository.UpdateMatrixExecutionStatusInput{RunId: run.Id, TaskId: input.TaskId, MatrixKey: input.MatrixKey, Task: input.Task})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	failFast := false
+	for _, t := range pl.Tasks {
+		if t.Id == input.TaskId && t.Matrix != nil {
+			failFast = t.Matrix.FailFast
+		}
+	}
+
+	total, done, failed := 0, 0, 0
+	for _, e := range updated.Matrix {
+		if e.TaskId != input.TaskId {
+			continue
+		}
+
+		total++
+		switch e.Status {
+		case types.TaskDone:
+			done++
+		case types.TaskFailed, types.TaskCanceled:
+			failed++
+		}
+	}
+
+	if input.Task.Status == types.TaskInProgress {
+		a.updatePipelineStatus(ctx, pl.Id, types.PipelineBusy)
+	}
+
+	if !(failed > 0 && failFast) && done+failed < total {
+		return
+	}
+
+	settled, err := a.repo.SettleMatrix(ctx, run.Id, input.TaskId)
+	if err != nil || !settled {
+		return
+	}
+
+	if failed > 0 {
+		// siblings still waiting in the outbox or for a pull agent must not start after the task failed
+		a.repo.CancelMatrixExecutions(ctx, run.Id, input.TaskId)
+		a.repo.CancelOutboxMessages(ctx, run.Id, input.TaskId)
+		a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: input.TaskId, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskFailed}})
+		a.finishRun(ctx, run, pl.Id, repository.RunFailed)
+		return
+	}
+
+	if outputs := matrixOutputs(updated.Matrix, input.TaskId); len(outputs) > 0 {
+		a.repo.UpdateRunOutputs(ctx, run.Id, input.TaskId, outputs)
+
+		if updated.Outputs == nil {
+			updated.Outputs = map[string]map[string]string{}
+		}
+		updated.Outputs[input.TaskId.Hex()] = outputs
+	}
+
+	a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: input.TaskId, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskDone}})
+	a.advancePipeline(ctx, updated, pl, input.TaskId)
+}
+
+// matrixOutputs merges the outputs of a matrix task's executions, each under <name>_<matrix values>, e.g. digest_amd64;
+// a name every reporting execution agrees on is also kept as is, so downstream tasks can reference it like a plain output
+func matrixOutputs(executions []repository.MatrixExecution, taskId primitive.ObjectID) map[string]string {
+	outputs := map[string]string{}
+	conflicting := map[string]bool{}
+
+	for _, e := range executions {
+		if e.TaskId != taskId {
+			continue
+		}
+
+		for name, v := range e.Outputs {
+			outputs[matrixOutputName(name, e.Values)] = v
+
+			if prev, ok := outputs[name]; ok && prev != v {
+				conflicting[name] = true
+			}
+			outputs[name] = v
+		}
+	}
+
+	for name := range conflicting {
+		delete(outputs, name)
+	}
+
+	return outputs
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	combos := expandMatrix(map[string][]string{"env": {"dev", "prod"}, "arch": {"amd64", "arm64"}})
+
+	if len(combos) != 4 {
+		t.Fatal(combos)
+	}
+
+	keys := []string{"arch=amd64,env=dev", "arch=amd64,env=prod", "arch=arm64,env=dev", "arch=arm64,env=prod"}
+	for i, c := range combos {
+		if matrixKey(c) != keys[i] {
+			t.Fatal(matrixKey(c))
+		}
+	}
+
+	if combos := expandMatrix(map[string][]string{"arch": {"amd64"}, "env": {}}); len(combos) != 0 {
+		t.Fatal(combos)
+	}
+}
+
+func TestMatrixOutputs(t *testing.T) {
+	taskId := primitive.NewObjectID()
+	executions := []repository.MatrixExecution{
+		{TaskId: taskId, Key: "arch=amd64", Values: map[string]string{"arch": "amd64"}, Outputs: map[string]string{"digest": "sha256:a", "version": "1.2.0"}},
+		{TaskId: taskId, Key: "arch=arm64", Values: map[string]string{"arch": "arm64"}, Outputs: map[string]string{"digest": "sha256:b", "version": "1.2.0"}},
+		{TaskId: primitive.NewObjectID(), Key: "arch=amd64", Values: map[string]string{"arch": "amd64"}, Outputs: map[string]string{"other": "x"}},
+	}
+
+	outputs := matrixOutputs(executions, taskId)
+
+	if len(outputs) != 5 || outputs["digest_amd64"] != "sha256:a" || outputs["digest_arm64"] != "sha256:b" || outputs["version"] != "1.2.0" {
+		t.Fatal(outputs)
+	}
+
+	if _, ok := outputs["digest"]; ok {
+		t.Fatal(outputs)
+	}
+}
+
+func TestMatrixOutputName(t *testing.T) {
+	if name := matrixOutputName("digest", map[string]string{"os": "linux/arm64", "env": "prod"}); name != "digest_prod_linux-arm64" {
+		t.Fatal(name)
+	}
+}
@@ -0,0 +1,431 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/notify"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var runStatusEvents = map[string]string{
+	repository.RunDone:             repository.NotifySucceeded,
+	repository.RunFailed:           repository.NotifyFailed,
+	repository.RunCanceled:         repository.NotifyCanceled,
+	repository.RunAwaitingApproval: repository.NotifyAwaitingApproval,
+}
+
+type PostNotificationSubscriptionInput struct {
+	ProjectId  primitive.ObjectID
+	PipelineId primitive.ObjectID
+	Name       string
+	Channel    repository.NotificationChannel
+	Events     []string
+	Template   repository.NotificationTemplate
+}
+
+func (a *Api) PostNotificationSubscription() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostNotificationSubscriptionInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: input.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// subscriptions to a single pipeline must not reach into another project
+		if !input.PipelineId.IsZero() {
+			var pl *repository.Pipeline
+			pl, err = a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: input.PipelineId})
+
+			if err == nil && pl.ProjectId != input.ProjectId {
+				err = fmt.Errorf("pipeline %s is not part of the project", input.PipelineId.Hex())
+			}
+		}
+
+		if err == nil {
+			err = a.validateSubscription(&input.Channel, input.Events, &input.Template)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		id, err := a.repo.CreateNotificationSubscription(ctx, &repository.CreateNotificationSubscriptionInput{
+			ProjectId:  input.ProjectId,
+			PipelineId: input.PipelineId,
+			Name:       input.Name,
+			Channel:    input.Channel,
+			Events:     input.Events,
+			Template:   input.Template,
+		})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationSubscriptionResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostNotificationSubscriptionResponse{Payload: &PostNotificationSubscriptionResponsePayload{Id: id}})
+	}
+}
+
+func (a *Api) GetNotificationSubscriptions() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetNotificationSubscriptionsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetNotificationSubscriptionsInput{ProjectId: pid}
+		if s := ctx.Query("pipelineId"); s != "" {
+			plId, _ := primitive.ObjectIDFromHex(s)
+			input.PipelineId = &plId
+		}
+
+		subs, err := a.repo.GetNotificationSubscriptions(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetNotificationSubscriptionsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		for i := range subs {
+			subs[i].Channel = redactChannel(subs[i].Channel)
+		}
+
+		ctx.JSON(http.StatusOK, GetNotificationSubscriptionsResponse{Payload: subs})
+	}
+}
+
+func (a *Api) PatchNotificationSubscription() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var sub repository.UpdateNotificationSubscription
+		err := ctx.BindJSON(&sub)
+
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		current, err := a.repo.GetNotificationSubscription(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// validated as merged, since channel, events and template depend on each other
+		channel, events, template := current.Channel, current.Events, current.Template
+		if sub.Channel != nil {
+			unredactChannel(sub.Channel, current.Channel)
+			channel = *sub.Channel
+		}
+		if sub.Events != nil {
+			events = sub.Events
+		}
+		if sub.Template != nil {
+			template = *sub.Template
+		}
+
+		err = a.validateSubscription(&channel, events, &template)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.UpdateNotificationSubscription(ctx, repository.UpdateNotificationSubscriptionInput{Id: id, ProjectId: pid, Subscription: sub})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchNotificationSubscriptionResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PatchNotificationSubscriptionResponse{})
+	}
+}
+
+func (a *Api) DeleteNotificationSubscription() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteNotificationSubscriptionResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.DeleteNotificationSubscription(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteNotificationSubscriptionResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, DeleteNotificationSubscriptionResponse{})
+	}
+}
+
+// PostNotificationTest queues a sample message on the channel of a subscription, rendered with its template
+func (a *Api) PostNotificationTest() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationTestResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		sub, err := a.repo.GetNotificationSubscription(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationTestResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		data := notify.Data{Event: repository.NotifySucceeded, Project: project.Name, Pipeline: "test", RunId: primitive.NilObjectID.Hex(), Status: repository.RunDone}
+		notificationId, err := a.enqueueNotification(ctx, sub, primitive.NilObjectID, data)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostNotificationTestResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostNotificationTestResponse{Payload: &PostNotificationTestResponsePayload{Id: notificationId}})
+	}
+}
+
+// GetNotifications returns the latest notifications of a project with their delivery attempts
+func (a *Api) GetNotifications() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetNotificationsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetNotificationsInput{ProjectId: pid}
+		if s := ctx.Query("runId"); s != "" {
+			runId, _ := primitive.ObjectIDFromHex(s)
+			input.RunId = &runId
+		}
+		if s := ctx.Query("status"); s != "" {
+			input.Status = &s
+		}
+
+		notifications, err := a.repo.GetNotifications(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetNotificationsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		for i := range notifications {
+			notifications[i].Channel = redactChannel(notifications[i].Channel)
+		}
+
+		ctx.JSON(http.StatusOK, GetNotificationsResponse{Payload: notifications})
+	}
+}
+
+// redacted stands in for channel credentials in responses, a patch sending it back keeps the stored value
+const redacted = "***"
+
+// redactChannel hides the credentials of a channel: the path of webhook urls, which holds the token of slack and teams
+// webhooks, and the values of custom headers
+func redactChannel(c repository.NotificationChannel) repository.NotificationChannel {
+	if c.Url != "" {
+		if u, err := url.Parse(c.Url); err == nil && u.Host != "" {
+			c.Url = u.Scheme + "://" + u.Host + "/" + redacted
+		} else {
+			c.Url = redacted
+		}
+	}
+
+	if len(c.Headers) > 0 {
+		headers := map[string]string{}
+		for k := range c.Headers {
+			headers[k] = redacted
+		}
+		c.Headers = headers
+	}
+
+	return c
+}
+
+// unredactChannel puts back the stored url and header values a patch sent as they were returned
+func unredactChannel(c *repository.NotificationChannel, current repository.NotificationChannel) {
+	if c.Url == redactChannel(current).Url {
+		c.Url = current.Url
+	}
+
+	for k, v := range c.Headers {
+		if stored, ok := current.Headers[k]; ok && v == redacted {
+			c.Headers[k] = stored
+		}
+	}
+}
+
+func (a *Api) validateSubscription(channel *repository.NotificationChannel, events []string, template *repository.NotificationTemplate) error {
+	if !a.notifier.HasChannel(channel.Type) {
+		return fmt.Errorf("unknown channel type %q", channel.Type)
+	}
+
+	if channel.Type == notify.ChannelEmail {
+		if len(channel.To) == 0 {
+			return fmt.Errorf("email channels need at least one recipient")
+		}
+
+		for _, to := range channel.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid recipient %q: %w", to, err)
+			}
+		}
+	} else if u, err := url.Parse(channel.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid channel url %q", channel.Url)
+	}
+
+	if len(events) == 0 {
+		return fmt.Errorf("subscriptions need at least one event")
+	}
+
+	for _, e := range events {
+		known := false
+		for _, k := range notify.Events {
+			known = known || e == k
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	return notify.ParseTemplate(*template)
+}
+
+// notifyRun queues the notifications of the subscriptions to the event a run status change maps to,
+// a success after a failed run is a recovery
+func (a *Api) notifyRun(runId primitive.ObjectID, status string) {
+	event, ok := runStatusEvents[status]
+	if !ok {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+
+		run, err := a.repo.GetRun(ctx, runId)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		events := []string{event}
+		if event == repository.NotifySucceeded {
+			if prev, err := a.repo.GetPreviousFinishedRun(ctx, run); err == nil && prev.Status == repository.RunFailed {
+				events = append([]string{repository.NotifyRecovered}, events...)
+			}
+		}
+
+		subs, err := a.repo.GetEventSubscriptions(ctx, run.ProjectId, run.PipelineId, events)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if len(subs) == 0 {
+			return
+		}
+
+		project, err := a.repo.GetProjectById(ctx, run.ProjectId)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for i := range subs {
+			data := notify.Data{Event: firstEvent(events, subs[i].Events), Project: project.Name, Pipeline: pl.Name, RunId: run.Id.Hex(), Status: status, Trigger: run.Trigger}
+
+			if _, err = a.enqueueNotification(ctx, &subs[i], run.Id, data); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// firstEvent returns the first of the events, most specific first, a subscription asked for
+func firstEvent(events, subscribed []string) string {
+	for _, e := range events {
+		for _, s := range subscribed {
+			if e == s {
+				return e
+			}
+		}
+	}
+
+	return events[len(events)-1]
+}
+
+func (a *Api) enqueueNotification(ctx context.Context, sub *repository.NotificationSubscription, runId primitive.ObjectID, data notify.Data) (primitive.ObjectID, error) {
+	subject, body, err := notify.Render(sub.Template, data)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return a.notifier.Enqueue(ctx, &repository.CreateNotificationInput{
+		ProjectId:      sub.ProjectId,
+		SubscriptionId: sub.Id,
+		RunId:          runId,
+		Event:          data.Event,
+		Channel:        sub.Channel,
+		Subject:        subject,
+		Body:           body,
+	})
+}
+
+func (a *Api) RunNotifier() {
+	a.notifier.Run()
+}
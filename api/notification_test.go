@@ -0,0 +1,42 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+func TestRedactChannel(t *testing.T) {
+	channel := repository.NotificationChannel{
+		Type:    "webhook",
+		Url:     "https://hooks.slack.com/services/T000/B000/XXXX?token=abc",
+		Headers: map[string]string{"Authorization": "Bearer t0ken"},
+	}
+
+	redactedChannel := redactChannel(channel)
+
+	if redactedChannel.Url != "https://hooks.slack.com/***" || redactedChannel.Headers["Authorization"] != redacted {
+		t.Fatal(redactedChannel)
+	}
+
+	if channel.Headers["Authorization"] != "Bearer t0ken" {
+		t.Fatal("expected the stored channel to be left as it is")
+	}
+
+	// a patch sending the redacted channel back keeps the stored credentials, new values replace them
+	sent := redactedChannel
+	sent.Headers = map[string]string{"Authorization": redacted, "X-Team": "ops"}
+	unredactChannel(&sent, channel)
+
+	if sent.Url != channel.Url || !reflect.DeepEqual(sent.Headers, map[string]string{"Authorization": "Bearer t0ken", "X-Team": "ops"}) {
+		t.Fatal(sent)
+	}
+
+	sent = repository.NotificationChannel{Type: "webhook", Url: "https://example.com/hook"}
+	unredactChannel(&sent, channel)
+
+	if sent.Url != "https://example.com/hook" {
+		t.Fatal(sent.Url)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"regexp"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StreamWebhookPayload extends the payload agents already understand with run-scoped data
+type StreamWebhookPayload struct {
+	types.StreamWebhookPayload
+	RunId   primitive.ObjectID     `json:"runId"`
+	Trigger *repository.RunTrigger `json:"trigger"`
+	// environment the run targets, its variables are merged into Arguments
+	Environment string                       `json:"environment,omitempty"`
+	Config      interface{}                  `json:"config"`
+	Outputs     map[string]map[string]string `json:"outputs"`
+	// values of a single matrix execution, empty for plain tasks
+	Matrix    map[string]string `json:"matrix,omitempty"`
+	MatrixKey string            `json:"matrixKey,omitempty"`
+}
+
+type StreamWebhook struct {
+	Payload StreamWebhookPayload
+}
+
+// matches ${{ tasks.<task name>.outputs.<key> }}
+var outputRefPattern = regexp.MustCompile(`\$\{\{\s*tasks\.([\w.-]+?)\.outputs\.([\w-]+)\s*\}\}`)
+
+// matches ${{ matrix.<axis> }}
+var matrixRefPattern = regexp.MustCompile(`\$\{\{\s*matrix\.([\w-]+)\s*\}\}`)
+
+// upstreamOutputs collects the outputs of every ancestor of a task, keyed by task name
+func upstreamOutputs(run *repository.Run, pl *repository.Pipeline, t repository.Task) map[string]map[string]string {
+	outputs := map[string]map[string]string{}
+
+	tasks := map[primitive.ObjectID]repository.Task{}
+	for _, pt := range pl.Tasks {
+		tasks[pt.Id] = pt
+	}
+
+	seen := map[primitive.ObjectID]bool{}
+	for id := t.UpstreamTaskId; !id.IsZero() && !seen[id]; {
+		seen[id] = true
+
+		upstream, ok := tasks[id]
+		if !ok {
+			break
+		}
+
+		if values, ok := run.Outputs[id.Hex()]; ok {
+			outputs[upstream.Name] = values
+		}
+
+		id = upstream.UpstreamTaskId
+	}
+
+	return outputs
+}
+
+var ErrMissingOutput = errors.New("task config references outputs no upstream task reported")
+
+// renderConfig substitutes output and matrix references in every string of a task config, references to outputs no
+// upstream task reported are left as they are and returned as tasks.<task name>.outputs.<key>
+func renderConfig(config interface{}, outputs map[string]map[string]string, matrix map[string]string) (interface{}, []string) {
+	var missing []string
+
+	rendered := mapConfigStrings(config, func(v string) string {
+		v = outputRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			m := outputRefPattern.FindStringSubmatch(ref)
+			if value, ok := outputs[m[1]][m[2]]; ok {
+				return value
+			}
+
+			missing = append(missing, "tasks."+m[1]+".outputs."+m[2])
+			return ref
+		})
+		return matrixRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			return matrix[matrixRefPattern.FindStringSubmatch(ref)[1]]
+		})
+	})
+
+	return rendered, missing
+}
+
+// mapConfigStrings applies fn to every string of a task config
+func mapConfigStrings(config interface{}, fn func(string) string) interface{} {
+	switch v := config.(type) {
+	case string:
+		return fn(v)
+	case bson.M:
+		rendered := bson.M{}
+		for k, e := range v {
+			rendered[k] = mapConfigStrings(e, fn)
+		}
+		return rendered
+	case map[string]interface{}:
+		rendered := map[string]interface{}{}
+		for k, e := range v {
+			rendered[k] = mapConfigStrings(e, fn)
+		}
+		return rendered
+	case bson.A:
+		rendered := bson.A{}
+		for _, e := range v {
+			rendered = append(rendered, mapConfigStrings(e, fn))
+		}
+		return rendered
+	case []interface{}:
+		rendered := []interface{}{}
+		for _, e := range v {
+			rendered = append(rendered, mapConfigStrings(e, fn))
+		}
+		return rendered
+	}
+
+	return config
+}
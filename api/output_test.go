@@ -0,0 +1,56 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRenderConfig(t *testing.T) {
+	outputs := map[string]map[string]string{"build": {"image": "app:1.0.2", "digest": "sha256:abc"}}
+
+	config := bson.M{
+		"image": "${{ tasks.build.outputs.image }}",
+		"env":   bson.A{"DIGEST=${{tasks.build.outputs.digest}}", "MISSING=${{ tasks.test.outputs.x }}"},
+	}
+
+	rendered, missing := renderConfig(config, outputs, nil)
+
+	if rendered.(bson.M)["image"] != "app:1.0.2" {
+		t.Fatal(rendered)
+	}
+
+	// a missing output is reported and its reference kept rather than rendered empty
+	env := rendered.(bson.M)["env"].(bson.A)
+	if env[0] != "DIGEST=sha256:abc" || env[1] != "MISSING=${{ tasks.test.outputs.x }}" {
+		t.Fatal(env)
+	}
+
+	if !reflect.DeepEqual(missing, []string{"tasks.test.outputs.x"}) {
+		t.Fatal(missing)
+	}
+
+	if _, missing := renderConfig(bson.M{"image": "${{ tasks.build.outputs.tag }}"}, outputs, nil); len(missing) != 1 {
+		t.Fatal("expected an unknown output of a known task to be reported", missing)
+	}
+}
+
+func TestRenderMatrixOutputs(t *testing.T) {
+	taskId := primitive.NewObjectID()
+	executions := []repository.MatrixExecution{
+		{TaskId: taskId, Key: "arch=amd64", Values: map[string]string{"arch": "amd64"}, Outputs: map[string]string{"digest": "sha256:a"}},
+		{TaskId: taskId, Key: "arch=arm64", Values: map[string]string{"arch": "arm64"}, Outputs: map[string]string{"digest": "sha256:b"}},
+	}
+
+	outputs := map[string]map[string]string{"build": matrixOutputs(executions, taskId)}
+	config := bson.M{"images": "${{ tasks.build.outputs.digest_amd64 }},${{ tasks.build.outputs.digest_arm64 }}"}
+
+	rendered, missing := renderConfig(config, outputs, nil)
+
+	if rendered.(bson.M)["images"] != "sha256:a,sha256:b" || len(missing) != 0 {
+		t.Fatal(rendered, missing)
+	}
+}
@@ -19,6 +19,19 @@ func (a *Api) PostPipeline() gin.HandlerFunc {
 			return
 		}
 
+		err = validateRefFilter(input.BranchWatched, &input.RefFilter)
+		if err == nil {
+			err = validatePathFilter(&input.PathFilter)
+		}
+		if err == nil {
+			err = input.Concurrency.Validate()
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
 		id, err := a.repo.CreatePipeline(ctx, &input)
 
 		if err != nil {
@@ -116,6 +129,24 @@ func (a *Api) PatchPipeline() gin.HandlerFunc {
 			return
 		}
 
+		branchWatched := ""
+		if input.Pipeline.BranchWatched != nil {
+			branchWatched = *input.Pipeline.BranchWatched
+		}
+
+		err = validateRefFilter(branchWatched, input.Pipeline.RefFilter)
+		if err == nil {
+			err = validatePathFilter(input.Pipeline.PathFilter)
+		}
+		if err == nil && input.Pipeline.Concurrency != nil {
+			err = input.Pipeline.Concurrency.Validate()
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
 		err = a.repo.UpdatePipeline(ctx, input)
 
 		if err != nil {
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/pipelinefile"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetPipelineExport returns the pipeline as a yaml file
+func (a *Api) GetPipelineExport() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		pl, err := a.memberPipeline(ctx, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetPipelineExportResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		f, err := pipelinefile.FromPipeline(pl)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetPipelineExportResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		data, err := pipelinefile.Marshal(f)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetPipelineExportResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.Data(http.StatusOK, "application/yaml", data)
+	}
+}
+
+// PostPipelineImport creates a pipeline of the project from the yaml file in the request body
+func (a *Api) PostPipelineImport() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		f, err := parsePipelineFile(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		plan, err := pipelinefile.NewPlan(f, nil, pid, time.Now().UTC())
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostPipelineResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		id, err := a.repo.ImportPipeline(ctx, &plan.Pipeline, plan.Tasks)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostPipelineResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostPipelineResponse{Payload: &PostPipelineResponsePayload{Id: id}})
+	}
+}
+
+// PutPipelineImport applies the yaml file in the request body to the pipeline, creating, updating and deleting
+// tasks to match it; with dryRun=true it only returns the changes
+func (a *Api) PutPipelineImport() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		dryRun, _ := strconv.ParseBool(ctx.Query("dryRun"))
+
+		pl, err := a.memberPipeline(ctx, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutPipelineImportResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		f, err := parsePipelineFile(ctx)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutPipelineImportResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		plan, err := pipelinefile.NewPlan(f, pl, pl.ProjectId, time.Now().UTC())
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutPipelineImportResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if !dryRun && (plan.PipelineChanged || len(plan.Changes) > 0) {
+			var replaced bool
+			replaced, err = a.repo.ReplacePipelineDefinition(ctx, pl.Id, pl.Revision, &plan.Pipeline, plan.Tasks)
+
+			if err == nil && !replaced {
+				ctx.JSON(http.StatusConflict, PutPipelineImportResponse{Code: types.CodeClientError, Msg: "pipeline was changed meanwhile, apply the file again"})
+				return
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutPipelineImportResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PutPipelineImportResponse{Payload: plan})
+	}
+}
+
+// memberPipeline returns a pipeline of a project the user is a member of
+func (a *Api) memberPipeline(ctx *gin.Context, id primitive.ObjectID) (*repository.Pipeline, error) {
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: id})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: pl.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+	if err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+// parsePipelineFile reads the pipeline file of the request body and checks its filters like PostPipeline does
+func parsePipelineFile(ctx *gin.Context) (*pipelinefile.File, error) {
+	data, err := ctx.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := pipelinefile.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	refFilter, pathFilter := repository.RefFilter(f.RefFilter), repository.PathFilter(f.PathFilter)
+
+	err = validateRefFilter(f.BranchWatched, &refFilter)
+	if err == nil {
+		err = validatePathFilter(&pathFilter)
+	}
+
+	return f, err
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
 	"github.com/more-than-code/deploybot-service-api/repository"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -93,13 +94,63 @@ func (a *Api) PatchProject() gin.HandlerFunc {
 			return
 		}
 
-		err = a.repo.UpdateProject(ctx, repository.UpdateProjectInput{Id: id, UserId: repository.GetUserFromContext(ctx).Id, Project: project})
+		if project.LogMasking != nil {
+			if err = validateLogMasking(project.LogMasking); err != nil {
+				ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+		}
+
+		if project.ArtifactRetention != nil {
+			if err = validateArtifactRetention(project.ArtifactRetention); err != nil {
+				ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+		}
+
+		if err = validateRegistries(project.Registries, a.allowInsecureRegistries); err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		userId := repository.GetUserFromContext(ctx).Id
+		current, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: id, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// the api token is sent to the api url and registry logins to the registries, these are left to owners and admins
+		if (project.GitApiUrl != nil || project.GitApiTokenSecret != nil || project.Registries != nil) && !hasRole(current, userId, adminRoles) {
+			ctx.JSON(http.StatusForbidden, PatchProjectResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+			return
+		}
+
+		if project.GitApiUrl != nil && *project.GitApiUrl != "" {
+			if err = gitprovider.CheckApiUrl(*project.GitApiUrl, a.gitApiHosts); err != nil {
+				ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+		}
+
+		// a token set up for one api must not follow the url elsewhere
+		if project.GitApiUrl != nil && *project.GitApiUrl != current.GitApiUrl && project.GitApiTokenSecret == nil {
+			noSecret := ""
+			project.GitApiTokenSecret = &noSecret
+		}
+
+		err = a.repo.UpdateProject(ctx, repository.UpdateProjectInput{Id: id, UserId: userId, Project: project})
 
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, PatchProjectResponse{Code: types.CodeServerError, Msg: err.Error()})
 			return
 		}
 
+		if project.LogMasking != nil {
+			a.maskers.invalidate(id)
+		}
+
 		ctx.JSON(http.StatusOK, PatchProjectResponse{})
 	}
 }
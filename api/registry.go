@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/more-than-code/deploybot-service-api/registry"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// imageConfigKey is the deploy task config entry naming the image to deploy
+const imageConfigKey = "image"
+
+// registrySecretPrefix starts the names of the secrets a registry login may be read from, so a registry entry cannot
+// send other secrets of the project to its host
+const registrySecretPrefix = "REGISTRY_"
+
+var ErrInsecureRegistryLogin = errors.New("logins to plain http registries are not allowed by the server")
+
+func configImage(config interface{}) string {
+	var image interface{}
+
+	switch v := config.(type) {
+	case bson.M:
+		image = v[imageConfigKey]
+	case map[string]interface{}:
+		image = v[imageConfigKey]
+	}
+
+	s, _ := image.(string)
+
+	return s
+}
+
+// withConfigImage returns a copy of the config naming another image
+func withConfigImage(config interface{}, image string) interface{} {
+	switch v := config.(type) {
+	case bson.M:
+		c := bson.M{}
+		for k, e := range v {
+			c[k] = e
+		}
+		c[imageConfigKey] = image
+		return c
+	case map[string]interface{}:
+		c := map[string]interface{}{}
+		for k, e := range v {
+			c[k] = e
+		}
+		c[imageConfigKey] = image
+		return c
+	}
+
+	return config
+}
+
+// deliveredImage returns the image named in the config of a delivered stream webhook
+func deliveredImage(body string) string {
+	var webhook struct {
+		Payload struct {
+			Config interface{} `json:"config"`
+		}
+	}
+
+	if json.Unmarshal([]byte(body), &webhook) != nil {
+		return ""
+	}
+
+	return configImage(webhook.Payload.Config)
+}
+
+// pinImage checks that the image a deploy task config names exists and pins the config to the image's digest,
+// so the deployment cannot drift when the tag moves
+func (a *Api) pinImage(ctx context.Context, run *repository.Run, t repository.Task, config interface{}) (interface{}, error) {
+	image := configImage(config)
+	if image == "" {
+		return config, nil
+	}
+
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	project, err := a.repo.GetProjectById(ctx, run.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	login, err := a.registryLogin(ctx, project, ref.Host, repository.SecretAudit{EnvironmentId: run.EnvironmentId, RunId: run.Id, TaskId: t.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := a.registry.Digest(ctx, ref, login)
+	if err == registry.ErrNotFound {
+		return nil, fmt.Errorf("image %s does not exist", image)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %w", image, err)
+	}
+
+	return withConfigImage(config, ref.Pinned(digest)), nil
+}
+
+// registryLogin opens the secrets holding the project's login to a registry, each resolution is audited like the
+// ones of agent payloads; registries the project does not list are reached anonymously
+func (a *Api) registryLogin(ctx context.Context, project *repository.Project, host string, audit repository.SecretAudit) (registry.Login, error) {
+	for _, r := range project.Registries {
+		if r.Host != host {
+			continue
+		}
+
+		login := registry.Login{Insecure: r.Insecure}
+
+		var names []string
+		for _, name := range []string{r.UsernameSecret, r.PasswordSecret} {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		if len(names) == 0 {
+			return login, nil
+		}
+
+		// entries saved before they were validated are checked again, the login is sent to the host
+		if err := validateRegistry(r, a.allowInsecureRegistries); err != nil {
+			return login, err
+		}
+
+		values, opened, err := a.openSecrets(ctx, project.Id, audit.EnvironmentId, names)
+		if err != nil {
+			return login, fmt.Errorf("registry %s: %w", host, err)
+		}
+
+		login.Username, login.Password = values[r.UsernameSecret], values[r.PasswordSecret]
+
+		for name, s := range opened {
+			entry := audit
+			entry.ProjectId, entry.EnvironmentId, entry.SecretName, entry.Version = project.Id, s.EnvironmentId, name, s.Version
+			entry.Action, entry.Host = repository.SecretAuditResolved, host
+			a.auditSecret(ctx, &entry)
+		}
+
+		return login, nil
+	}
+
+	return registry.Login{}, nil
+}
+
+// pruneImage deletes the manifest of an artifact from its registry, with every tag pointing to it, unless a
+// manifest in use is that one
+func (a *Api) pruneImage(ctx context.Context, project *repository.Project, artifact repository.Artifact, inUse map[string]bool, logins map[string]registry.Login) error {
+	ref, err := registry.ParseReference(artifactRef(artifact))
+	if err != nil {
+		return err
+	}
+
+	digest, err := a.resolveDigest(ctx, project, ref, logins)
+	if err == registry.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if inUse[manifestKey(ref, digest)] {
+		return nil
+	}
+
+	login, err := a.hostLogin(ctx, project, ref.Host, logins)
+	if err != nil {
+		return err
+	}
+
+	ref.Digest = digest
+
+	return a.registry.Delete(ctx, ref, login)
+}
+
+// manifestsInUse resolves the manifests the references point to, keyed by manifestKey; only references to the
+// repositories of the collected artifacts are resolved, tag-only ones through their registry
+func (a *Api) manifestsInUse(ctx context.Context, project *repository.Project, collected []repository.Artifact, refs []string, logins map[string]registry.Login) (map[string]bool, error) {
+	repositories := map[string]bool{}
+	for _, c := range collected {
+		if ref, err := registry.ParseReference(artifactRef(c)); err == nil {
+			repositories[ref.Host+"/"+ref.Repository] = true
+		}
+	}
+
+	inUse := map[string]bool{}
+	for _, s := range refs {
+		ref, err := registry.ParseReference(s)
+		if err != nil || !repositories[ref.Host+"/"+ref.Repository] {
+			continue
+		}
+
+		digest, err := a.resolveDigest(ctx, project, ref, logins)
+		if err == registry.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s, err)
+		}
+
+		inUse[manifestKey(ref, digest)] = true
+	}
+
+	return inUse, nil
+}
+
+// resolveDigest returns the digest a reference is pinned to, or the one its tag points to now
+func (a *Api) resolveDigest(ctx context.Context, project *repository.Project, ref registry.Reference, logins map[string]registry.Login) (string, error) {
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	login, err := a.hostLogin(ctx, project, ref.Host, logins)
+	if err != nil {
+		return "", err
+	}
+
+	return a.registry.Digest(ctx, ref, login)
+}
+
+// hostLogin returns the project's login to a registry, opened once per collection
+func (a *Api) hostLogin(ctx context.Context, project *repository.Project, host string, logins map[string]registry.Login) (registry.Login, error) {
+	if login, ok := logins[host]; ok {
+		return login, nil
+	}
+
+	login, err := a.registryLogin(ctx, project, host, repository.SecretAudit{})
+	if err != nil {
+		return login, err
+	}
+
+	logins[host] = login
+
+	return login, nil
+}
+
+func manifestKey(ref registry.Reference, digest string) string {
+	return ref.Host + "/" + ref.Repository + "@" + digest
+}
+
+func artifactRef(artifact repository.Artifact) string {
+	ref := artifact.Name
+	if artifact.Tag != "" {
+		ref += ":" + artifact.Tag
+	}
+	if artifact.Digest != "" {
+		ref += "@" + artifact.Digest
+	}
+
+	return ref
+}
+
+func validateRegistries(registries []repository.Registry, allowInsecure bool) error {
+	hosts := map[string]bool{}
+
+	for _, r := range registries {
+		if r.Host == "" {
+			return errors.New("registry host is required")
+		}
+
+		if hosts[r.Host] {
+			return fmt.Errorf("registry %s is listed twice", r.Host)
+		}
+		hosts[r.Host] = true
+
+		if err := validateRegistry(r, allowInsecure); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRegistry checks the login of a registry, anonymous registries may use plain http
+func validateRegistry(r repository.Registry, allowInsecure bool) error {
+	if (r.UsernameSecret == "") != (r.PasswordSecret == "") {
+		return fmt.Errorf("registry %s needs both a username and a password secret", r.Host)
+	}
+
+	if r.UsernameSecret == "" {
+		return nil
+	}
+
+	for _, name := range []string{r.UsernameSecret, r.PasswordSecret} {
+		if !strings.HasPrefix(name, registrySecretPrefix) {
+			return fmt.Errorf("registry %s: secret %s must be named %s...", r.Host, name, registrySecretPrefix)
+		}
+	}
+
+	if r.Insecure && !allowInsecure {
+		return fmt.Errorf("registry %s: %w", r.Host, ErrInsecureRegistryLogin)
+	}
+
+	return nil
+}
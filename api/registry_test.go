@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/registry"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConfigImage(t *testing.T) {
+	pinned := "registry.example.com/app:1.2.0@sha256:4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+
+	configs := []interface{}{
+		bson.M{"image": "registry.example.com/app:1.2.0", "replicas": 2},
+		map[string]interface{}{"image": "registry.example.com/app:1.2.0", "replicas": 2},
+	}
+
+	for _, config := range configs {
+		if image := configImage(config); image != "registry.example.com/app:1.2.0" {
+			t.Fatal(config, image)
+		}
+
+		pinnedConfig := withConfigImage(config, pinned)
+		if configImage(pinnedConfig) != pinned || configImage(config) == pinned {
+			t.Fatal(config, pinnedConfig)
+		}
+
+		body, _ := json.Marshal(StreamWebhook{Payload: StreamWebhookPayload{Config: pinnedConfig}})
+		if image := deliveredImage(string(body)); image != pinned {
+			t.Fatal(string(body), image)
+		}
+	}
+
+	if configImage("docker run app") != "" || configImage(bson.M{"image": 1}) != "" {
+		t.Fatal("config without image")
+	}
+}
+
+func TestValidateRegistries(t *testing.T) {
+	valid := []repository.Registry{{Host: "ghcr.io", UsernameSecret: "REGISTRY_GHCR_USER", PasswordSecret: "REGISTRY_GHCR_TOKEN"}, {Host: "localhost:5000", Insecure: true}}
+	if err := validateRegistries(valid, false); err != nil {
+		t.Fatal(err)
+	}
+
+	insecureLogin := []repository.Registry{{Host: "localhost:5000", UsernameSecret: "REGISTRY_USER", PasswordSecret: "REGISTRY_TOKEN", Insecure: true}}
+	if err := validateRegistries(insecureLogin, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][]repository.Registry{
+		{{UsernameSecret: "REGISTRY_USER", PasswordSecret: "REGISTRY_TOKEN"}},
+		{{Host: "ghcr.io", UsernameSecret: "REGISTRY_USER"}},
+		{{Host: "ghcr.io"}, {Host: "ghcr.io"}},
+		{{Host: "ghcr.io", UsernameSecret: "REGISTRY_USER", PasswordSecret: "DATABASE_PASSWORD"}},
+		insecureLogin,
+	} {
+		if validateRegistries(r, false) == nil {
+			t.Fatal(r)
+		}
+	}
+}
+
+func TestPruneImage(t *testing.T) {
+	shared := "sha256:4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+	old := "sha256:0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a"
+	manifests := map[string]string{"1.1.0": shared, "stable": shared, "1.0.0": old}
+	var deleted []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manifest := strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, manifest)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		digest, ok := manifests[manifest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	project := &repository.Project{Registries: []repository.Registry{{Host: host, Insecure: true}}}
+	a := &Api{registry: &registry.Client{Client: srv.Client()}}
+	ctx := context.Background()
+
+	// tag-only artifacts, 1.1.0 shares its manifest with the kept stable tag
+	collected := []repository.Artifact{{Name: host + "/app", Tag: "1.1.0"}, {Name: host + "/app", Tag: "1.0.0"}}
+	logins := map[string]registry.Login{}
+
+	inUse, err := a.manifestsInUse(ctx, project, collected, []string{host + "/app:stable", "other/app:1.0.0"}, logins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range collected {
+		if err = a.pruneImage(ctx, project, c, inUse, logins); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(deleted) != 1 || deleted[0] != old {
+		t.Fatal(deleted)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/pipelinefile"
 	"github.com/more-than-code/deploybot-service-api/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -79,6 +80,100 @@ type PutTaskStatusResponse struct {
 	Msg  string `json:"msg"`
 }
 
+type PostRunResponse struct {
+	Code    int             `json:"code"`
+	Msg     string          `json:"msg"`
+	Payload *repository.Run `json:"payload"`
+}
+
+type GetRunQueueResponsePayload struct {
+	Concurrency repository.ConcurrencyConfig `json:"concurrency"`
+	Slots       []repository.ConcurrencySlot `json:"slots"`
+	Queued      []repository.Run             `json:"queued"`
+}
+
+type GetRunQueueResponse struct {
+	Code    int                         `json:"code"`
+	Msg     string                      `json:"msg"`
+	Payload *GetRunQueueResponsePayload `json:"payload"`
+}
+
+type GetRunsResponse struct {
+	Code    int                       `json:"code"`
+	Msg     string                    `json:"msg"`
+	Payload *repository.GetRunsOutput `json:"payload"`
+}
+
+type GetRunResponse struct {
+	Code    int             `json:"code"`
+	Msg     string          `json:"msg"`
+	Payload *repository.Run `json:"payload"`
+}
+
+type PutApprovalResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetDeliveriesResponse struct {
+	Code    int                                 `json:"code"`
+	Msg     string                              `json:"msg"`
+	Payload *repository.GetOutboxMessagesOutput `json:"payload"`
+}
+
+type GetDeliveryResponse struct {
+	Code    int                       `json:"code"`
+	Msg     string                    `json:"msg"`
+	Payload *repository.OutboxMessage `json:"payload"`
+}
+
+type PutRedriveDeliveryResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type PostWebhookSecretResponsePayload struct {
+	Id     primitive.ObjectID `json:"id"`
+	Secret string             `json:"secret"`
+}
+
+type PostWebhookSecretResponse struct {
+	Code    int                               `json:"code"`
+	Msg     string                            `json:"msg"`
+	Payload *PostWebhookSecretResponsePayload `json:"payload"`
+}
+
+type GetWebhookSecretsResponse struct {
+	Code    int                        `json:"code"`
+	Msg     string                     `json:"msg"`
+	Payload []repository.WebhookSecret `json:"payload"`
+}
+
+type DeleteWebhookSecretResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type PutGitWebhookSecretResponsePayload struct {
+	Secret string `json:"secret"`
+}
+
+type PutGitWebhookSecretResponse struct {
+	Code    int                                 `json:"code"`
+	Msg     string                              `json:"msg"`
+	Payload *PutGitWebhookSecretResponsePayload `json:"payload"`
+}
+
+type PostGitWebhookResponsePayload struct {
+	RunIds []primitive.ObjectID `json:"runIds"`
+}
+
+type PostGitWebhookResponse struct {
+	Code    int                            `json:"code"`
+	Msg     string                         `json:"msg"`
+	Payload *PostGitWebhookResponsePayload `json:"payload"`
+}
+
 type AuthenticationResponse struct {
 	Msg     string                           `json:"msg"`
 	Code    int                              `json:"code"`
@@ -154,3 +249,224 @@ type GetDiskInfoResponse struct {
 	Code    int             `json:"code"`
 	Payload *types.DiskInfo `json:"payload"`
 }
+
+type PutAgentJoinTokenResponsePayload struct {
+	Token string `json:"token"`
+}
+
+type PutAgentJoinTokenResponse struct {
+	Code    int                               `json:"code"`
+	Msg     string                            `json:"msg"`
+	Payload *PutAgentJoinTokenResponsePayload `json:"payload"`
+}
+
+type RegisterAgentResponsePayload struct {
+	Id              primitive.ObjectID `json:"id"`
+	ProjectId       primitive.ObjectID `json:"projectId"`
+	Token           string             `json:"token"`
+	HeartbeatSecond int                `json:"heartbeatSecond"`
+}
+
+type RegisterAgentResponse struct {
+	Code    int                           `json:"code"`
+	Msg     string                        `json:"msg"`
+	Payload *RegisterAgentResponsePayload `json:"payload"`
+}
+
+type PutAgentHeartbeatResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetAgentsResponse struct {
+	Code    int                `json:"code"`
+	Msg     string             `json:"msg"`
+	Payload []repository.Agent `json:"payload"`
+}
+
+type DeleteAgentResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type PostServerUsageResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetServerUsageResponse struct {
+	Code    int                      `json:"code"`
+	Msg     string                   `json:"msg"`
+	Payload []repository.ServerUsage `json:"payload"`
+}
+
+type GetServerAlertsResponse struct {
+	Code    int                      `json:"code"`
+	Msg     string                   `json:"msg"`
+	Payload []repository.ServerAlert `json:"payload"`
+}
+
+type GetJobResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	// nil when no job came up while waiting
+	Payload *Job `json:"payload"`
+}
+
+type PutJobResponse struct {
+	Code        int    `json:"code"`
+	Msg         string `json:"msg"`
+	LeaseSecond int    `json:"leaseSecond"`
+}
+
+type PostLogsResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetLogsResponse struct {
+	Code    int        `json:"code"`
+	Msg     string     `json:"msg"`
+	Payload *LogOutput `json:"payload"`
+}
+
+type PostNotificationSubscriptionResponsePayload struct {
+	Id primitive.ObjectID `json:"id"`
+}
+
+type PostNotificationSubscriptionResponse struct {
+	Code    int                                          `json:"code"`
+	Msg     string                                       `json:"msg"`
+	Payload *PostNotificationSubscriptionResponsePayload `json:"payload"`
+}
+
+type GetNotificationSubscriptionsResponse struct {
+	Code    int                                   `json:"code"`
+	Msg     string                                `json:"msg"`
+	Payload []repository.NotificationSubscription `json:"payload"`
+}
+
+type PatchNotificationSubscriptionResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type DeleteNotificationSubscriptionResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type PostNotificationTestResponsePayload struct {
+	Id primitive.ObjectID `json:"id"`
+}
+
+type PostNotificationTestResponse struct {
+	Code    int                                  `json:"code"`
+	Msg     string                               `json:"msg"`
+	Payload *PostNotificationTestResponsePayload `json:"payload"`
+}
+
+type GetNotificationsResponse struct {
+	Code    int                       `json:"code"`
+	Msg     string                    `json:"msg"`
+	Payload []repository.Notification `json:"payload"`
+}
+
+type PutSecretResponsePayload struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+type PutSecretResponse struct {
+	Code    int                       `json:"code"`
+	Msg     string                    `json:"msg"`
+	Payload *PutSecretResponsePayload `json:"payload"`
+}
+
+type GetSecretsResponse struct {
+	Code    int                 `json:"code"`
+	Msg     string              `json:"msg"`
+	Payload []repository.Secret `json:"payload"`
+}
+
+type DeleteSecretResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetSecretAuditResponse struct {
+	Code    int                      `json:"code"`
+	Msg     string                   `json:"msg"`
+	Payload []repository.SecretAudit `json:"payload"`
+}
+
+type PutSecretsRewrapResponse struct {
+	Code      int    `json:"code"`
+	Msg       string `json:"msg"`
+	Rewrapped int    `json:"rewrapped"`
+}
+
+type PostEnvironmentResponsePayload struct {
+	Id primitive.ObjectID `json:"id"`
+}
+
+type PostEnvironmentResponse struct {
+	Code    int                             `json:"code"`
+	Msg     string                          `json:"msg"`
+	Payload *PostEnvironmentResponsePayload `json:"payload"`
+}
+
+type GetEnvironmentsResponse struct {
+	Code    int                      `json:"code"`
+	Msg     string                   `json:"msg"`
+	Payload []repository.Environment `json:"payload"`
+}
+
+type PatchEnvironmentResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type DeleteEnvironmentResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetDeploymentsResponse struct {
+	Code    int                     `json:"code"`
+	Msg     string                  `json:"msg"`
+	Payload []repository.Deployment `json:"payload"`
+}
+
+type PostArtifactsResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetArtifactsResponse struct {
+	Code    int                   `json:"code"`
+	Msg     string                `json:"msg"`
+	Payload []repository.Artifact `json:"payload"`
+}
+
+type GetArtifactResponse struct {
+	Code    int                  `json:"code"`
+	Msg     string               `json:"msg"`
+	Payload *repository.Artifact `json:"payload"`
+}
+
+type DeleteArtifactResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type GetPipelineExportResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type PutPipelineImportResponse struct {
+	Code    int                `json:"code"`
+	Msg     string             `json:"msg"`
+	Payload *pipelinefile.Plan `json:"payload"`
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNoAgent = errors.New("no healthy agent matches the task's labels")
+
+// routeDelivery picks the agent a message without a fixed host is sent to
+func (a *Api) routeDelivery(ctx context.Context, msg *repository.OutboxMessage) (string, error) {
+	agents, err := a.repo.GetAgents(ctx, repository.GetAgentsInput{ProjectId: msg.ProjectId, Status: repository.AgentOnline})
+	if err != nil {
+		return "", err
+	}
+
+	agent := selectAgent(agentsByMode(agents, repository.AgentPush), msg.AgentLabels)
+	if agent == nil {
+		return "", fmt.Errorf("%w %v", ErrNoAgent, msg.AgentLabels)
+	}
+
+	// the load of the last heartbeat does not know about this task yet
+	if err = a.repo.AddAgentRunning(ctx, agent.Id); err != nil {
+		log.Println(err)
+	}
+
+	return agent.Host, nil
+}
+
+// isPullJob reports whether a task goes to pull agents: its host is a pull agent's, or only pull agents carry its labels
+func (a *Api) isPullJob(ctx context.Context, projectId primitive.ObjectID, host string, labels map[string]string) bool {
+	agents, err := a.repo.GetAgents(ctx, repository.GetAgentsInput{ProjectId: projectId})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if host != "" {
+		for _, agent := range agents {
+			if agent.Host == host {
+				return agent.Mode == repository.AgentPull
+			}
+		}
+
+		return false
+	}
+
+	return labelsPullOnly(agents, labels)
+}
+
+// labelsPullOnly reports whether no push agent but a pull agent carries the labels
+func labelsPullOnly(agents []repository.Agent, labels map[string]string) bool {
+	return selectAgent(agentsByMode(agents, repository.AgentPush), labels) == nil && selectAgent(agentsByMode(agents, repository.AgentPull), labels) != nil
+}
+
+// agentsByMode treats agents registered without a mode as push agents; push agents without a host cannot be
+// reached and are left out, pull agents need none
+func agentsByMode(agents []repository.Agent, mode string) []repository.Agent {
+	var filtered []repository.Agent
+
+	for _, agent := range agents {
+		m := agent.Mode
+		if m == "" {
+			m = repository.AgentPush
+		}
+
+		if m == mode && (m == repository.AgentPull || agent.Host != "") {
+			filtered = append(filtered, agent)
+		}
+	}
+
+	return filtered
+}
+
+func hasLabels(agent *repository.Agent, labels map[string]string) bool {
+	for k, v := range labels {
+		if agent.Labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func agentLoad(agent *repository.Agent) float64 {
+	capacity := agent.Capacity
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return float64(agent.Running) / float64(capacity)
+}
+
+// selectAgent returns the online agent carrying all the labels with the lowest load, the most free disk breaking ties
+func selectAgent(agents []repository.Agent, labels map[string]string) *repository.Agent {
+	var candidates []*repository.Agent
+
+	for i := range agents {
+		if agents[i].Status == repository.AgentOnline && hasLabels(&agents[i], labels) {
+			candidates = append(candidates, &agents[i])
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		li, lj := agentLoad(candidates[i]), agentLoad(candidates[j])
+		if li != lj {
+			return li < lj
+		}
+
+		return candidates[i].DiskInfo.Free > candidates[j].DiskInfo.Free
+	})
+
+	return candidates[0]
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"testing"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+func TestSelectAgent(t *testing.T) {
+	agents := []repository.Agent{
+		{Name: "busy", Host: "a", Status: repository.AgentOnline, Labels: map[string]string{"arch": "arm64"}, Capacity: 2, Running: 2},
+		{Name: "small-disk", Host: "b", Status: repository.AgentOnline, Labels: map[string]string{"arch": "arm64", "role": "builder"}, Capacity: 4, Running: 1, DiskInfo: types.DiskInfo{Free: 10}},
+		{Name: "big-disk", Host: "c", Status: repository.AgentOnline, Labels: map[string]string{"arch": "arm64"}, Capacity: 4, Running: 1, DiskInfo: types.DiskInfo{Free: 100}},
+		{Name: "offline", Host: "d", Status: repository.AgentOffline, Labels: map[string]string{"arch": "arm64"}, Capacity: 4},
+	}
+
+	if a := selectAgent(agents, map[string]string{"arch": "arm64"}); a == nil || a.Name != "big-disk" {
+		t.Fatal(a)
+	}
+
+	if a := selectAgent(agents, map[string]string{"role": "builder"}); a == nil || a.Name != "small-disk" {
+		t.Fatal(a)
+	}
+
+	if a := selectAgent(agents, map[string]string{"arch": "amd64"}); a != nil {
+		t.Fatal(a)
+	}
+}
+
+func TestLabelsPullOnly(t *testing.T) {
+	agents := []repository.Agent{
+		{Name: "nat", Mode: repository.AgentPull, Status: repository.AgentOnline, Labels: map[string]string{"site": "office"}},
+		{Name: "push", Host: "a", Status: repository.AgentOnline, Labels: map[string]string{"site": "cloud"}},
+		{Name: "unreachable", Status: repository.AgentOnline, Labels: map[string]string{"site": "office"}},
+	}
+
+	if !labelsPullOnly(agents, map[string]string{"site": "office"}) {
+		t.Error("expected a host-less pull agent to take the task")
+	}
+
+	if labelsPullOnly(agents, map[string]string{"site": "cloud"}) {
+		t.Error("expected the push agent to take the task")
+	}
+
+	if labelsPullOnly(agents, map[string]string{"site": "lab"}) {
+		t.Error("expected no agent to carry the labels")
+	}
+}
@@ -0,0 +1,413 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type PostRunInput struct {
+	PipelineId primitive.ObjectID
+	// name of the target environment, the pipeline's default when empty
+	Environment string
+}
+
+type ApprovalInput struct {
+	TaskId  primitive.ObjectID
+	Comment string
+}
+
+func (a *Api) PostRun() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostRunInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: input.PipelineId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// service key requests carry no user, they must come from an agent of the pipeline's project and the
+		// environment's protection rules decide for them
+		userId := repository.GetUserFromContext(ctx).Id
+		if userId.IsZero() {
+			err = a.projectAgent(ctx, pl.ProjectId)
+		} else {
+			_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: pl.ProjectId, UserId: userId})
+		}
+
+		if err == ErrUnknownAgent {
+			ctx.JSON(http.StatusUnauthorized, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusForbidden, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		trigger := repository.RunTrigger{Type: repository.RunTriggerManual, UserId: userId}
+		env, err := a.runEnvironment(ctx, pl, input.Environment, &trigger)
+
+		if err == ErrEnvironmentProtected {
+			ctx.JSON(http.StatusForbidden, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		run, err := a.startRun(context.Background(), pl, &trigger, env)
+
+		if err == ErrRunRejected {
+			ctx.JSON(http.StatusConflict, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if errors.Is(err, dispatcher.ErrNoWebhookSecret) {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostRunResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PostRunResponse{Payload: run})
+	}
+}
+
+func (a *Api) GetRunQueue() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		plId, _ := primitive.ObjectIDFromHex(ctx.Query("pipelineId"))
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: plId})
+
+		if err == nil {
+			_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: pl.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunQueueResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		slots, err := a.repo.GetConcurrencySlots(ctx, slotKeys(pl))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunQueueResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		queued, err := a.repo.GetRunQueue(ctx, repository.GetRunQueueInput{PipelineId: pl.Id, ProjectId: pl.ProjectId, ConcurrencyGroup: pl.Concurrency.Group})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunQueueResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetRunQueueResponse{Payload: &GetRunQueueResponsePayload{Concurrency: pl.Concurrency, Slots: slots, Queued: queued}})
+	}
+}
+
+func (a *Api) GetRuns() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		plId, _ := primitive.ObjectIDFromHex(ctx.Query("pipelineId"))
+		pId, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pId, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetRunsInput{PipelineId: plId, ProjectId: pId}
+
+		status, exists := ctx.GetQuery("status")
+		if exists && status != "" {
+			input.Status = &status
+		}
+
+		output, err := a.repo.GetRuns(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetRunsResponse{Payload: output})
+	}
+}
+
+func (a *Api) GetRun() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		run, err := a.repo.GetRun(ctx, id)
+
+		if err == nil {
+			_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: run.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetRunResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetRunResponse{Payload: run})
+	}
+}
+
+func (a *Api) ApproveRun() gin.HandlerFunc {
+	return a.decideApproval(true)
+}
+
+func (a *Api) RejectRun() gin.HandlerFunc {
+	return a.decideApproval(false)
+}
+
+func (a *Api) decideApproval(approved bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input ApprovalInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutApprovalResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		runId, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		user := repository.GetUserFromContext(ctx)
+
+		run, err := a.repo.GetRun(ctx, runId)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutApprovalResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutApprovalResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		err = a.checkApprover(ctx, run, pl.ProjectId, input.TaskId, user.Id)
+
+		if err != nil {
+			ctx.JSON(http.StatusForbidden, PutApprovalResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		approval, err := a.repo.CreateApprovalDecision(ctx, repository.CreateApprovalDecisionInput{RunId: run.Id, TaskId: input.TaskId, Decision: repository.ApprovalDecision{UserId: user.Id, Approved: approved, Comment: input.Comment}})
+
+		if err == mongo.ErrNoDocuments {
+			ctx.JSON(http.StatusBadRequest, PutApprovalResponse{Code: types.CodeClientError, Msg: "approval is not pending or already decided by this user"})
+			return
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutApprovalResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		eventType := repository.RunEventRejected
+		if approved {
+			eventType = repository.RunEventApproved
+		}
+		a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: eventType, TaskId: input.TaskId, UserId: user.Id, Comment: input.Comment})
+
+		ctx.JSON(http.StatusOK, PutApprovalResponse{})
+
+		go a.settleApproval(context.Background(), run, pl, approval)
+	}
+}
+
+func (a *Api) checkApprover(ctx context.Context, run *repository.Run, projectId, taskId, userId primitive.ObjectID) error {
+	approval := pendingApproval(run, taskId)
+	if approval == nil {
+		return errors.New("no pending approval for this task")
+	}
+
+	project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: projectId, UserId: userId})
+	if err != nil {
+		return errors.New("not a member of this project")
+	}
+
+	return allowedApprover(approval, project, userId)
+}
+
+// pendingApproval returns the approval of a task while it waits for decisions
+func pendingApproval(run *repository.Run, taskId primitive.ObjectID) *repository.Approval {
+	for i, ap := range run.Approvals {
+		if ap.TaskId == taskId && ap.Status == repository.ApprovalPending {
+			return &run.Approvals[i]
+		}
+	}
+
+	return nil
+}
+
+// allowedApprover checks the member holds one of the roles an approval is restricted to, if any
+func allowedApprover(approval *repository.Approval, project *repository.Project, userId primitive.ObjectID) error {
+	if len(approval.Roles) == 0 {
+		return nil
+	}
+
+	for _, m := range project.Members {
+		if m.UserId != userId {
+			continue
+		}
+
+		for _, r := range approval.Roles {
+			if m.Role == r {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("role not allowed to approve")
+}
+
+// approvalOutcome is rejected on the first rejection, approved once enough members approved and pending otherwise
+func approvalOutcome(approval *repository.Approval) string {
+	for _, d := range approval.Decisions {
+		if !d.Approved {
+			return repository.ApprovalRejected
+		}
+	}
+
+	if len(approval.Decisions) < approval.RequiredApprovers {
+		return repository.ApprovalPending
+	}
+
+	return repository.ApprovalApproved
+}
+
+// settleApproval resumes or fails the run once an approval has enough decisions; with parallel approvals the run
+// stays awaiting approval until the last one settles, while the approved branch goes on
+func (a *Api) settleApproval(ctx context.Context, run *repository.Run, pl *repository.Pipeline, approval *repository.Approval) {
+	if approval == nil {
+		return
+	}
+
+	switch approvalOutcome(approval) {
+	case repository.ApprovalRejected:
+		a.closeApproval(ctx, run, pl.Id, approval.TaskId, repository.ApprovalRejected)
+		return
+	case repository.ApprovalPending:
+		return
+	}
+
+	settled, err := a.repo.UpdateApprovalStatus(ctx, repository.UpdateApprovalStatusInput{RunId: run.Id, TaskId: approval.TaskId, Status: repository.ApprovalApproved})
+	if err != nil || !settled {
+		return
+	}
+
+	if resumed, err := a.repo.ResumeApprovedRun(ctx, run.Id); err == nil && resumed {
+		a.reportRunStatus(run.Id, repository.RunInProgress)
+	}
+
+	if approval.TaskId == environmentGate {
+		a.startRootTasks(ctx, run, pl)
+		return
+	}
+
+	a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pl.Id, TaskId: approval.TaskId, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskDone}})
+	a.advancePipeline(ctx, run, pl, approval.TaskId)
+}
+
+func (a *Api) closeApproval(ctx context.Context, run *repository.Run, pipelineId, taskId primitive.ObjectID, status string) {
+	settled, err := a.repo.UpdateApprovalStatus(ctx, repository.UpdateApprovalStatusInput{RunId: run.Id, TaskId: taskId, Status: status})
+	if err != nil || !settled {
+		return
+	}
+
+	if taskId != environmentGate {
+		a.repo.UpdateTaskStatus(ctx, &repository.UpdateTaskStatusInput{PipelineId: pipelineId, TaskId: taskId, Task: repository.UpdateTaskStatusInputTask{Status: types.TaskFailed}})
+	}
+	a.finishRun(ctx, run, pipelineId, repository.RunFailed)
+}
+
+// WatchApprovals fails runs whose approval gates time out before they are decided
+func (a *Api) WatchApprovals(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx := context.Background()
+
+		runs, err := a.repo.GetExpiredApprovalRuns(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		now := primitive.NewDateTimeFromTime(time.Now().UTC())
+
+		for i := range runs {
+			run := &runs[i]
+			for _, ap := range run.Approvals {
+				if ap.Status != repository.ApprovalPending || ap.ExpiresAt == 0 || ap.ExpiresAt > now {
+					continue
+				}
+
+				a.repo.CreateRunEvent(ctx, run.Id, repository.RunEvent{Type: repository.RunEventApprovalExpired, TaskId: ap.TaskId})
+				a.closeApproval(ctx, run, run.PipelineId, ap.TaskId, repository.ApprovalExpired)
+			}
+		}
+	}
+}
+
+// ErrRunOfOtherPipeline refuses task reports naming a run of another pipeline than the task's
+var ErrRunOfOtherPipeline = errors.New("run belongs to another pipeline")
+
+// taskRun resolves the run a task status belongs to, opening one when a task was started outside of a run
+func (a *Api) taskRun(ctx context.Context, pl *repository.Pipeline, runId primitive.ObjectID) (*repository.Run, error) {
+	if !runId.IsZero() {
+		run, err := a.repo.GetRun(ctx, runId)
+		if err == nil && run.PipelineId != pl.Id {
+			return nil, ErrRunOfOtherPipeline
+		}
+
+		return run, err
+	}
+
+	run, err := a.repo.GetActiveRun(ctx, pl.Id)
+
+	if err == nil {
+		return run, nil
+	}
+
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	id, err := a.repo.CreateRun(ctx, &repository.CreateRunInput{PipelineId: pl.Id, ProjectId: pl.ProjectId, ConcurrencyGroup: pl.Concurrency.Group})
+	if err != nil {
+		return nil, err
+	}
+
+	// the task is already running, so the slots are only taken to hold back runs triggered meanwhile
+	a.acquireSlots(ctx, pl, id)
+
+	return a.repo.GetRun(ctx, id)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"testing"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApprovalOutcome(t *testing.T) {
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+
+	cases := []struct {
+		decisions []repository.ApprovalDecision
+		want      string
+	}{
+		{[]repository.ApprovalDecision{{UserId: alice, Approved: true}}, repository.ApprovalPending},
+		{[]repository.ApprovalDecision{{UserId: alice, Approved: true}, {UserId: bob, Approved: true}}, repository.ApprovalApproved},
+		{[]repository.ApprovalDecision{{UserId: alice, Approved: true}, {UserId: bob}}, repository.ApprovalRejected},
+		{[]repository.ApprovalDecision{{UserId: alice}}, repository.ApprovalRejected},
+	}
+
+	for i, c := range cases {
+		if got := approvalOutcome(&repository.Approval{RequiredApprovers: 2, Decisions: c.decisions}); got != c.want {
+			t.Errorf("%d: expected %s, got %s", i, c.want, got)
+		}
+	}
+}
+
+func TestCheckApprover(t *testing.T) {
+	build, deploy := primitive.NewObjectID(), primitive.NewObjectID()
+	admin, member := primitive.NewObjectID(), primitive.NewObjectID()
+
+	run := &repository.Run{Approvals: []repository.Approval{
+		{TaskId: build, Status: repository.ApprovalApproved},
+		{TaskId: deploy, Status: repository.ApprovalPending, Roles: []types.Role{types.RoleOwner, types.RoleAdmin}},
+	}}
+	project := &repository.Project{Members: []repository.Member{{UserId: admin, Role: types.RoleAdmin}, {UserId: member, Role: types.RoleMember}}}
+
+	if pendingApproval(run, build) != nil {
+		t.Fatal("expected a settled approval not to be pending")
+	}
+
+	approval := pendingApproval(run, deploy)
+	if approval == nil {
+		t.Fatal("expected the deploy approval to be pending")
+	}
+
+	if err := allowedApprover(approval, project, admin); err != nil {
+		t.Error(err)
+	}
+
+	if allowedApprover(approval, project, member) == nil {
+		t.Error("expected a member without an allowed role to be refused")
+	}
+
+	if err := allowedApprover(&repository.Approval{}, project, member); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,498 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/envelope"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// matches ${{ secrets.<name> }}
+var secretRefPattern = regexp.MustCompile(`\$\{\{\s*secrets\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+type PutSecretInput struct {
+	ProjectId primitive.ObjectID
+	// zero for a project secret
+	EnvironmentId primitive.ObjectID
+	Name          string
+	Value         string
+	Description   *string
+}
+
+// PutSecret creates a secret or rotates it to a new version, the value can never be read back
+func (a *Api) PutSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PutSecretInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: input.ProjectId, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if !secretNamePattern.MatchString(input.Name) {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeClientError, Msg: fmt.Sprintf("invalid secret name %q", input.Name)})
+			return
+		}
+
+		if !input.EnvironmentId.IsZero() {
+			env, err := a.repo.GetEnvironment(ctx, input.ProjectId, input.EnvironmentId)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+
+			if !canChangeEnvironment(project, userId, env) {
+				ctx.JSON(http.StatusForbidden, PutSecretResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+				return
+			}
+		}
+
+		current, err := a.repo.GetSecret(ctx, input.ProjectId, input.EnvironmentId, input.Name)
+
+		if err != nil && err != mongo.ErrNoDocuments {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		version := 1
+		if current != nil {
+			version = current.Version + 1
+		}
+
+		sealed, err := a.keyring.Seal([]byte(input.Value), secretAad(input.ProjectId, input.EnvironmentId, input.Name, version))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		sv := repository.SecretVersion{
+			Version:    version,
+			KeyId:      sealed.KeyId,
+			WrappedKey: sealed.WrappedKey,
+			Ciphertext: sealed.Ciphertext,
+			CreatedBy:  userId,
+			CreatedAt:  primitive.NewDateTimeFromTime(time.Now().UTC()),
+		}
+
+		action := repository.SecretAuditCreated
+
+		if current == nil {
+			description := ""
+			if input.Description != nil {
+				description = *input.Description
+			}
+
+			var created bool
+			created, err = a.repo.CreateSecret(ctx, &repository.CreateSecretInput{ProjectId: input.ProjectId, EnvironmentId: input.EnvironmentId, Name: input.Name, Description: description, Version: sv})
+			if err == nil && !created {
+				err = errors.New("secret was changed concurrently, try again")
+			}
+		} else {
+			action = repository.SecretAuditRotated
+
+			var added bool
+			added, err = a.repo.AddSecretVersion(ctx, &repository.AddSecretVersionInput{ProjectId: input.ProjectId, EnvironmentId: input.EnvironmentId, Name: input.Name, Description: input.Description, Version: sv})
+			if err == nil && !added {
+				err = errors.New("secret was changed concurrently, try again")
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		a.maskers.invalidate(input.ProjectId)
+		a.auditSecret(ctx, &repository.SecretAudit{ProjectId: input.ProjectId, EnvironmentId: input.EnvironmentId, SecretName: input.Name, Version: version, Action: action, UserId: userId})
+
+		ctx.JSON(http.StatusOK, PutSecretResponse{Payload: &PutSecretResponsePayload{Name: input.Name, Version: version}})
+	}
+}
+
+func (a *Api) GetSecrets() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetSecretsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		envId, _ := primitive.ObjectIDFromHex(ctx.Query("environmentId"))
+
+		secrets, err := a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: pid, EnvironmentId: envId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetSecretsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetSecretsResponse{Payload: secrets})
+	}
+}
+
+func (a *Api) DeleteSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+		envId, _ := primitive.ObjectIDFromHex(ctx.Query("environmentId"))
+		name := ctx.Param("name")
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		if !envId.IsZero() {
+			env, err := a.repo.GetEnvironment(ctx, pid, envId)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, DeleteSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+				return
+			}
+
+			if !canChangeEnvironment(project, userId, env) {
+				ctx.JSON(http.StatusForbidden, DeleteSecretResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+				return
+			}
+		}
+
+		deleted, err := a.repo.DeleteSecret(ctx, pid, envId, name)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		if deleted {
+			a.maskers.invalidate(pid)
+			a.auditSecret(ctx, &repository.SecretAudit{ProjectId: pid, EnvironmentId: envId, SecretName: name, Action: repository.SecretAuditDeleted, UserId: userId})
+		}
+
+		ctx.JSON(http.StatusOK, DeleteSecretResponse{})
+	}
+}
+
+// GetSecretAudit returns who wrote the secrets of a project and which runs they were resolved for
+func (a *Api) GetSecretAudit() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetSecretAuditResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		limit, _ := strconv.ParseInt(ctx.Query("limit"), 10, 64)
+
+		audit, err := a.repo.GetSecretAudit(ctx, repository.GetSecretAuditInput{ProjectId: pid, SecretName: ctx.Query("name"), Limit: limit})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetSecretAuditResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetSecretAuditResponse{Payload: audit})
+	}
+}
+
+// PutSecretsRewrap wraps the data keys of a project's secret versions and webhook secrets sealed under retired master keys
+// with the current one, and seals webhook secrets, the git one included, kept in plaintext; once every project is rewrapped the retired keys can
+// be dropped from the config
+func (a *Api) PutSecretsRewrap() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretsRewrapResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		envs, err := a.repo.GetEnvironments(ctx, pid)
+
+		scopes := []primitive.ObjectID{primitive.NilObjectID}
+		for _, env := range envs {
+			scopes = append(scopes, env.Id)
+		}
+
+		var secrets []repository.Secret
+		for _, envId := range scopes {
+			if err != nil {
+				break
+			}
+
+			var scoped []repository.Secret
+			scoped, err = a.scopeSecrets(ctx, pid, envId)
+			secrets = append(secrets, scoped...)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretsRewrapResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		rewrapped := 0
+
+		for _, s := range secrets {
+			for _, v := range s.Versions {
+				if v.KeyId == a.keyring.Current() {
+					continue
+				}
+
+				sealed, err := a.keyring.Rewrap(&envelope.Sealed{KeyId: v.KeyId, WrappedKey: v.WrappedKey, Ciphertext: v.Ciphertext})
+				if err == nil {
+					err = a.repo.UpdateSecretVersionKey(ctx, s.Id, v.Version, sealed.KeyId, sealed.WrappedKey)
+				}
+
+				if err != nil {
+					ctx.JSON(http.StatusBadRequest, PutSecretsRewrapResponse{Code: types.CodeServerError, Msg: fmt.Sprintf("%s version %d: %s", s.Name, v.Version, err), Rewrapped: rewrapped})
+					return
+				}
+
+				a.auditSecret(ctx, &repository.SecretAudit{ProjectId: pid, EnvironmentId: s.EnvironmentId, SecretName: s.Name, Version: v.Version, Action: repository.SecretAuditRewrapped, UserId: userId})
+				rewrapped++
+			}
+		}
+
+		n, err := a.rewrapWebhookSecrets(ctx, pid)
+		rewrapped += n
+
+		if err == nil {
+			var sealed bool
+			if sealed, err = a.rewrapGitWebhookSecret(ctx, project); sealed {
+				rewrapped++
+			}
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutSecretsRewrapResponse{Code: types.CodeServerError, Msg: err.Error(), Rewrapped: rewrapped})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, PutSecretsRewrapResponse{Rewrapped: rewrapped})
+	}
+}
+
+// scopeSecrets returns the secrets of a project or environment with their encrypted versions
+func (a *Api) scopeSecrets(ctx context.Context, projectId, environmentId primitive.ObjectID) ([]repository.Secret, error) {
+	secrets, err := a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: projectId, EnvironmentId: environmentId})
+	if err != nil || len(secrets) == 0 {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		names = append(names, s.Name)
+	}
+
+	return a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: projectId, EnvironmentId: environmentId, Names: names})
+}
+
+// secretAad binds a ciphertext to its secret, so values cannot be swapped between secrets, scopes or versions
+func secretAad(projectId, environmentId primitive.ObjectID, name string, version int) []byte {
+	if environmentId.IsZero() {
+		return []byte(fmt.Sprintf("%s/%s/%d", projectId.Hex(), name, version))
+	}
+
+	return []byte(fmt.Sprintf("%s/%s/%s/%d", projectId.Hex(), environmentId.Hex(), name, version))
+}
+
+// getScopedSecrets returns the named secrets visible to an environment, its own ones shadowing those of the project
+func (a *Api) getScopedSecrets(ctx context.Context, projectId, environmentId primitive.ObjectID, names []string) (map[string]repository.Secret, error) {
+	secrets, err := a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: projectId, Names: names})
+	if err != nil {
+		return nil, err
+	}
+
+	if !environmentId.IsZero() {
+		scoped, err := a.repo.GetSecrets(ctx, repository.GetSecretsInput{ProjectId: projectId, EnvironmentId: environmentId, Names: names})
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, scoped...)
+	}
+
+	byName := map[string]repository.Secret{}
+	for _, s := range secrets {
+		byName[s.Name] = s
+	}
+
+	return byName, nil
+}
+
+func (a *Api) openSecretVersion(s *repository.Secret, v *repository.SecretVersion) ([]byte, error) {
+	return a.keyring.Open(&envelope.Sealed{KeyId: v.KeyId, WrappedKey: v.WrappedKey, Ciphertext: v.Ciphertext}, secretAad(s.ProjectId, s.EnvironmentId, s.Name, v.Version))
+}
+
+func secretRefs(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, m := range secretRefPattern.FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+
+	return names
+}
+
+// openSecrets decrypts the current versions of the named secrets visible to an environment, every name must exist
+func (a *Api) openSecrets(ctx context.Context, projectId, environmentId primitive.ObjectID, names []string) (map[string]string, map[string]*repository.Secret, error) {
+	secrets, err := a.getScopedSecrets(ctx, projectId, environmentId, names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]string{}
+	opened := map[string]*repository.Secret{}
+
+	for _, name := range names {
+		s, ok := secrets[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("secret %s does not exist", name)
+		}
+
+		for i := range s.Versions {
+			if s.Versions[i].Version != s.Version {
+				continue
+			}
+
+			plaintext, err := a.openSecretVersion(&s, &s.Versions[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("secret %s: %w", name, err)
+			}
+
+			values[name] = string(plaintext)
+			opened[name] = &s
+		}
+	}
+
+	return values, opened, nil
+}
+
+// markSecretRefs turns the secret references of trusted text, the pipeline arguments and a task's own config
+// template, into references only resolveSecrets of the message carrying the nonce resolves. Trigger data, matrix
+// values and upstream outputs are merged after marking, references they bring in stay literal
+func markSecretRefs(text, nonce string) string {
+	return secretRefPattern.ReplaceAllString(text, "${{ sealed."+nonce+".$1 }}")
+}
+
+func markedSecretRefPattern(nonce string) *regexp.Regexp {
+	return regexp.MustCompile(`\$\{\{ sealed\.` + regexp.QuoteMeta(nonce) + `\.([A-Za-z_][A-Za-z0-9_]*) \}\}`)
+}
+
+// markedSecretRefs returns the names of the secrets marked for a message
+func markedSecretRefs(text, nonce string) []string {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, m := range markedSecretRefPattern(nonce).FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+
+	return names
+}
+
+// resolveSecrets substitutes the marked secret references of an outbox message body right before it goes to an agent,
+// so resolved values are never stored; every resolution is audited
+func (a *Api) resolveSecrets(ctx context.Context, msg *repository.OutboxMessage, host string) ([]byte, error) {
+	if msg.SecretNonce == "" {
+		return []byte(msg.Body), nil
+	}
+
+	names := markedSecretRefs(msg.Body, msg.SecretNonce)
+	if len(names) == 0 {
+		return []byte(msg.Body), nil
+	}
+
+	values, opened, err := a.openSecrets(ctx, msg.ProjectId, msg.EnvironmentId, names)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := markedSecretRefPattern(msg.SecretNonce)
+	body := pattern.ReplaceAllStringFunc(msg.Body, func(ref string) string {
+		// references sit inside json strings
+		quoted, _ := json.Marshal(values[pattern.FindStringSubmatch(ref)[1]])
+		return string(quoted[1 : len(quoted)-1])
+	})
+
+	for _, name := range names {
+		s := opened[name]
+		a.auditSecret(ctx, &repository.SecretAudit{ProjectId: msg.ProjectId, EnvironmentId: s.EnvironmentId, SecretName: name, Version: s.Version, Action: repository.SecretAuditResolved, RunId: msg.RunId, TaskId: msg.TaskId, Host: host})
+	}
+
+	return []byte(body), nil
+}
+
+// referencedSecretValues returns every version of the secrets referenced in the texts, for masking, without auditing
+func (a *Api) referencedSecretValues(ctx context.Context, projectId, environmentId primitive.ObjectID, texts ...string) []string {
+	var names []string
+	for _, text := range texts {
+		names = append(names, secretRefs(text)...)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	secrets, err := a.getScopedSecrets(ctx, projectId, environmentId, names)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	var values []string
+	for _, s := range secrets {
+		for i := range s.Versions {
+			if plaintext, err := a.openSecretVersion(&s, &s.Versions[i]); err == nil {
+				values = append(values, string(plaintext))
+			}
+		}
+	}
+
+	return values
+}
+
+func (a *Api) auditSecret(ctx context.Context, audit *repository.SecretAudit) {
+	if err := a.repo.CreateSecretAudit(ctx, audit); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSecretRefs(t *testing.T) {
+	body := `{"arguments":["TOKEN=${{ secrets.API_TOKEN }}"],"config":{"password":"${{secrets.DB_PASSWORD}}","again":"${{ secrets.API_TOKEN }}","bad":"${{ secrets.1X }}"}}`
+
+	names := secretRefs(body)
+	if !reflect.DeepEqual(names, []string{"API_TOKEN", "DB_PASSWORD"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestMarkedSecretRefs(t *testing.T) {
+	config := bson.M{"password": "${{ secrets.DB_PASSWORD }}", "title": "${{ tasks.build.outputs.title }}"}
+	outputs := map[string]map[string]string{"build": {"title": "${{ secrets.PROD_KEY }}"}}
+
+	marked := mapConfigStrings(config, func(v string) string { return markSecretRefs(v, "n1") })
+	rendered, _ := renderConfig(marked, outputs, nil)
+	body, _ := json.Marshal(rendered)
+
+	if names := markedSecretRefs(string(body), "n1"); !reflect.DeepEqual(names, []string{"DB_PASSWORD"}) {
+		t.Fatalf("expected only the template reference, got %v", names)
+	}
+
+	if names := markedSecretRefs(string(body), "n2"); len(names) != 0 {
+		t.Fatalf("expected no references under another nonce, got %v", names)
+	}
+}
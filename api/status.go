@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/more-than-code/deploybot-service-api/gitprovider"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var runStatusStates = map[string]struct{ state, description string }{
+	repository.RunQueued:           {gitprovider.StatePending, "Queued"},
+	repository.RunAwaitingApproval: {gitprovider.StatePending, "Awaiting approval"},
+	repository.RunInProgress:       {gitprovider.StateRunning, "In progress"},
+	repository.RunDone:             {gitprovider.StateSuccess, "Succeeded"},
+	repository.RunFailed:           {gitprovider.StateFailure, "Failed"},
+	repository.RunCanceled:         {gitprovider.StateCanceled, "Canceled"},
+}
+
+// statusQueue holds the statuses of each run still to be reported, in the order of the transitions
+type statusQueue struct {
+	mu sync.Mutex
+	// a run has an entry while its reporter goroutine is running
+	pending map[primitive.ObjectID][]string
+}
+
+// push queues a status and tells whether the run has no reporter running yet
+func (q *statusQueue) push(runId primitive.ObjectID, status string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	statuses, running := q.pending[runId]
+	q.pending[runId] = append(statuses, status)
+
+	return !running
+}
+
+// pop takes the next status of a run, once none is left the reporter is done
+func (q *statusQueue) pop(runId primitive.ObjectID) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	statuses := q.pending[runId]
+	if len(statuses) == 0 {
+		delete(q.pending, runId)
+		return "", false
+	}
+
+	q.pending[runId] = statuses[1:]
+
+	return statuses[0], true
+}
+
+// reportRunStatus reports a status change of a git triggered run back to the provider as a commit status,
+// projects without an api token secret are skipped; the statuses of a run are sent one at a time and in order,
+// so the provider never ends up showing an earlier one
+func (a *Api) reportRunStatus(runId primitive.ObjectID, status string) {
+	if _, ok := runStatusStates[status]; !ok {
+		return
+	}
+
+	if !a.statusReports.push(runId, status) {
+		return
+	}
+
+	go func() {
+		for {
+			status, ok := a.statusReports.pop(runId)
+			if !ok {
+				return
+			}
+
+			a.sendRunStatus(runId, status)
+		}
+	}()
+}
+
+func (a *Api) sendRunStatus(runId primitive.ObjectID, status string) {
+	s := runStatusStates[status]
+	ctx := context.Background()
+
+	run, err := a.repo.GetRun(ctx, runId)
+	if err != nil || run.Trigger == nil || run.Trigger.Type != repository.RunTriggerGit || run.Trigger.CommitSha == "" {
+		return
+	}
+
+	reporter, ok := a.statusReporters[run.Trigger.Provider]
+	if !ok {
+		return
+	}
+
+	project, err := a.repo.GetProjectById(ctx, run.ProjectId)
+	if err != nil || project.GitApiTokenSecret == "" {
+		return
+	}
+
+	// urls set before they were checked must not receive the token either
+	if project.GitApiUrl != "" {
+		if err = gitprovider.CheckApiUrl(project.GitApiUrl, a.gitApiHosts); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	name := project.GitApiTokenSecret
+	values, opened, err := a.openSecrets(ctx, project.Id, primitive.NilObjectID, []string{name})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for name, secret := range opened {
+		a.auditSecret(ctx, &repository.SecretAudit{ProjectId: project.Id, SecretName: name, Version: secret.Version, Action: repository.SecretAuditResolved, RunId: run.Id})
+	}
+
+	pl, err := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: run.PipelineId})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = reporter.ReportStatus(ctx, project.GitApiUrl, values[name], gitprovider.Status{
+		Repo:        run.Trigger.Repo,
+		CommitSha:   run.Trigger.CommitSha,
+		State:       s.state,
+		Context:     "deploybot/" + pl.Name,
+		Description: s.description,
+	})
+
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -1,10 +1,7 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -52,6 +49,15 @@ func (a *Api) GetTask() gin.HandlerFunc {
 			return
 		}
 
+		if runId, err := primitive.ObjectIDFromHex(ctx.Query("runId")); err == nil {
+			run, err := a.repo.GetRun(ctx, runId)
+			pl, plErr := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: pid})
+
+			if err == nil && plErr == nil {
+				task.Config, _ = renderConfig(task.Config, upstreamOutputs(run, pl, *task), nil)
+			}
+		}
+
 		ctx.JSON(http.StatusOK, GetTaskResponse{Payload: &GetTaskResponsePayload{Task: *task}})
 	}
 }
@@ -108,42 +114,61 @@ func (a *Api) PutTaskStatus() gin.HandlerFunc {
 			return
 		}
 
-		err = a.repo.UpdateTaskStatus(ctx, &input)
+		a.updateTaskStatus(ctx, input)
+	}
+}
+
+// PutAgentTaskStatus takes the task status reports of agents, which authenticate with X-Agent-Token like for their
+// logs and may only report on runs of their project
+func (a *Api) PutAgentTaskStatus() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input repository.UpdateTaskStatusInput
+		err := ctx.BindJSON(&input)
 
 		if err != nil {
-			ctx.JSON(http.StatusBadRequest, PutTaskStatusResponse{Code: types.CodeServerError, Msg: err.Error()})
+			ctx.JSON(http.StatusBadRequest, PutTaskStatusResponse{Code: types.CodeClientError, Msg: err.Error()})
 			return
 		}
 
-		ctx.JSON(http.StatusOK, PutTaskStatusResponse{})
+		_, _, err = a.agentRun(ctx, input.RunId, input.TaskId)
+		if err == ErrUnknownAgent {
+			ctx.JSON(http.StatusUnauthorized, PutTaskStatusResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusForbidden, PutTaskStatusResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
 
-		go func() {
-			pStatus := types.PipelineIdle
+		a.updateTaskStatus(ctx, input)
+	}
+}
 
-			if input.Task.Status == types.TaskDone {
-				autoRun := true
-				pl, _ := a.repo.GetPipeline(ctx, repository.GetPipelineInput{Id: input.PipelineId, TaskFilter: repository.TaskFilter{UpstreamTaskId: &input.TaskId, AutoRun: &autoRun}})
+func (a *Api) updateTaskStatus(ctx *gin.Context, input repository.UpdateTaskStatusInput) {
+	if !input.RunId.IsZero() {
+		run, err := a.repo.GetRun(ctx, input.RunId)
+		if err == nil && run.PipelineId != input.PipelineId {
+			err = ErrRunOfOtherPipeline
+		}
 
-				if pl == nil || len(pl.Tasks) == 0 {
-					a.repo.UpdatePipelineStatus(ctx, repository.UpdatePipelineStatusInput{PipelineId: input.PipelineId, Pipeline: struct{ Status string }{Status: types.PipelineIdle}})
-					return
-				}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutTaskStatusResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+	}
 
-				for _, t := range pl.Tasks {
-					body, _ := json.Marshal(types.StreamWebhook{Payload: types.StreamWebhookPayload{PipelineId: types.ObjectId(pl.Id), TaskId: types.ObjectId(t.Id), Arguments: pl.Arguments}})
+	// matrix executions are tracked on the run, the task status follows once they all finish
+	var err error
+	if input.MatrixKey == "" {
+		err = a.repo.UpdateTaskStatus(ctx, &input)
+	}
 
-					req, _ := http.NewRequest("POST", fmt.Sprintf("https://%s/streamWebhook", t.WebhookHost), bytes.NewReader(body))
-					res, _ := http.DefaultClient.Do(req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, PutTaskStatusResponse{Code: types.CodeServerError, Msg: err.Error()})
+		return
+	}
 
-					if res != nil {
-						log.Println(res.Status)
-					}
-				}
-			} else if input.Task.Status == types.TaskInProgress {
-				pStatus = types.PipelineBusy
-			}
+	ctx.JSON(http.StatusOK, PutTaskStatusResponse{})
 
-			a.repo.UpdatePipelineStatus(ctx, repository.UpdatePipelineStatusInput{PipelineId: input.PipelineId, Pipeline: struct{ Status string }{Status: pStatus}})
-		}()
-	}
+	go a.handleTaskStatus(context.Background(), input)
 }
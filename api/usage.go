@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PostServerUsageInput struct {
+	DiskInfo   types.DiskInfo
+	Memory     repository.MemoryInfo
+	ImageCache repository.ImageCacheInfo
+}
+
+func usedPercent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(used) * 100 / float64(total)
+}
+
+// PostServerUsage stores a usage sample of the server of the agent authenticated by X-Agent-Token
+// and raises or resolves its disk alert
+func (a *Api) PostServerUsage() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostServerUsageInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostServerUsageResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		agent, err := a.repo.GetAgentByToken(ctx, hashToken(ctx.GetHeader("X-Agent-Token")))
+
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, PostServerUsageResponse{Code: types.CodeClientError, Msg: "unknown agent"})
+			return
+		}
+
+		_, err = a.repo.CreateServerUsage(ctx, &repository.CreateServerUsageInput{
+			ProjectId:  agent.ProjectId,
+			ServerHost: agent.Host,
+			AgentId:    agent.Id,
+			DiskInfo:   input.DiskInfo,
+			Memory:     input.Memory,
+			ImageCache: input.ImageCache,
+		})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostServerUsageResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		a.checkDiskAlert(ctx, agent, usedPercent(input.DiskInfo.Used, input.DiskInfo.Total))
+
+		ctx.JSON(http.StatusOK, PostServerUsageResponse{})
+	}
+}
+
+func (a *Api) checkDiskAlert(ctx context.Context, agent *repository.Agent, percent float64) {
+	if percent < a.diskAlertPercent {
+		err := a.repo.ResolveServerAlerts(ctx, agent.ProjectId, agent.Id, repository.ServerAlertDiskFull)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	raised, err := a.repo.OpenServerAlert(ctx, &repository.ServerAlert{
+		ProjectId:  agent.ProjectId,
+		AgentId:    agent.Id,
+		ServerHost: agent.Host,
+		Type:       repository.ServerAlertDiskFull,
+		Percent:    percent,
+		Threshold:  a.diskAlertPercent,
+	})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if raised {
+		log.Printf("disk of agent %s is %.1f%% full", agent.Name, percent)
+	}
+}
+
+func timeQuery(ctx *gin.Context, key string) (*time.Time, error) {
+	v := ctx.Query(key)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// GetDiskInfo returns the latest disk usage reported by an agent, or for a server
+func (a *Api) GetDiskInfo() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDiskInfoResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		agentId, _ := primitive.ObjectIDFromHex(ctx.Query("agentId"))
+
+		usage, err := a.repo.GetServerUsage(ctx, repository.GetServerUsageInput{ProjectId: pid, AgentId: agentId, ServerHost: ctx.Query("serverHost"), Limit: 1})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetDiskInfoResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		if len(usage) == 0 {
+			ctx.JSON(http.StatusNotFound, GetDiskInfoResponse{Code: types.CodeClientError, Msg: "no usage reported for this server"})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetDiskInfoResponse{Payload: &usage[0].DiskInfo})
+	}
+}
+
+// GetServerUsage returns the usage history of an agent, or of a server, between the optional RFC 3339 from and to times
+func (a *Api) GetServerUsage() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetServerUsageResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input := repository.GetServerUsageInput{ProjectId: pid, ServerHost: ctx.Query("serverHost")}
+		input.AgentId, _ = primitive.ObjectIDFromHex(ctx.Query("agentId"))
+
+		input.From, err = timeQuery(ctx, "from")
+		if err == nil {
+			input.To, err = timeQuery(ctx, "to")
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetServerUsageResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		input.Limit, _ = strconv.ParseInt(ctx.Query("limit"), 10, 64)
+
+		usage, err := a.repo.GetServerUsage(ctx, input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetServerUsageResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetServerUsageResponse{Payload: usage})
+	}
+}
+
+func (a *Api) GetServerAlerts() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetServerAlertsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		agentId, _ := primitive.ObjectIDFromHex(ctx.Query("agentId"))
+
+		alerts, err := a.repo.GetServerAlerts(ctx, repository.GetServerAlertsInput{ProjectId: pid, AgentId: agentId, ServerHost: ctx.Query("serverHost"), ActiveOnly: ctx.Query("active") == "true"})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetServerAlertsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetServerAlertsResponse{Payload: alerts})
+	}
+}
+
+// PruneServerUsage drops usage samples older than the retention period
+func (a *Api) PruneServerUsage(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := a.repo.DeleteServerUsage(context.Background(), time.Now().UTC().Add(-a.usageRetention))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
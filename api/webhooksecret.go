@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/envelope"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultSecretOverlapMinute = 60
+
+type PostWebhookSecretInput struct {
+	ProjectId primitive.ObjectID
+	// empty for the project-wide secret
+	ServerHost string
+	// how long the secrets being replaced stay valid
+	OverlapMinute *int
+}
+
+// PostWebhookSecret creates a new signing secret and lets the ones it replaces expire after the overlap window
+func (a *Api) PostWebhookSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var input PostWebhookSecretInput
+		err := ctx.BindJSON(&input)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.GetProject(ctx, repository.GetProjectInput{Id: input.ProjectId, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+		secret := hex.EncodeToString(b)
+
+		// sealed first, a keyring without a master key leaves the current secrets as they are
+		id := primitive.NewObjectID()
+		sealed, err := a.keyring.Seal([]byte(secret), webhookSecretAad(input.ProjectId, id))
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		overlap := defaultSecretOverlapMinute
+		if input.OverlapMinute != nil {
+			overlap = *input.OverlapMinute
+		}
+
+		expiresAt := primitive.NewDateTimeFromTime(time.Now().UTC().Add(time.Duration(overlap) * time.Minute))
+		err = a.repo.ExpireWebhookSecrets(ctx, repository.ExpireWebhookSecretsInput{ProjectId: input.ProjectId, ServerHost: input.ServerHost, ExpiresAt: expiresAt})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		_, err = a.repo.CreateWebhookSecret(ctx, &repository.CreateWebhookSecretInput{Id: id, ProjectId: input.ProjectId, ServerHost: input.ServerHost, KeyId: sealed.KeyId, WrappedKey: sealed.WrappedKey, Ciphertext: sealed.Ciphertext})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PostWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		// the secret is only ever returned here
+		ctx.JSON(http.StatusOK, PostWebhookSecretResponse{Payload: &PostWebhookSecretResponsePayload{Id: id, Secret: secret}})
+	}
+}
+
+func (a *Api) GetWebhookSecrets() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetWebhookSecretsResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		secrets, err := a.repo.GetWebhookSecrets(ctx, repository.GetWebhookSecretsInput{ProjectId: pid, ServerHost: ctx.Query("serverHost")})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, GetWebhookSecretsResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, GetWebhookSecretsResponse{Payload: secrets})
+	}
+}
+
+func (a *Api) DeleteWebhookSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+		pid, _ := primitive.ObjectIDFromHex(ctx.Query("projectId"))
+
+		_, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: repository.GetUserFromContext(ctx).Id})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteWebhookSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		err = a.repo.DeleteWebhookSecret(ctx, pid, id)
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, DeleteWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, DeleteWebhookSecretResponse{})
+	}
+}
+
+// PutGitWebhookSecret replaces the secret git providers sign the project's webhooks with, the secret rests sealed
+func (a *Api) PutGitWebhookSecret() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pid, _ := primitive.ObjectIDFromHex(ctx.Param("id"))
+
+		userId := repository.GetUserFromContext(ctx).Id
+		project, err := a.repo.GetProject(ctx, repository.GetProjectInput{Id: pid, UserId: userId})
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutGitWebhookSecretResponse{Code: types.CodeClientError, Msg: err.Error()})
+			return
+		}
+
+		// whoever knows the secret can start the project's pipelines
+		if !hasRole(project, userId, adminRoles) {
+			ctx.JSON(http.StatusForbidden, PutGitWebhookSecretResponse{Code: types.CodeClientError, Msg: ErrAdminRequired.Error()})
+			return
+		}
+
+		secret, err := randomToken()
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutGitWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		sealed, err := a.keyring.Seal([]byte(secret), gitWebhookSecretAad(pid))
+
+		if err == nil {
+			err = a.repo.SealGitWebhookSecret(ctx, pid, sealed.KeyId, sealed.WrappedKey, sealed.Ciphertext)
+		}
+
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PutGitWebhookSecretResponse{Code: types.CodeServerError, Msg: err.Error()})
+			return
+		}
+
+		// the secret is only ever returned here
+		ctx.JSON(http.StatusOK, PutGitWebhookSecretResponse{Payload: &PutGitWebhookSecretResponsePayload{Secret: secret}})
+	}
+}
+
+// gitWebhookSecretAad binds a sealed git webhook secret to its project
+func gitWebhookSecretAad(projectId primitive.ObjectID) []byte {
+	return []byte(fmt.Sprintf("gitwebhook/%s", projectId.Hex()))
+}
+
+// openGitWebhookSecret returns the secret git providers sign the project's webhooks with, empty when none is set;
+// secrets set before they were sealed are still plaintext
+func (a *Api) openGitWebhookSecret(project *repository.Project) (string, error) {
+	if project.GitWebhookCiphertext == nil {
+		return project.GitWebhookSecret, nil
+	}
+
+	secret, err := a.keyring.Open(&envelope.Sealed{KeyId: project.GitWebhookKeyId, WrappedKey: project.GitWebhookWrappedKey, Ciphertext: project.GitWebhookCiphertext}, gitWebhookSecretAad(project.Id))
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// rewrapGitWebhookSecret seals the git webhook secret of a project still in plaintext or rewraps it when it was sealed
+// under a retired master key, it reports whether it changed
+func (a *Api) rewrapGitWebhookSecret(ctx context.Context, project *repository.Project) (bool, error) {
+	var sealed *envelope.Sealed
+	var err error
+
+	switch {
+	case project.GitWebhookCiphertext == nil && project.GitWebhookSecret != "":
+		sealed, err = a.keyring.Seal([]byte(project.GitWebhookSecret), gitWebhookSecretAad(project.Id))
+	case project.GitWebhookCiphertext != nil && project.GitWebhookKeyId != a.keyring.Current():
+		sealed, err = a.keyring.Rewrap(&envelope.Sealed{KeyId: project.GitWebhookKeyId, WrappedKey: project.GitWebhookWrappedKey, Ciphertext: project.GitWebhookCiphertext})
+	default:
+		return false, nil
+	}
+
+	if err == nil {
+		err = a.repo.SealGitWebhookSecret(ctx, project.Id, sealed.KeyId, sealed.WrappedKey, sealed.Ciphertext)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("git webhook secret: %w", err)
+	}
+
+	return true, nil
+}
+
+// webhookSecretAad binds a sealed webhook secret to its project and id
+func webhookSecretAad(projectId, id primitive.ObjectID) []byte {
+	return []byte(fmt.Sprintf("webhook/%s/%s", projectId.Hex(), id.Hex()))
+}
+
+// openWebhookSecret returns the signing key of a webhook secret, secrets created before sealing are still plaintext
+func (a *Api) openWebhookSecret(s *repository.WebhookSecret) ([]byte, error) {
+	if s.Ciphertext == nil {
+		return []byte(s.Secret), nil
+	}
+
+	return a.keyring.Open(&envelope.Sealed{KeyId: s.KeyId, WrappedKey: s.WrappedKey, Ciphertext: s.Ciphertext}, webhookSecretAad(s.ProjectId, s.Id))
+}
+
+// rewrapWebhookSecrets seals the webhook secrets of a project still in plaintext and rewraps those sealed under retired
+// master keys, it returns how many it changed
+func (a *Api) rewrapWebhookSecrets(ctx context.Context, projectId primitive.ObjectID) (int, error) {
+	secrets, err := a.repo.GetProjectWebhookSecrets(ctx, projectId)
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+
+	for _, s := range secrets {
+		var sealed *envelope.Sealed
+
+		switch {
+		case s.Ciphertext == nil:
+			sealed, err = a.keyring.Seal([]byte(s.Secret), webhookSecretAad(s.ProjectId, s.Id))
+		case s.KeyId != a.keyring.Current():
+			sealed, err = a.keyring.Rewrap(&envelope.Sealed{KeyId: s.KeyId, WrappedKey: s.WrappedKey, Ciphertext: s.Ciphertext})
+		default:
+			continue
+		}
+
+		if err == nil {
+			err = a.repo.SealWebhookSecret(ctx, s.Id, sealed.KeyId, sealed.WrappedKey, sealed.Ciphertext)
+		}
+
+		if err != nil {
+			return rewrapped, fmt.Errorf("webhook secret %s: %w", s.Id.Hex(), err)
+		}
+
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
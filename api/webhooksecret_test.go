@@ -0,0 +1,78 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/more-than-code/deploybot-service-api/envelope"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOpenWebhookSecret(t *testing.T) {
+	t.Setenv("SECRET_MASTER_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+	keyring, err := envelope.NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Api{keyring: keyring}
+
+	s := repository.WebhookSecret{Id: primitive.NewObjectID(), ProjectId: primitive.NewObjectID()}
+	sealed, err := keyring.Seal([]byte("s3cret"), webhookSecretAad(s.ProjectId, s.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.KeyId, s.WrappedKey, s.Ciphertext = sealed.KeyId, sealed.WrappedKey, sealed.Ciphertext
+
+	if key, err := a.openWebhookSecret(&s); err != nil || string(key) != "s3cret" {
+		t.Fatalf("%q %v", key, err)
+	}
+
+	// a sealed secret cannot be moved to another project
+	moved := s
+	moved.ProjectId = primitive.NewObjectID()
+	if _, err := a.openWebhookSecret(&moved); err == nil {
+		t.Fatal("expected a secret sealed for another project not to open")
+	}
+
+	legacy := repository.WebhookSecret{Id: primitive.NewObjectID(), ProjectId: s.ProjectId, Secret: "plain"}
+	if key, err := a.openWebhookSecret(&legacy); err != nil || string(key) != "plain" {
+		t.Fatalf("%q %v", key, err)
+	}
+}
+
+func TestOpenGitWebhookSecret(t *testing.T) {
+	t.Setenv("SECRET_MASTER_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+	keyring, err := envelope.NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Api{keyring: keyring}
+
+	project := repository.Project{Id: primitive.NewObjectID()}
+	if secret, err := a.openGitWebhookSecret(&project); err != nil || secret != "" {
+		t.Fatalf("expected no secret, got %q %v", secret, err)
+	}
+
+	sealed, err := keyring.Seal([]byte("s3cret"), gitWebhookSecretAad(project.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	project.GitWebhookKeyId, project.GitWebhookWrappedKey, project.GitWebhookCiphertext = sealed.KeyId, sealed.WrappedKey, sealed.Ciphertext
+
+	if secret, err := a.openGitWebhookSecret(&project); err != nil || secret != "s3cret" {
+		t.Fatalf("%q %v", secret, err)
+	}
+
+	moved := project
+	moved.Id = primitive.NewObjectID()
+	if _, err := a.openGitWebhookSecret(&moved); err == nil {
+		t.Fatal("expected a secret sealed for another project not to open")
+	}
+
+	legacy := repository.Project{Id: project.Id, GitWebhookSecret: "plain"}
+	if secret, err := a.openGitWebhookSecret(&legacy); err != nil || secret != "plain" {
+		t.Fatalf("%q %v", secret, err)
+	}
+}
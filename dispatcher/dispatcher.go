@@ -0,0 +1,301 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"github.com/more-than-code/deploybot-service-api/signature"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Config struct {
+	TimeoutSecond    int `envconfig:"DISPATCH_TIMEOUT_SECOND" default:"10"`
+	MaxAttempts      int `envconfig:"DISPATCH_MAX_ATTEMPTS" default:"8"`
+	BackoffSecond    int `envconfig:"DISPATCH_BACKOFF_SECOND" default:"5"`
+	BackoffMaxSecond int `envconfig:"DISPATCH_BACKOFF_MAX_SECOND" default:"600"`
+	LeaseSecond      int `envconfig:"DISPATCH_LEASE_SECOND" default:"60"`
+	PollSecond       int `envconfig:"DISPATCH_POLL_SECOND" default:"5"`
+	Workers          int `envconfig:"DISPATCH_WORKERS" default:"4"`
+}
+
+var ErrNoWebhookSecret = errors.New("no active webhook secret")
+
+// Dispatcher delivers outbox messages to agents, retrying with exponential backoff until they are dead-lettered
+type Dispatcher struct {
+	repo   *repository.Repository
+	client *http.Client
+	cfg    Config
+	wake   chan struct{}
+	// called once a message runs out of attempts
+	OnDead func(ctx context.Context, msg *repository.OutboxMessage)
+	// picks the agent host of messages without a fixed host
+	Route func(ctx context.Context, msg *repository.OutboxMessage) (string, error)
+	// builds the body sent to the agent from the stored one, e.g. to resolve values that must not rest in the outbox
+	Prepare func(ctx context.Context, msg *repository.OutboxMessage) ([]byte, error)
+	// returns the signing key of a webhook secret, which rests sealed
+	OpenSecret func(s *repository.WebhookSecret) ([]byte, error)
+}
+
+// StreamWebhookUrl is the endpoint agents receive tasks on
+func StreamWebhookUrl(host string) string {
+	return fmt.Sprintf("https://%s/streamWebhook", host)
+}
+
+func NewDispatcher(repo *repository.Repository) *Dispatcher {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+
+	return &Dispatcher{
+		repo:   repo,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSecond) * time.Second},
+		cfg:    cfg,
+		wake:   make(chan struct{}, cfg.Workers),
+	}
+}
+
+// Enqueue stores a message in the outbox and wakes a worker to deliver it
+func (d *Dispatcher) Enqueue(ctx context.Context, input *repository.CreateOutboxMessageInput) (primitive.ObjectID, error) {
+	id, err := d.repo.CreateOutboxMessage(ctx, input)
+	if err != nil {
+		return id, err
+	}
+
+	d.Notify()
+
+	return id, nil
+}
+
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks; messages left in flight by a previous process are picked up once their lease expires
+func (d *Dispatcher) Run() {
+	for i := 1; i < d.cfg.Workers; i++ {
+		go d.work()
+	}
+
+	d.work()
+}
+
+func (d *Dispatcher) work() {
+	ticker := time.NewTicker(time.Duration(d.cfg.PollSecond) * time.Second)
+	defer ticker.Stop()
+
+	lease := time.Duration(d.cfg.LeaseSecond) * time.Second
+
+	for {
+		for {
+			ctx := context.Background()
+
+			msg, err := d.repo.ClaimOutboxMessage(ctx, lease)
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					log.Println(err)
+				}
+				break
+			}
+
+			d.deliver(ctx, msg)
+		}
+
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, msg *repository.OutboxMessage) {
+	start := time.Now().UTC()
+	attempt := repository.DeliveryAttempt{StartedAt: primitive.NewDateTimeFromTime(start)}
+
+	err := d.send(ctx, msg, &attempt)
+	attempt.Duration = time.Since(start).Milliseconds()
+
+	input := repository.UpdateOutboxAttemptInput{Id: msg.Id, Attempt: attempt, Status: repository.OutboxDelivered}
+
+	if err != nil {
+		attempt.Error = err.Error()
+		input.Attempt = attempt
+
+		// retrying cannot help a host without a secret, the task fails until one is created and the delivery redriven
+		attempts := msg.AttemptCount + 1
+		if attempts >= d.cfg.MaxAttempts || errors.Is(err, ErrNoWebhookSecret) {
+			input.Status = repository.OutboxDead
+		} else {
+			input.Status = repository.OutboxPending
+			input.NextAttemptAt = primitive.NewDateTimeFromTime(time.Now().UTC().Add(Backoff(time.Duration(d.cfg.BackoffSecond)*time.Second, time.Duration(d.cfg.BackoffMaxSecond)*time.Second, attempts)))
+		}
+	}
+
+	err = d.repo.UpdateOutboxAttempt(ctx, input)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if input.Status == repository.OutboxDead && d.OnDead != nil {
+		d.OnDead(ctx, msg)
+	}
+}
+
+// ClaimJob leases the next job of a pull agent, jobs whose lease ran out on their last attempt are dead-lettered
+// first, so a job that keeps losing its agent ends like a push delivery out of attempts
+func (d *Dispatcher) ClaimJob(ctx context.Context, input repository.ClaimJobInput) (*repository.OutboxMessage, error) {
+	input.MaxAttempts = d.cfg.MaxAttempts
+
+	dead, err := d.repo.DeadLetterJobs(ctx, input.ProjectId, input.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dead {
+		if d.OnDead != nil {
+			d.OnDead(ctx, &dead[i])
+		}
+	}
+
+	return d.repo.ClaimJob(ctx, input)
+}
+
+func (d *Dispatcher) send(ctx context.Context, msg *repository.OutboxMessage, attempt *repository.DeliveryAttempt) error {
+	if msg.Host == "" {
+		if d.Route == nil {
+			return errors.New("message has no host and no router is set")
+		}
+
+		host, err := d.Route(ctx, msg)
+		if err != nil {
+			return err
+		}
+
+		msg.Host = host
+		msg.Url = StreamWebhookUrl(host)
+	}
+
+	attempt.Host = msg.Host
+
+	body := []byte(msg.Body)
+	if d.Prepare != nil {
+		var err error
+		if body, err = d.Prepare(ctx, msg); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", msg.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// signed on every attempt so the timestamp stays fresh and rotated secrets apply to retries
+	secrets, err := d.secrets(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	// agents only trust signed requests, so deliveries to a host without a secret fail and are dead-lettered
+	if len(secrets) == 0 {
+		return fmt.Errorf("%w for host %s of project %s", ErrNoWebhookSecret, msg.Host, msg.ProjectId.Hex())
+	}
+
+	if err = signature.SignRequest(req, body, secrets...); err != nil {
+		return err
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	attempt.StatusCode = res.StatusCode
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// HasSecret reports whether deliveries to a host of the project can be signed, matching secrets the way deliveries do
+func (d *Dispatcher) HasSecret(ctx context.Context, projectId primitive.ObjectID, host string) (bool, error) {
+	secrets, err := d.activeSecrets(ctx, projectId, host)
+
+	return len(secrets) > 0, err
+}
+
+// activeSecrets returns the active secrets of a server of the project, falling back to those of the project
+func (d *Dispatcher) activeSecrets(ctx context.Context, projectId primitive.ObjectID, host string) ([]repository.WebhookSecret, error) {
+	if host != "" {
+		secrets, err := d.repo.GetWebhookSecrets(ctx, repository.GetWebhookSecretsInput{ProjectId: projectId, ServerHost: host, ActiveOnly: true})
+		if err != nil || len(secrets) > 0 {
+			return secrets, err
+		}
+	}
+
+	return d.repo.GetWebhookSecrets(ctx, repository.GetWebhookSecretsInput{ProjectId: projectId, ActiveOnly: true})
+}
+
+// secrets returns the signing keys of the target server's active secrets
+func (d *Dispatcher) secrets(ctx context.Context, msg *repository.OutboxMessage) ([][]byte, error) {
+	secrets, err := d.activeSecrets(ctx, msg.ProjectId, msg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(secrets))
+	for i := range secrets {
+		if d.OpenSecret == nil {
+			return nil, errors.New("webhook secrets are sealed and no opener is set")
+		}
+
+		key, err := d.OpenSecret(&secrets[i])
+		if err != nil {
+			return nil, fmt.Errorf("webhook secret %s: %w", secrets[i].Id.Hex(), err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Backoff returns the delay before the next attempt, doubling from base after every failed attempt up to max
+func Backoff(base, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+
+	if delay > max {
+		return max
+	}
+
+	return delay
+}
@@ -0,0 +1,18 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	base, max := 5*time.Second, time.Minute
+
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+
+	for i, e := range expected {
+		if d := Backoff(base, max, i+1); d != e {
+			t.Fatalf("attempt %d: %v", i+1, d)
+		}
+	}
+}
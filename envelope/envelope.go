@@ -0,0 +1,180 @@
+// Package envelope encrypts values with a fresh data key each, the data keys being wrapped by a master key
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+var ErrNoMasterKey = errors.New("no secret master key configured")
+
+// Config holds the current master key and the retired ones still needed to unwrap older data keys, all base64 encoded 32 byte keys
+type Config struct {
+	MasterKey   string            `envconfig:"SECRET_MASTER_KEY"`
+	MasterKeyId string            `envconfig:"SECRET_MASTER_KEY_ID" default:"1"`
+	RetiredKeys map[string]string `envconfig:"SECRET_RETIRED_KEYS"`
+}
+
+// Sealed is an encrypted value with the data key it was encrypted with, wrapped by the master key KeyId
+type Sealed struct {
+	KeyId      string
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+// Keyring seals with the current master key and opens with any known one
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring loads the master keys from the environment, a keyring without a current key can neither seal nor open
+func NewKeyring() (*Keyring, error) {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{keys: map[string][]byte{}}
+
+	for id, encoded := range cfg.RetiredKeys {
+		if err = k.add(id, encoded); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MasterKey != "" {
+		if err = k.add(cfg.MasterKeyId, cfg.MasterKey); err != nil {
+			return nil, err
+		}
+		k.current = cfg.MasterKeyId
+	}
+
+	return k, nil
+}
+
+func (k *Keyring) add(id, encoded string) error {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("master key %s: %w", id, err)
+	}
+
+	if len(key) != 32 {
+		return fmt.Errorf("master key %s is %d bytes, want 32", id, len(key))
+	}
+
+	k.keys[id] = key
+
+	return nil
+}
+
+// Current returns the id of the key new values are sealed with
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// Seal encrypts the plaintext under a new data key, aad binds the ciphertext to its context, e.g. the secret name and version
+func (k *Keyring) Seal(plaintext, aad []byte) (*Sealed, error) {
+	if k.current == "" {
+		return nil, ErrNoMasterKey
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := encrypt(dataKey, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := encrypt(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealed{KeyId: k.current, WrappedKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+// Open decrypts a sealed value with the aad it was sealed with
+func (k *Keyring) Open(s *Sealed, aad []byte) ([]byte, error) {
+	dataKey, err := k.unwrap(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(dataKey, s.Ciphertext, aad)
+}
+
+// Rewrap wraps the data key of a value sealed under a retired master key with the current one, the ciphertext is kept
+func (k *Keyring) Rewrap(s *Sealed) (*Sealed, error) {
+	if k.current == "" {
+		return nil, ErrNoMasterKey
+	}
+
+	dataKey, err := k.unwrap(s)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := encrypt(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealed{KeyId: k.current, WrappedKey: wrapped, Ciphertext: s.Ciphertext}, nil
+}
+
+func (k *Keyring) unwrap(s *Sealed) ([]byte, error) {
+	key, ok := k.keys[s.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", s.KeyId)
+	}
+
+	return decrypt(key, s.WrappedKey, []byte(s.KeyId))
+}
+
+// encrypt seals with aes-256-gcm, the nonce is prepended to the ciphertext
+func encrypt(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func decrypt(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,83 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func randomKey(t *testing.T) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestSealOpenRewrap(t *testing.T) {
+	oldKey, newKey := randomKey(t), randomKey(t)
+
+	t.Setenv("SECRET_MASTER_KEY", oldKey)
+	t.Setenv("SECRET_MASTER_KEY_ID", "a")
+
+	k, err := NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aad := []byte("project/DB_PASSWORD/1")
+	s, err := k.Seal([]byte("hunter2"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(s.Ciphertext, []byte("hunter2")) {
+		t.Fatal("plaintext in ciphertext")
+	}
+
+	if _, err = k.Open(s, []byte("project/DB_PASSWORD/2")); err == nil {
+		t.Fatal("opened with the wrong aad")
+	}
+
+	// rotate: b becomes current, a is retired
+	t.Setenv("SECRET_MASTER_KEY", newKey)
+	t.Setenv("SECRET_MASTER_KEY_ID", "b")
+	t.Setenv("SECRET_RETIRED_KEYS", "a:"+oldKey)
+
+	k, err = NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = k.Rewrap(s)
+	if err != nil || s.KeyId != "b" {
+		t.Fatal(s, err)
+	}
+
+	t.Setenv("SECRET_RETIRED_KEYS", "")
+
+	k, err = NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := k.Open(s, aad)
+	if err != nil || string(plaintext) != "hunter2" {
+		t.Fatal(string(plaintext), err)
+	}
+}
+
+func TestNoMasterKey(t *testing.T) {
+	t.Setenv("SECRET_MASTER_KEY", "")
+
+	k, err := NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = k.Seal([]byte("x"), nil); err != ErrNoMasterKey {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package gitprovider
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash    string `json:"hash"`
+		Message string `json:"message"`
+		Author  struct {
+			Raw  string `json:"raw"`
+			User struct {
+				DisplayName string `json:"display_name"`
+				Nickname    string `json:"nickname"`
+			} `json:"user"`
+		} `json:"author"`
+	} `json:"target"`
+}
+
+type bitbucketPush struct {
+	Push struct {
+		Changes []struct {
+			New    *bitbucketRef `json:"new"`
+			Closed bool          `json:"closed"`
+		} `json:"changes"`
+	} `json:"push"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		Name     string `json:"name"`
+		Links    struct {
+			Html struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+	Actor struct {
+		DisplayName string `json:"display_name"`
+		Nickname    string `json:"nickname"`
+	} `json:"actor"`
+}
+
+type bitbucket struct{}
+
+func init() {
+	register(bitbucket{})
+}
+
+func (bitbucket) Name() string {
+	return "bitbucket"
+}
+
+// Verify checks X-Hub-Signature, which Bitbucket sets when the webhook has a secret
+func (bitbucket) Verify(header http.Header, body []byte, secret string) error {
+	return verifyHmacHex(strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha256="), secret, body)
+}
+
+// Parse returns one event per updated branch or tag, a single push may update several
+func (b bitbucket) Parse(header http.Header, body []byte) ([]Event, error) {
+	if header.Get("X-Event-Key") != "repo:push" {
+		return nil, nil
+	}
+
+	var push bitbucketPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	repo := push.Repository
+
+	var events []Event
+	for _, c := range push.Push.Changes {
+		if c.Closed || c.New == nil {
+			continue
+		}
+
+		ev := Event{
+			Provider:    b.Name(),
+			Repo:        repo.FullName,
+			RepoAliases: []string{repo.Name, repo.Links.Html.Href},
+			CommitSha:   c.New.Target.Hash,
+			Message:     c.New.Target.Message,
+			Author:      c.New.Target.Author.User.Nickname,
+		}
+
+		if c.New.Type == "tag" {
+			ev.SetRef("refs/tags/" + c.New.Name)
+		} else {
+			ev.SetRef("refs/heads/" + c.New.Name)
+		}
+
+		if ev.Author == "" {
+			ev.Author = push.Actor.Nickname
+		}
+		if ev.Author == "" {
+			ev.Author = c.New.Target.Author.Raw
+		}
+
+		events = append(events, ev)
+	}
+
+	return events, nil
+}
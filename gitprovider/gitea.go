@@ -0,0 +1,48 @@
+package gitprovider
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// gitea sends GitHub-shaped push and pull request payloads
+type gitea struct{}
+
+func init() {
+	register(gitea{})
+}
+
+func (gitea) Name() string {
+	return "gitea"
+}
+
+// Verify checks X-Gitea-Signature
+func (gitea) Verify(header http.Header, body []byte, secret string) error {
+	return verifyHmacHex(header.Get("X-Gitea-Signature"), secret, body)
+}
+
+func (g gitea) Parse(header http.Header, body []byte) ([]Event, error) {
+	switch header.Get("X-Gitea-Event") {
+	case "push":
+	case "pull_request":
+		var pr githubPullRequest
+		if err := json.Unmarshal(body, &pr); err != nil {
+			return nil, err
+		}
+
+		return pr.event(g.Name(), "opened", "reopened", "synchronized"), nil
+	default:
+		return nil, nil
+	}
+
+	var push githubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	if isZeroSha(push.After) {
+		return nil, nil
+	}
+
+	return []Event{push.event(g.Name())}, nil
+}
@@ -0,0 +1,176 @@
+package gitprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+	Name     string `json:"name"`
+	CloneUrl string `json:"clone_url"`
+	HtmlUrl  string `json:"html_url"`
+	SshUrl   string `json:"ssh_url"`
+}
+
+type githubCommit struct {
+	fileChanges
+	Id      string `json:"id"`
+	Message string `json:"message"`
+	Author  struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+type githubPush struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Repository githubRepository `json:"repository"`
+	HeadCommit *githubCommit    `json:"head_commit"`
+	Commits    []githubCommit   `json:"commits"`
+	// only sent by Gitea, which lists a limited number of commits
+	TotalCommits int `json:"total_commits"`
+	Pusher       struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+}
+
+func (r githubRepository) aliases() []string {
+	return []string{r.Name, r.CloneUrl, r.HtmlUrl, r.SshUrl}
+}
+
+func (p githubPush) event(provider string) Event {
+	ev := Event{Provider: provider, Repo: p.Repository.FullName, RepoAliases: p.Repository.aliases(), CommitSha: p.After}
+	ev.SetRef(p.Ref)
+
+	if p.HeadCommit != nil {
+		ev.Message = p.HeadCommit.Message
+		ev.Author = p.HeadCommit.Author.Username
+		if ev.Author == "" {
+			ev.Author = p.HeadCommit.Author.Name
+		}
+	}
+
+	if ev.Author == "" {
+		for _, name := range []string{p.Pusher.Login, p.Pusher.Username, p.Pusher.Name} {
+			if name != "" {
+				ev.Author = name
+				break
+			}
+		}
+	}
+
+	ev.ChangedFiles = p.changedFiles()
+
+	return ev
+}
+
+// githubMaxCommits is the number of commits GitHub lists in a push payload at most
+const githubMaxCommits = 2048
+
+// changedFiles returns nil when the payload may not list every pushed commit
+func (p githubPush) changedFiles() []string {
+	n := len(p.Commits)
+	if n == 0 || n >= githubMaxCommits || p.TotalCommits > n {
+		return nil
+	}
+
+	changes := make([]fileChanges, n)
+	for i, c := range p.Commits {
+		changes[i] = c.fileChanges
+	}
+
+	return changedFiles(changes)
+}
+
+// githubPullRequest is the pull_request payload of GitHub and Gitea
+type githubPullRequest struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Title string `json:"title"`
+		Head  struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"pull_request"`
+	Repository githubRepository `json:"repository"`
+}
+
+// event returns the pull request event for the actions that open it or push to it
+func (p githubPullRequest) event(provider string, actions ...string) []Event {
+	for _, action := range actions {
+		if p.Action == action {
+			pr := p.PullRequest
+
+			return []Event{{
+				Provider:     provider,
+				Kind:         EventPullRequest,
+				Repo:         p.Repository.FullName,
+				RepoAliases:  p.Repository.aliases(),
+				Ref:          fmt.Sprintf("refs/pull/%d/head", p.Number),
+				Branch:       pr.Head.Ref,
+				CommitSha:    pr.Head.Sha,
+				Author:       pr.User.Login,
+				Message:      pr.Title,
+				PullRequest:  p.Number,
+				TargetBranch: pr.Base.Ref,
+			}}
+		}
+	}
+
+	return nil
+}
+
+type github struct{}
+
+func init() {
+	register(github{})
+}
+
+func (github) Name() string {
+	return "github"
+}
+
+// Verify checks X-Hub-Signature-256
+func (github) Verify(header http.Header, body []byte, secret string) error {
+	return verifyHmacHex(strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="), secret, body)
+}
+
+func (g github) Parse(header http.Header, body []byte) ([]Event, error) {
+	switch header.Get("X-GitHub-Event") {
+	case "push":
+	case "pull_request":
+		var pr githubPullRequest
+		if err := json.Unmarshal(body, &pr); err != nil {
+			return nil, err
+		}
+
+		return pr.event(g.Name(), "opened", "reopened", "synchronize"), nil
+	default:
+		return nil, nil
+	}
+
+	var push githubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	if push.Deleted || isZeroSha(push.After) {
+		return nil, nil
+	}
+
+	return []Event{push.event(g.Name())}, nil
+}
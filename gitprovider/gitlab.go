@@ -0,0 +1,162 @@
+package gitprovider
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	Name              string `json:"name"`
+	WebUrl            string `json:"web_url"`
+	GitHttpUrl        string `json:"git_http_url"`
+	GitSshUrl         string `json:"git_ssh_url"`
+}
+
+type gitlabCommit struct {
+	fileChanges
+	Id      string `json:"id"`
+	Message string `json:"message"`
+	Author  struct {
+		Name string `json:"name"`
+	} `json:"author"`
+}
+
+type gitlabPush struct {
+	ObjectKind   string         `json:"object_kind"`
+	Ref          string         `json:"ref"`
+	After        string         `json:"after"`
+	CheckoutSha  string         `json:"checkout_sha"`
+	UserName     string         `json:"user_name"`
+	UserUsername string         `json:"user_username"`
+	Project      gitlabProject  `json:"project"`
+	Commits      []gitlabCommit `json:"commits"`
+	// GitLab lists the last 20 commits only
+	TotalCommitsCount int `json:"total_commits_count"`
+}
+
+type gitlabMergeRequest struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project          gitlabProject `json:"project"`
+	ObjectAttributes struct {
+		Iid          int    `json:"iid"`
+		Action       string `json:"action"`
+		Title        string `json:"title"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		// only set on updates that pushed commits
+		Oldrev     string       `json:"oldrev"`
+		LastCommit gitlabCommit `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+type gitlab struct{}
+
+func init() {
+	register(gitlab{})
+}
+
+func (gitlab) Name() string {
+	return "gitlab"
+}
+
+// Verify compares X-Gitlab-Token, GitLab sends the secret token itself
+func (gitlab) Verify(header http.Header, body []byte, secret string) error {
+	token := header.Get("X-Gitlab-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func (g gitlab) Parse(header http.Header, body []byte) ([]Event, error) {
+	switch header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	case "Merge Request Hook":
+		return g.parseMergeRequest(body)
+	default:
+		return nil, nil
+	}
+
+	var push gitlabPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	sha := push.CheckoutSha
+	if sha == "" {
+		sha = push.After
+	}
+
+	if isZeroSha(sha) {
+		return nil, nil
+	}
+
+	p := push.Project
+	ev := Event{
+		Provider:    g.Name(),
+		Repo:        p.PathWithNamespace,
+		RepoAliases: []string{p.Name, p.WebUrl, p.GitHttpUrl, p.GitSshUrl},
+		CommitSha:   sha,
+		Author:      push.UserUsername,
+	}
+	ev.SetRef(push.Ref)
+
+	if ev.Author == "" {
+		ev.Author = push.UserName
+	}
+
+	changes := make([]fileChanges, len(push.Commits))
+	for i, c := range push.Commits {
+		if c.Id == sha {
+			ev.Message = c.Message
+		}
+		changes[i] = c.fileChanges
+	}
+
+	if len(changes) > 0 && push.TotalCommitsCount <= len(changes) {
+		ev.ChangedFiles = changedFiles(changes)
+	}
+
+	return []Event{ev}, nil
+}
+
+func (g gitlab) parseMergeRequest(body []byte) ([]Event, error) {
+	var mr gitlabMergeRequest
+	if err := json.Unmarshal(body, &mr); err != nil {
+		return nil, err
+	}
+
+	attrs := mr.ObjectAttributes
+
+	switch attrs.Action {
+	case "open", "reopen":
+	case "update":
+		if attrs.Oldrev == "" {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+
+	p := mr.Project
+
+	return []Event{{
+		Provider:     g.Name(),
+		Kind:         EventPullRequest,
+		Repo:         p.PathWithNamespace,
+		RepoAliases:  []string{p.Name, p.WebUrl, p.GitHttpUrl, p.GitSshUrl},
+		Ref:          fmt.Sprintf("refs/merge-requests/%d/head", attrs.Iid),
+		Branch:       attrs.SourceBranch,
+		CommitSha:    attrs.LastCommit.Id,
+		Author:       mr.User.Username,
+		Message:      attrs.Title,
+		PullRequest:  attrs.Iid,
+		TargetBranch: attrs.TargetBranch,
+	}}, nil
+}
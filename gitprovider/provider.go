@@ -0,0 +1,141 @@
+// Package gitprovider verifies inbound webhooks of Git hosting providers and normalizes them into events.
+package gitprovider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	EventPush        = "push"
+	EventTag         = "tag"
+	EventPullRequest = "pull_request"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrUnknownProvider  = errors.New("unknown git provider")
+)
+
+// Event is a provider-independent view of a webhook
+type Event struct {
+	Provider string `json:"provider"`
+	Kind     string `json:"kind"`
+	// full name, e.g. owner/repo
+	Repo string `json:"repo"`
+	// other names the repository is known by: short name, clone and web urls
+	RepoAliases []string `json:"-"`
+	Ref         string   `json:"ref"`
+	Branch      string   `json:"branch"`
+	Tag         string   `json:"tag"`
+	CommitSha   string   `json:"commitSha"`
+	Author      string   `json:"author"`
+	Message     string   `json:"message"`
+	// number of the pull or merge request, whose source branch is Branch
+	PullRequest  int    `json:"pullRequest"`
+	TargetBranch string `json:"targetBranch"`
+	// files added, modified or removed by the push, nil when the provider does not list them all
+	ChangedFiles []string `json:"changedFiles"`
+}
+
+// fileChanges is the per-commit file list GitHub, Gitea and GitLab include in push payloads
+type fileChanges struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// changedFiles merges the file lists of the commits, without duplicates
+func changedFiles(commits []fileChanges) []string {
+	seen := map[string]bool{}
+	files := []string{}
+
+	for _, c := range commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range list {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+	}
+
+	return files
+}
+
+type Provider interface {
+	Name() string
+	// Verify authenticates a webhook with the secret shared with the provider
+	Verify(header http.Header, body []byte, secret string) error
+	// Parse returns the events of a webhook, none for webhooks that are not handled
+	Parse(header http.Header, body []byte) ([]Event, error)
+}
+
+var providers = map[string]Provider{}
+
+func register(p Provider) {
+	providers[p.Name()] = p
+}
+
+func Get(name string) (Provider, error) {
+	p, ok := providers[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	return p, nil
+}
+
+// MatchesRepo reports whether a watched repository, given as full name, short name or url, is the event's repository
+func (e *Event) MatchesRepo(watched string) bool {
+	watched = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(watched)), ".git")
+	if watched == "" {
+		return false
+	}
+
+	for _, name := range append([]string{e.Repo}, e.RepoAliases...) {
+		if strings.TrimSuffix(strings.ToLower(name), ".git") == watched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetRef fills kind, branch and tag from a full ref such as refs/heads/main or refs/tags/v1.0.0
+func (e *Event) SetRef(ref string) {
+	e.Ref = ref
+
+	switch {
+	case strings.HasPrefix(ref, "refs/tags/"):
+		e.Kind = EventTag
+		e.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		e.Kind = EventPush
+		e.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	}
+}
+
+func hmacSha256Hex(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyHmacHex(signature, secret string, body []byte) error {
+	if signature == "" || !hmac.Equal([]byte(signature), []byte(hmacSha256Hex(secret, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func isZeroSha(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
@@ -0,0 +1,139 @@
+package gitprovider
+
+import (
+	"net/http"
+	"testing"
+)
+
+func parse(t *testing.T, provider string, header http.Header, body string) []Event {
+	p, err := Get(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := p.Parse(header, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestGithub(t *testing.T) {
+	body := `{"ref":"refs/heads/main","after":"a1b2c3","repository":{"full_name":"acme/api","name":"api","clone_url":"https://github.com/acme/api.git"},"head_commit":{"id":"a1b2c3","message":"fix","author":{"name":"Jane","username":"jane"}}}`
+
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Hub-Signature-256", "sha256="+hmacSha256Hex("s3cret", []byte(body)))
+
+	p, _ := Get("github")
+	if err := p.Verify(header, []byte(body), "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(header, []byte(body), "other"); err != ErrInvalidSignature {
+		t.Fatal(err)
+	}
+
+	events := parse(t, "github", header, body)
+	if len(events) != 1 {
+		t.Fatal(events)
+	}
+
+	ev := events[0]
+	if ev.Kind != EventPush || ev.Branch != "main" || ev.CommitSha != "a1b2c3" || ev.Author != "jane" {
+		t.Fatal(ev)
+	}
+
+	if !ev.MatchesRepo("acme/api") || !ev.MatchesRepo("https://github.com/acme/api") || ev.MatchesRepo("acme/web") {
+		t.Fatal(ev.RepoAliases)
+	}
+}
+
+func TestGitlabTag(t *testing.T) {
+	body := `{"object_kind":"tag_push","ref":"refs/tags/v1.2.0","checkout_sha":"d4e5f6","user_username":"joe","project":{"path_with_namespace":"acme/api"}}`
+
+	header := http.Header{}
+	header.Set("X-Gitlab-Event", "Tag Push Hook")
+	header.Set("X-Gitlab-Token", "s3cret")
+
+	p, _ := Get("gitlab")
+	if err := p.Verify(header, []byte(body), "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := parse(t, "gitlab", header, body)
+	if len(events) != 1 || events[0].Kind != EventTag || events[0].Tag != "v1.2.0" || events[0].CommitSha != "d4e5f6" {
+		t.Fatal(events)
+	}
+}
+
+func TestBitbucket(t *testing.T) {
+	body := `{"push":{"changes":[{"new":{"type":"branch","name":"develop","target":{"hash":"abc","message":"wip"}}},{"new":null,"closed":true}]},"repository":{"full_name":"acme/api"},"actor":{"nickname":"kim"}}`
+
+	header := http.Header{}
+	header.Set("X-Event-Key", "repo:push")
+
+	events := parse(t, "bitbucket", header, body)
+	if len(events) != 1 || events[0].Branch != "develop" || events[0].Author != "kim" {
+		t.Fatal(events)
+	}
+}
+
+func TestIgnoredEvent(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Gitea-Event", "issues")
+
+	if events := parse(t, "gitea", header, `{}`); len(events) != 0 {
+		t.Fatal(events)
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	body := `{"ref":"refs/heads/main","after":"b2","repository":{"full_name":"acme/mono"},"commits":[{"id":"b1","added":["svc/a/main.go"],"modified":["README.md"]},{"id":"b2","modified":["svc/a/main.go"],"removed":["svc/b/old.go"]}]}`
+
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+
+	events := parse(t, "github", header, body)
+	files := events[0].ChangedFiles
+	if len(files) != 3 || files[0] != "svc/a/main.go" || files[1] != "README.md" || files[2] != "svc/b/old.go" {
+		t.Fatal(files)
+	}
+
+	body = `{"object_kind":"push","ref":"refs/heads/main","checkout_sha":"c1","total_commits_count":25,"project":{"path_with_namespace":"acme/mono"},"commits":[{"id":"c1","added":["x.go"]}]}`
+
+	header = http.Header{}
+	header.Set("X-Gitlab-Event", "Push Hook")
+
+	events = parse(t, "gitlab", header, body)
+	if events[0].ChangedFiles != nil {
+		t.Fatal(events[0].ChangedFiles)
+	}
+}
+
+func TestPullRequest(t *testing.T) {
+	body := `{"action":"synchronize","number":7,"pull_request":{"title":"Add cache","head":{"ref":"feature/cache","sha":"f00"},"base":{"ref":"main"},"user":{"login":"jane"}},"repository":{"full_name":"acme/api"}}`
+
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "pull_request")
+
+	events := parse(t, "github", header, body)
+	if len(events) != 1 || events[0].Kind != EventPullRequest || events[0].PullRequest != 7 || events[0].Branch != "feature/cache" || events[0].TargetBranch != "main" || events[0].CommitSha != "f00" {
+		t.Fatal(events)
+	}
+
+	body = `{"action":"closed","number":7,"repository":{"full_name":"acme/api"}}`
+	if events := parse(t, "github", header, body); len(events) != 0 {
+		t.Fatal(events)
+	}
+
+	body = `{"user":{"username":"joe"},"project":{"path_with_namespace":"acme/api"},"object_attributes":{"iid":3,"action":"update","source_branch":"fix","target_branch":"main","oldrev":"aaa","last_commit":{"id":"bbb"}}}`
+
+	header = http.Header{}
+	header.Set("X-Gitlab-Event", "Merge Request Hook")
+
+	events = parse(t, "gitlab", header, body)
+	if len(events) != 1 || events[0].PullRequest != 3 || events[0].CommitSha != "bbb" || events[0].Ref != "refs/merge-requests/3/head" {
+		t.Fatal(events)
+	}
+}
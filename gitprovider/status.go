@@ -0,0 +1,191 @@
+package gitprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	StatePending  = "pending"
+	StateRunning  = "running"
+	StateSuccess  = "success"
+	StateFailure  = "failure"
+	StateCanceled = "canceled"
+)
+
+var ErrNoStatusApi = errors.New("git provider has no status api configured")
+
+var ErrApiHostNotAllowed = errors.New("git api url host is not one of the configured providers")
+
+// StatusConfig holds the api base urls of the providers, self-hosted instances and mock servers override them per project
+type StatusConfig struct {
+	GithubApiUrl  string `envconfig:"GITHUB_API_URL" default:"https://api.github.com"`
+	GitlabApiUrl  string `envconfig:"GITLAB_API_URL" default:"https://gitlab.com/api/v4"`
+	GiteaApiUrl   string `envconfig:"GITEA_API_URL"`
+	TimeoutSecond int    `envconfig:"GIT_STATUS_TIMEOUT_SECOND" default:"10"`
+	// further hosts the api urls of projects may point to, e.g. self-hosted instances or a local mock server
+	ApiHosts []string `envconfig:"GIT_API_HOSTS"`
+}
+
+// Status is the state of a pipeline for a commit
+type Status struct {
+	Repo        string
+	CommitSha   string
+	State       string
+	Context     string
+	Description string
+	TargetUrl   string
+}
+
+type StatusReporter interface {
+	// ReportStatus sets the commit status, baseUrl overrides the configured api base url when set
+	ReportStatus(ctx context.Context, baseUrl, token string, s Status) error
+}
+
+// NewStatusReporters returns the reporters of the providers that expose a commit status api, keyed by provider name
+func NewStatusReporters() map[string]StatusReporter {
+	var cfg StatusConfig
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	client := &http.Client{Timeout: time.Duration(cfg.TimeoutSecond) * time.Second}
+
+	return map[string]StatusReporter{
+		"github": &GithubStatus{BaseUrl: cfg.GithubApiUrl, Client: client},
+		"gitlab": &GitlabStatus{BaseUrl: cfg.GitlabApiUrl, Client: client},
+		"gitea":  &GiteaStatus{BaseUrl: cfg.GiteaApiUrl, Client: client},
+	}
+}
+
+// ApiHosts returns the hosts the api urls of projects may point to, those of the configured providers and GIT_API_HOSTS
+func ApiHosts() map[string]bool {
+	var cfg StatusConfig
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	hosts := map[string]bool{}
+	for _, h := range cfg.ApiHosts {
+		hosts[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+
+	for _, u := range []string{cfg.GithubApiUrl, cfg.GitlabApiUrl, cfg.GiteaApiUrl} {
+		if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+			hosts[strings.ToLower(parsed.Host)] = true
+		}
+	}
+
+	return hosts
+}
+
+// CheckApiUrl makes sure a project's api url points to one of the allowed hosts, the token of the project is sent there
+func CheckApiUrl(raw string, hosts map[string]bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || !hosts[strings.ToLower(u.Host)] {
+		return fmt.Errorf("%w: %s", ErrApiHostNotAllowed, u.Host)
+	}
+
+	return nil
+}
+
+// GithubStatus reports through the commit statuses api
+type GithubStatus struct {
+	BaseUrl string
+	Client  *http.Client
+}
+
+func (g *GithubStatus) ReportStatus(ctx context.Context, baseUrl, token string, s Status) error {
+	state := map[string]string{StatePending: "pending", StateRunning: "pending", StateSuccess: "success", StateFailure: "failure", StateCanceled: "error"}[s.State]
+
+	body := map[string]string{"state": state, "context": s.Context, "description": s.Description, "target_url": s.TargetUrl}
+	header := http.Header{"Authorization": {"Bearer " + token}, "Accept": {"application/vnd.github+json"}}
+
+	return postStatus(ctx, g.Client, apiUrl(baseUrl, g.BaseUrl), fmt.Sprintf("/repos/%s/statuses/%s", s.Repo, s.CommitSha), header, body)
+}
+
+// GitlabStatus reports through the commit status api of the project
+type GitlabStatus struct {
+	BaseUrl string
+	Client  *http.Client
+}
+
+func (g *GitlabStatus) ReportStatus(ctx context.Context, baseUrl, token string, s Status) error {
+	state := map[string]string{StatePending: "pending", StateRunning: "running", StateSuccess: "success", StateFailure: "failed", StateCanceled: "canceled"}[s.State]
+
+	body := map[string]string{"state": state, "name": s.Context, "description": s.Description, "target_url": s.TargetUrl}
+	header := http.Header{"Private-Token": {token}}
+
+	return postStatus(ctx, g.Client, apiUrl(baseUrl, g.BaseUrl), fmt.Sprintf("/projects/%s/statuses/%s", url.PathEscape(s.Repo), s.CommitSha), header, body)
+}
+
+// GiteaStatus reports through the commit statuses api, which has no default host
+type GiteaStatus struct {
+	BaseUrl string
+	Client  *http.Client
+}
+
+func (g *GiteaStatus) ReportStatus(ctx context.Context, baseUrl, token string, s Status) error {
+	state := map[string]string{StatePending: "pending", StateRunning: "pending", StateSuccess: "success", StateFailure: "failure", StateCanceled: "error"}[s.State]
+
+	body := map[string]string{"state": state, "context": s.Context, "description": s.Description, "target_url": s.TargetUrl}
+	header := http.Header{"Authorization": {"token " + token}}
+
+	return postStatus(ctx, g.Client, apiUrl(baseUrl, g.BaseUrl), fmt.Sprintf("/repos/%s/statuses/%s", s.Repo, s.CommitSha), header, body)
+}
+
+func apiUrl(override, configured string) string {
+	if override != "" {
+		return override
+	}
+
+	return configured
+}
+
+func postStatus(ctx context.Context, client *http.Client, baseUrl, path string, header http.Header, body map[string]string) error {
+	if baseUrl == "" {
+		return ErrNoStatusApi
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseUrl, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("status api responded %d: %s", res.StatusCode, msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package gitprovider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReportStatus(t *testing.T) {
+	var path, auth string
+	var body map[string]string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization") + r.Header.Get("Private-Token")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	s := Status{Repo: "acme/api", CommitSha: "a1b2c3", State: StateFailure, Context: "deploybot/build"}
+
+	github := &GithubStatus{Client: srv.Client()}
+	if err := github.ReportStatus(context.Background(), srv.URL, "t0ken", s); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/repos/acme/api/statuses/a1b2c3" || auth != "Bearer t0ken" || body["state"] != "failure" || body["context"] != "deploybot/build" {
+		t.Fatal(path, auth, body)
+	}
+
+	gitlab := &GitlabStatus{BaseUrl: srv.URL, Client: srv.Client()}
+	if err := gitlab.ReportStatus(context.Background(), "", "t0ken", s); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/projects/acme%2Fapi/statuses/a1b2c3" || auth != "t0ken" || body["state"] != "failed" || body["name"] != "deploybot/build" {
+		t.Fatal(path, auth, body)
+	}
+
+	gitea := &GiteaStatus{Client: srv.Client()}
+	if err := gitea.ReportStatus(context.Background(), "", "t0ken", s); err != ErrNoStatusApi {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckApiUrl(t *testing.T) {
+	hosts := map[string]bool{"api.github.com": true, "git.internal:3000": true}
+
+	for raw, allowed := range map[string]bool{
+		"https://api.github.com":          true,
+		"https://API.github.com/":         true,
+		"http://git.internal:3000/api/v1": true,
+		"https://git.internal/api/v1":     false,
+		"https://attacker.example":        false,
+		"ftp://api.github.com":            false,
+		"api.github.com":                  false,
+	} {
+		if err := CheckApiUrl(raw, hosts); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", raw, allowed, err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/more-than-code/auth-helper v0.0.0-20221005122945-c5218a67647e
 	go.mongodb.org/mongo-driver v1.14.0
 	google.golang.org/api v0.171.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -72,5 +73,4 @@ require (
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,56 @@
+package logstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// GridFS stores each chunk as a file named after its key
+type GridFS struct {
+	Bucket *gridfs.Bucket
+}
+
+func (g *GridFS) Put(ctx context.Context, key string, data []byte) error {
+	_, err := g.Bucket.UploadFromStream(key, bytes.NewReader(data))
+	return err
+}
+
+func (g *GridFS) Get(ctx context.Context, key string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	_, err := g.Bucket.DownloadToStreamByName(key, &buf)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (g *GridFS) Delete(ctx context.Context, key string) error {
+	cursor, err := g.Bucket.FindContext(ctx, bson.M{"filename": key})
+	if err != nil {
+		return err
+	}
+
+	var files []struct {
+		Id interface{} `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &files); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err = g.Bucket.DeleteContext(ctx, f.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Package logstore keeps chunks of task logs in GridFS, on local disk or in an S3-compatible bucket.
+package logstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+const (
+	BackendGridFS = "gridfs"
+	BackendDisk   = "disk"
+	BackendS3     = "s3"
+)
+
+var ErrNotFound = errors.New("log chunk not found")
+
+// Store saves immutable chunks under keys such as <runId>/<taskId>/<seq>
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type Config struct {
+	Backend string `envconfig:"LOG_STORE" default:"gridfs"`
+	Dir     string `envconfig:"LOG_STORE_DIR" default:"/var/lib/deploybot/logs"`
+	// any S3-compatible endpoint, addressed path-style, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	S3Endpoint  string `envconfig:"LOG_S3_ENDPOINT"`
+	S3Region    string `envconfig:"LOG_S3_REGION" default:"us-east-1"`
+	S3Bucket    string `envconfig:"LOG_S3_BUCKET"`
+	S3AccessKey string `envconfig:"LOG_S3_ACCESS_KEY"`
+	S3SecretKey string `envconfig:"LOG_S3_SECRET_KEY"`
+}
+
+// NewStore returns the configured store, bucket is only used by the GridFS backend
+func NewStore(bucket func() (*gridfs.Bucket, error)) (Store, error) {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Backend {
+	case BackendGridFS:
+		b, err := bucket()
+		if err != nil {
+			return nil, err
+		}
+		return &GridFS{Bucket: b}, nil
+	case BackendDisk:
+		return &Disk{Dir: cfg.Dir}, nil
+	case BackendS3:
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, errors.New("LOG_S3_ENDPOINT and LOG_S3_BUCKET are required for the s3 log store")
+		}
+		return &S3{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown log store %q", cfg.Backend)
+	}
+}
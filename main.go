@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kelseyhightower/envconfig"
@@ -28,10 +29,14 @@ func main() {
 	{
 		authorized.GET("/pipelines", api.GetPipelines())
 		authorized.GET("/pipeline", api.GetPipeline())
+		authorized.GET("/pipelineMatches", api.GetPipelineMatches())
 		authorized.DELETE("/pipeline/:id", api.DeletePipeline())
 		authorized.POST("/pipeline", api.PostPipeline())
 		authorized.PATCH("/pipeline", api.PatchPipeline())
 		authorized.PUT("/pipelineStatus", api.PutPipelineStatus())
+		authorized.GET("/pipeline/:id/export", api.GetPipelineExport())
+		authorized.POST("/pipelines/import", api.PostPipelineImport())
+		authorized.PUT("/pipeline/:id/import", api.PutPipelineImport())
 
 		authorized.GET("/task", api.GetTask())
 		authorized.DELETE("/task", api.DeleteTask())
@@ -39,11 +44,67 @@ func main() {
 		authorized.PATCH("/task", api.PatchTask())
 		authorized.PUT("/taskStatus", api.PutTaskStatus())
 
+		authorized.POST("/run", api.PostRun())
+		authorized.GET("/runQueue", api.GetRunQueue())
+		authorized.GET("/runs", api.GetRuns())
+		authorized.GET("/run/:id", api.GetRun())
+		authorized.PUT("/run/:id/approve", api.ApproveRun())
+		authorized.PUT("/run/:id/reject", api.RejectRun())
+
+		authorized.GET("/events", api.StreamEvents())
+
+		authorized.GET("/logs", api.GetLogs())
+		authorized.GET("/logs/stream", api.StreamLogs())
+
+		authorized.GET("/deliveries", api.GetDeliveries())
+		authorized.GET("/delivery/:id", api.GetDelivery())
+		authorized.PUT("/delivery/:id/redrive", api.RedriveDelivery())
+
 		authorized.GET("/projects", api.GetProjects())
 		authorized.GET("/project/:id", api.GetProject())
 		authorized.DELETE("/project/:id", api.DeleteProject())
 		authorized.POST("/project", api.PostProject())
 		authorized.PATCH("/project/:id", api.PatchProject())
+		authorized.PUT("/project/:id/agentJoinToken", api.PutAgentJoinToken())
+		authorized.PUT("/project/:id/gitWebhookSecret", api.PutGitWebhookSecret())
+
+		authorized.GET("/agents", api.GetAgents())
+		authorized.DELETE("/agent/:id", api.DeleteAgent())
+
+		authorized.GET("/diskInfo", api.GetDiskInfo())
+		authorized.GET("/serverUsage", api.GetServerUsage())
+		authorized.GET("/serverAlerts", api.GetServerAlerts())
+
+		authorized.POST("/webhookSecret", api.PostWebhookSecret())
+		authorized.GET("/webhookSecrets", api.GetWebhookSecrets())
+		authorized.DELETE("/webhookSecret/:id", api.DeleteWebhookSecret())
+
+		authorized.POST("/environment", api.PostEnvironment())
+		authorized.GET("/environments", api.GetEnvironments())
+		authorized.PATCH("/environment/:id", api.PatchEnvironment())
+		authorized.DELETE("/environment/:id", api.DeleteEnvironment())
+
+		authorized.GET("/deployments", api.GetDeployments())
+		authorized.GET("/deployments/current", api.GetCurrentDeployments())
+		authorized.POST("/deployment/:id/rollback", api.PostRollback())
+
+		authorized.GET("/artifacts", api.GetArtifacts())
+		authorized.GET("/artifact/:id", api.GetArtifact())
+		authorized.DELETE("/artifact/:id", api.DeleteArtifact())
+		authorized.POST("/artifacts/gc", api.PostArtifactsGc())
+
+		authorized.PUT("/secret", api.PutSecret())
+		authorized.GET("/secrets", api.GetSecrets())
+		authorized.DELETE("/secret/:name", api.DeleteSecret())
+		authorized.GET("/secretAudit", api.GetSecretAudit())
+		authorized.PUT("/secrets/rewrap", api.PutSecretsRewrap())
+
+		authorized.POST("/notificationSubscription", api.PostNotificationSubscription())
+		authorized.GET("/notificationSubscriptions", api.GetNotificationSubscriptions())
+		authorized.PATCH("/notificationSubscription/:id", api.PatchNotificationSubscription())
+		authorized.DELETE("/notificationSubscription/:id", api.DeleteNotificationSubscription())
+		authorized.POST("/notificationSubscription/:id/test", api.PostNotificationTest())
+		authorized.GET("/notifications", api.GetNotifications())
 
 		authorized.DELETE("/member", api.DeleteMember())
 		authorized.POST("/member", api.PostMember())
@@ -64,11 +125,35 @@ func main() {
 		saAuthorized.PUT("/pipelineStatus", api.PutPipelineStatus())
 
 		saAuthorized.GET("/task", api.GetTask())
-		saAuthorized.PUT("/taskStatus", api.PutTaskStatus())
+		saAuthorized.PUT("/taskStatus", api.PutAgentTaskStatus())
+
+		saAuthorized.POST("/run", api.PostRun())
+
+		saAuthorized.POST("/logs", api.PostLogs())
+		saAuthorized.POST("/artifacts", api.PostArtifacts())
+
+		saAuthorized.POST("/agent", api.RegisterAgent())
+		saAuthorized.PUT("/agentHeartbeat", api.PutAgentHeartbeat())
+		saAuthorized.POST("/serverUsage", api.PostServerUsage())
+
+		saAuthorized.GET("/jobs", api.GetJob())
+		saAuthorized.PUT("/jobs/:id/lease", api.PutJobLease())
+		saAuthorized.PUT("/jobs/:id/complete", api.PutJobComplete())
 	}
 
+	g.POST("/hooks/:provider/:projectId", api.PostGitWebhook())
+
 	g.GET("/healthCheck", HealthCheckHandler())
 
+	go api.WatchApprovals(time.Minute)
+	go api.WatchRunTimeouts(time.Minute)
+	go api.RunDispatcher()
+	go api.RunNotifier()
+	go api.WatchAgents()
+	go api.WatchEvents()
+	go api.PruneServerUsage(time.Hour)
+	go api.CollectArtifacts(time.Hour)
+
 	g.Run(fmt.Sprintf(":%d", cfg.ServerPort))
 }
 
@@ -0,0 +1,262 @@
+// Package mask redacts secrets from log lines: known secret values and well-known credential formats.
+package mask
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const Replacement = "***"
+
+// values shorter than this are too likely to appear by chance to be masked
+const minValueLength = 4
+
+// Rules are the builtin credential formats, keyed by the name projects disable them with
+var Rules = map[string]*regexp.Regexp{
+	"aws-access-key": regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA)[0-9A-Z]{16}\b`),
+	"aws-secret-key": regexp.MustCompile(`(?i)(aws_secret_access_key|aws_secret_key|secret_access_key)(\s*[:=]\s*["']?)[A-Za-z0-9/+=]{40}`),
+	"github-token":   regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	"jwt":            regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`),
+}
+
+// Block is a credential spanning lines, masked whole from its Begin to its End marker
+type Block struct {
+	Begin *regexp.Regexp
+	End   *regexp.Regexp
+}
+
+// BlockRules are the builtin multi-line credential formats, disabled by name like Rules
+var BlockRules = map[string]Block{
+	"private-key": {Begin: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`), End: regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// IsRule reports whether a builtin rule, single or multi-line, has the name
+func IsRule(name string) bool {
+	_, ok := Rules[name]
+	if !ok {
+		_, ok = BlockRules[name]
+	}
+
+	return ok
+}
+
+// DefaultSecretNames select the arguments and config entries whose values are secret
+var DefaultSecretNames = []string{"token", "secret", "password", "passwd", "apikey", "api_key", "credential", "private_key"}
+
+// Masker replaces secret values and rule matches with Replacement
+type Masker struct {
+	values   []string
+	patterns []*regexp.Regexp
+	// block rules by name, in name order
+	blockNames []string
+	blocks     map[string]Block
+}
+
+// New builds a masker from secret values, custom regular expressions and the builtin rules not disabled
+func New(values []string, patterns []string, disabledRules []string) (*Masker, error) {
+	m := &Masker{}
+
+	for _, v := range values {
+		if len(v) >= minValueLength {
+			m.values = append(m.values, v)
+		}
+
+		// logs are masked line by line, so every line of a multi-line value is a secret of its own
+		if strings.Contains(v, "\n") {
+			for _, line := range strings.Split(v, "\n") {
+				if line = strings.TrimSpace(line); len(line) >= minValueLength {
+					m.values = append(m.values, line)
+				}
+			}
+		}
+	}
+
+	// longest first so a secret containing another is masked whole
+	sort.Slice(m.values, func(i, j int) bool { return len(m.values[i]) > len(m.values[j]) })
+
+	disabled := map[string]bool{}
+	for _, name := range disabledRules {
+		disabled[name] = true
+	}
+
+	names := make([]string, 0, len(Rules))
+	for name := range Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !disabled[name] {
+			m.patterns = append(m.patterns, Rules[name])
+		}
+	}
+
+	m.blocks = map[string]Block{}
+	for name, b := range BlockRules {
+		if !disabled[name] {
+			m.blockNames = append(m.blockNames, name)
+			m.blocks[name] = b
+		}
+	}
+	sort.Strings(m.blockNames)
+
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, re)
+	}
+
+	return m, nil
+}
+
+// Validate returns the first custom pattern that does not compile
+func Validate(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mask masks a text, blocks are masked whole when both of their markers are part of it
+func (m *Masker) Mask(s string) string {
+	lines, _ := m.MaskLines(strings.Split(s, "\n"), "")
+
+	return strings.Join(lines, "\n")
+}
+
+// MaskLines masks the lines of a log in place and in order; open names the block rule the previous lines left
+// open, if any, and the one these lines leave open is returned, so a block spanning chunks is masked whole
+func (m *Masker) MaskLines(lines []string, open string) ([]string, string) {
+	if _, ok := m.blocks[open]; !ok {
+		open = ""
+	}
+
+	for i, rest := range lines {
+		var masked strings.Builder
+
+		for {
+			if open != "" {
+				// everything up to and including the end marker, or the whole rest of the line, is the block
+				masked.WriteString(Replacement)
+
+				end := m.blocks[open].End.FindStringIndex(rest)
+				if end == nil {
+					break
+				}
+
+				rest, open = rest[end[1]:], ""
+				continue
+			}
+
+			name, begin := m.firstBlock(rest)
+			if begin == nil {
+				masked.WriteString(m.maskLine(rest))
+				break
+			}
+
+			masked.WriteString(m.maskLine(rest[:begin[0]]))
+			rest, open = rest[begin[1]:], name
+		}
+
+		lines[i] = masked.String()
+	}
+
+	return lines, open
+}
+
+// firstBlock returns the block rule whose begin marker comes first in s, with the marker's position
+func (m *Masker) firstBlock(s string) (string, []int) {
+	var first string
+	var loc []int
+
+	for _, name := range m.blockNames {
+		if l := m.blocks[name].Begin.FindStringIndex(s); l != nil && (loc == nil || l[0] < loc[0]) {
+			first, loc = name, l
+		}
+	}
+
+	return first, loc
+}
+
+func (m *Masker) maskLine(s string) string {
+	for _, v := range m.values {
+		s = strings.ReplaceAll(s, v, Replacement)
+	}
+
+	for _, re := range m.patterns {
+		// keep the key of key=value style rules readable
+		if re.NumSubexp() == 2 {
+			s = re.ReplaceAllString(s, "${1}${2}"+Replacement)
+		} else {
+			s = re.ReplaceAllString(s, Replacement)
+		}
+	}
+
+	return s
+}
+
+// IsSecretName reports whether an argument or config key names a secret
+func IsSecretName(name string, secretNames []string) bool {
+	name = strings.ToLower(name)
+
+	for _, s := range secretNames {
+		if strings.Contains(name, strings.ToLower(s)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecretValues collects the values of KEY=VALUE arguments and of config entries, at any depth, whose names are secret,
+// config is either decoded json or bson
+func SecretValues(arguments []string, config interface{}, secretNames []string) []string {
+	var values []string
+
+	for _, arg := range arguments {
+		if k, v, ok := strings.Cut(arg, "="); ok && IsSecretName(k, secretNames) {
+			values = append(values, v)
+		}
+	}
+
+	var walk func(key string, v interface{})
+	walk = func(key string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				walk(k, child)
+			}
+		case primitive.M:
+			for k, child := range v {
+				walk(k, child)
+			}
+		case primitive.D:
+			for _, e := range v {
+				walk(e.Key, e.Value)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(key, child)
+			}
+		case primitive.A:
+			for _, child := range v {
+				walk(key, child)
+			}
+		case string:
+			if IsSecretName(key, secretNames) {
+				values = append(values, v)
+			}
+		}
+	}
+	walk("", config)
+
+	return values
+}
@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+const (
+	ChannelSlack   = "slack"
+	ChannelTeams   = "teams"
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+)
+
+// Sender delivers a rendered notification to one type of channel
+type Sender interface {
+	Send(ctx context.Context, n *repository.Notification, attempt *repository.DeliveryAttempt) error
+}
+
+// SlackSender posts to slack incoming webhooks
+type SlackSender struct {
+	Client *http.Client
+}
+
+func (s *SlackSender) Send(ctx context.Context, n *repository.Notification, attempt *repository.DeliveryAttempt) error {
+	body := map[string]string{"text": fmt.Sprintf("*%s*\n%s", n.Subject, n.Body)}
+
+	return postJson(ctx, s.Client, n.Channel.Url, nil, body, attempt)
+}
+
+// TeamsSender posts message cards to microsoft teams incoming webhooks
+type TeamsSender struct {
+	Client *http.Client
+}
+
+func (s *TeamsSender) Send(ctx context.Context, n *repository.Notification, attempt *repository.DeliveryAttempt) error {
+	body := map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  n.Subject,
+		"title":    n.Subject,
+		"text":     n.Body,
+	}
+
+	return postJson(ctx, s.Client, n.Channel.Url, nil, body, attempt)
+}
+
+// WebhookSender posts the notification as json with the headers of the channel
+type WebhookSender struct {
+	Client *http.Client
+}
+
+func (s *WebhookSender) Send(ctx context.Context, n *repository.Notification, attempt *repository.DeliveryAttempt) error {
+	body := map[string]string{
+		"event":     n.Event,
+		"projectId": n.ProjectId.Hex(),
+		"runId":     n.RunId.Hex(),
+		"subject":   n.Subject,
+		"body":      n.Body,
+	}
+
+	return postJson(ctx, s.Client, n.Channel.Url, n.Channel.Headers, body, attempt)
+}
+
+// EmailSender sends plain text mail through an smtp relay
+type EmailSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	Timeout  time.Duration
+}
+
+func (s *EmailSender) Send(ctx context.Context, n *repository.Notification, attempt *repository.DeliveryAttempt) error {
+	if s.Host == "" {
+		return fmt.Errorf("no smtp host configured")
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	attempt.Host = addr
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.Channel.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", " ").Replace(n.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Body, "\n", "\r\n"))
+
+	// dialed by hand, unlike smtp.SendMail, so the whole exchange is bounded by the timeout
+	conn, err := (&net.Dialer{Timeout: s.Timeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(s.From); err != nil {
+		return err
+	}
+
+	for _, to := range n.Channel.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func postJson(ctx context.Context, client *http.Client, url string, header map[string]string, body interface{}, attempt *repository.DeliveryAttempt) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	attempt.Host = req.URL.Host
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	attempt.StatusCode = res.StatusCode
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, msg)
+	}
+
+	io.Copy(io.Discard, res.Body)
+
+	return nil
+}
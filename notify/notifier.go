@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/more-than-code/deploybot-service-api/dispatcher"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Config holds the delivery settings and the smtp relay, webhook based channels carry their own endpoint
+type Config struct {
+	TimeoutSecond    int    `envconfig:"NOTIFY_TIMEOUT_SECOND" default:"10"`
+	MaxAttempts      int    `envconfig:"NOTIFY_MAX_ATTEMPTS" default:"6"`
+	BackoffSecond    int    `envconfig:"NOTIFY_BACKOFF_SECOND" default:"10"`
+	BackoffMaxSecond int    `envconfig:"NOTIFY_BACKOFF_MAX_SECOND" default:"900"`
+	LeaseSecond      int    `envconfig:"NOTIFY_LEASE_SECOND" default:"60"`
+	PollSecond       int    `envconfig:"NOTIFY_POLL_SECOND" default:"5"`
+	SmtpHost         string `envconfig:"SMTP_HOST"`
+	SmtpPort         int    `envconfig:"SMTP_PORT" default:"587"`
+	SmtpUsername     string `envconfig:"SMTP_USERNAME"`
+	SmtpPassword     string `envconfig:"SMTP_PASSWORD"`
+	SmtpFrom         string `envconfig:"SMTP_FROM"`
+}
+
+// Notifier delivers queued notifications, retrying with exponential backoff until they are dead
+type Notifier struct {
+	repo    *repository.Repository
+	cfg     Config
+	senders map[string]Sender
+	wake    chan struct{}
+}
+
+func NewNotifier(repo *repository.Repository) *Notifier {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	timeout := time.Duration(cfg.TimeoutSecond) * time.Second
+	client := &http.Client{Timeout: timeout}
+
+	return &Notifier{
+		repo: repo,
+		cfg:  cfg,
+		senders: map[string]Sender{
+			ChannelSlack:   &SlackSender{Client: client},
+			ChannelTeams:   &TeamsSender{Client: client},
+			ChannelWebhook: &WebhookSender{Client: client},
+			ChannelEmail:   &EmailSender{Host: cfg.SmtpHost, Port: cfg.SmtpPort, Username: cfg.SmtpUsername, Password: cfg.SmtpPassword, From: cfg.SmtpFrom, Timeout: timeout},
+		},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores a notification and wakes the worker to send it
+func (n *Notifier) Enqueue(ctx context.Context, input *repository.CreateNotificationInput) (primitive.ObjectID, error) {
+	id, err := n.repo.CreateNotification(ctx, input)
+	if err != nil {
+		return id, err
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+
+	return id, nil
+}
+
+// HasChannel reports whether a channel type can be sent to
+func (n *Notifier) HasChannel(channelType string) bool {
+	_, ok := n.senders[channelType]
+	return ok
+}
+
+// Run sends due notifications and blocks
+func (n *Notifier) Run() {
+	ticker := time.NewTicker(time.Duration(n.cfg.PollSecond) * time.Second)
+	defer ticker.Stop()
+
+	lease := time.Duration(n.cfg.LeaseSecond) * time.Second
+
+	for {
+		for {
+			ctx := context.Background()
+
+			msg, err := n.repo.ClaimNotification(ctx, lease)
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					log.Println(err)
+				}
+				break
+			}
+
+			n.deliver(ctx, msg)
+		}
+
+		select {
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Notifier) deliver(ctx context.Context, msg *repository.Notification) {
+	start := time.Now().UTC()
+	attempt := repository.DeliveryAttempt{StartedAt: primitive.NewDateTimeFromTime(start)}
+
+	err := n.send(ctx, msg, &attempt)
+	attempt.Duration = time.Since(start).Milliseconds()
+
+	input := repository.UpdateNotificationAttemptInput{Id: msg.Id, Status: repository.NotificationSent}
+
+	if err != nil {
+		attempt.Error = err.Error()
+
+		attempts := msg.AttemptCount + 1
+		if attempts >= n.cfg.MaxAttempts {
+			input.Status = repository.NotificationDead
+		} else {
+			input.Status = repository.NotificationPending
+			input.NextAttemptAt = primitive.NewDateTimeFromTime(time.Now().UTC().Add(dispatcher.Backoff(time.Duration(n.cfg.BackoffSecond)*time.Second, time.Duration(n.cfg.BackoffMaxSecond)*time.Second, attempts)))
+		}
+	}
+
+	input.Attempt = attempt
+
+	if err = n.repo.UpdateNotificationAttempt(ctx, input); err != nil {
+		log.Println(err)
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, msg *repository.Notification, attempt *repository.DeliveryAttempt) error {
+	sender, ok := n.senders[msg.Channel.Type]
+	if !ok {
+		return fmt.Errorf("unknown channel type %q", msg.Channel.Type)
+	}
+
+	return sender.Send(ctx, msg, attempt)
+}
@@ -0,0 +1,149 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+func TestRender(t *testing.T) {
+	data := Data{Event: repository.NotifyFailed, Project: "shop", Pipeline: "api", RunId: "r1", Status: repository.RunFailed,
+		Trigger: &repository.RunTrigger{CommitSha: "abc123", Branch: "main", Author: "dev"}}
+
+	subject, body, err := Render(repository.NotificationTemplate{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject != "api failed" || body != "Run r1 of api in shop is FAILED.\nCommit abc123 on main by dev" {
+		t.Fatalf("%q %q", subject, body)
+	}
+
+	subject, _, err = Render(repository.NotificationTemplate{Subject: "[{{.Project}}] {{.Event}}"}, data)
+	if err != nil || subject != "[shop] FAILED" {
+		t.Fatal(subject, err)
+	}
+
+	if ParseTemplate(repository.NotificationTemplate{Body: "{{.Pipeline"}) == nil {
+		t.Fatal("expected a parse error")
+	}
+}
+
+func TestWebhookSenders(t *testing.T) {
+	var got map[string]string
+	var auth string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	n := &repository.Notification{Event: repository.NotifyFailed, Subject: "api failed", Body: "details",
+		Channel: repository.NotificationChannel{Url: srv.URL, Headers: map[string]string{"Authorization": "Bearer t"}}}
+
+	var attempt repository.DeliveryAttempt
+
+	if err := (&SlackSender{Client: srv.Client()}).Send(context.Background(), n, &attempt); err != nil || got["text"] != "*api failed*\ndetails" {
+		t.Fatal(got, err)
+	}
+
+	if err := (&TeamsSender{Client: srv.Client()}).Send(context.Background(), n, &attempt); err != nil || got["title"] != "api failed" || got["text"] != "details" {
+		t.Fatal(got, err)
+	}
+
+	if err := (&WebhookSender{Client: srv.Client()}).Send(context.Background(), n, &attempt); err != nil || got["event"] != repository.NotifyFailed || auth != "Bearer t" {
+		t.Fatal(got, auth, err)
+	}
+
+	if attempt.StatusCode != http.StatusOK {
+		t.Fatal(attempt)
+	}
+}
+
+func TestWebhookSenderFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	n := &repository.Notification{Channel: repository.NotificationChannel{Url: srv.URL}}
+
+	var attempt repository.DeliveryAttempt
+	if err := (&SlackSender{Client: srv.Client()}).Send(context.Background(), n, &attempt); err == nil || attempt.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(err, attempt)
+	}
+}
+
+// serveSmtp accepts one session and returns the message data it received
+func serveSmtp(l net.Listener) <-chan string {
+	data := make(chan string, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost")
+
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				lines, _ := tp.ReadDotLines()
+				data <- strings.Join(lines, "\n")
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return data
+}
+
+func TestEmailSender(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	data := serveSmtp(l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	s := &EmailSender{Host: host, Port: p, From: "bot@example.com", Timeout: 5 * time.Second}
+	n := &repository.Notification{Subject: "api failed", Body: "details", Channel: repository.NotificationChannel{To: []string{"dev@example.com"}}}
+
+	var attempt repository.DeliveryAttempt
+	if err = s.Send(context.Background(), n, &attempt); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-data
+	if !strings.Contains(msg, "Subject: api failed") || !strings.Contains(msg, "To: dev@example.com") || !strings.HasSuffix(msg, "details") {
+		t.Fatal(msg)
+	}
+}
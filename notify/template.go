@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/more-than-code/deploybot-service-api/repository"
+)
+
+// Data is what message templates are executed with
+type Data struct {
+	Event    string
+	Project  string
+	Pipeline string
+	RunId    string
+	Status   string
+	Trigger  *repository.RunTrigger
+}
+
+var defaultSubjects = map[string]string{
+	repository.NotifyFailed:           `{{.Pipeline}} failed`,
+	repository.NotifyRecovered:        `{{.Pipeline}} recovered`,
+	repository.NotifySucceeded:        `{{.Pipeline}} succeeded`,
+	repository.NotifyCanceled:         `{{.Pipeline}} was canceled`,
+	repository.NotifyAwaitingApproval: `{{.Pipeline}} is awaiting approval`,
+}
+
+const defaultBody = `Run {{.RunId}} of {{.Pipeline}} in {{.Project}} is {{.Status}}.
+{{- with .Trigger}}{{if .CommitSha}}
+Commit {{.CommitSha}}{{with .Branch}} on {{.}}{{end}}{{with .Author}} by {{.}}{{end}}{{with .Message}}: {{.}}{{end}}{{end}}{{end}}`
+
+// Events are the run outcomes subscriptions can choose from
+var Events = []string{repository.NotifyFailed, repository.NotifyRecovered, repository.NotifySucceeded, repository.NotifyCanceled, repository.NotifyAwaitingApproval}
+
+// ParseTemplate reports whether the subject and body templates are valid
+func ParseTemplate(t repository.NotificationTemplate) error {
+	if _, err := template.New("subject").Parse(t.Subject); err != nil {
+		return err
+	}
+
+	_, err := template.New("body").Parse(t.Body)
+
+	return err
+}
+
+// Render executes the templates, falling back to the defaults of the event for empty ones
+func Render(t repository.NotificationTemplate, data Data) (string, string, error) {
+	subject := t.Subject
+	if subject == "" {
+		subject = defaultSubjects[data.Event]
+	}
+
+	body := t.Body
+	if body == "" {
+		body = defaultBody
+	}
+
+	s, err := execute(subject, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	b, err := execute(body, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return s, b, nil
+}
+
+func execute(text string, data Data) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,110 @@
+// Package pattern matches git refs and file paths against glob or regular expression patterns.
+//
+// A pattern wrapped in slashes, such as /^release-\d+$/, is a regular expression. Any other
+// pattern is a glob where * and ? stay within a path segment and ** crosses segments, so
+// release/* matches release/1.0 but not release/1.0/hotfix, while feature/** matches both.
+package pattern
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var cache sync.Map
+
+func isRegex(p string) bool {
+	return len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/")
+}
+
+// Compile turns a pattern into an anchored regular expression
+func Compile(p string) (*regexp.Regexp, error) {
+	if re, ok := cache.Load(p); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	var expr string
+	if isRegex(p) {
+		expr = p[1 : len(p)-1]
+	} else {
+		expr = "^" + globToRegex(p) + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Store(p, re)
+
+	return re, nil
+}
+
+func globToRegex(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+
+		switch {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			i++
+			// **/ also matches no directory at all
+			if i+1 < len(glob) && glob[i+1] == '/' {
+				i++
+				b.WriteString("(?:.*/)?")
+			} else {
+				b.WriteString(".*")
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// Match reports whether s matches the pattern, an invalid pattern matches nothing
+func Match(p, s string) bool {
+	re, err := Compile(p)
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(s)
+}
+
+// MatchAny reports whether s matches at least one of the patterns
+func MatchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if Match(p, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate returns the first pattern that does not compile
+func Validate(patterns ...string) error {
+	for _, p := range patterns {
+		if _, err := Compile(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Filter applies include patterns, where none means everything, and then exclude patterns
+func Filter(include, exclude []string, s string) bool {
+	if len(include) > 0 && !MatchAny(include, s) {
+		return false
+	}
+
+	return !MatchAny(exclude, s)
+}
@@ -0,0 +1,49 @@
+package pattern
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"main", "main", true},
+		{"main", "main2", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"feature/**", "feature/a/b", true},
+		{"feature/**", "feature/a", true},
+		{"dependabot/*", "dependabot/npm", true},
+		{"v?.?", "v1.2", true},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "api/run.go", true},
+		{"services/api/**", "services/web/main.go", false},
+		{"/^release-\\d+$/", "release-12", true},
+		{"/^release-\\d+$/", "release-x", false},
+		{"a.b", "axb", false},
+	}
+
+	for _, c := range cases {
+		if Match(c.pattern, c.s) != c.match {
+			t.Errorf("%s %s: expected %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	include := []string{"**"}
+	exclude := []string{"dependabot/*"}
+
+	if !Filter(include, exclude, "feature/x") || Filter(include, exclude, "dependabot/npm") {
+		t.Fatal()
+	}
+
+	if !Filter(nil, exclude, "main") {
+		t.Fatal()
+	}
+
+	if err := Validate("/(/"); err == nil {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,561 @@
+package pipelinefile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the schema version files are written in
+const Version = 1
+
+type RefFilter struct {
+	Branches       []string `yaml:"branches,omitempty"`
+	BranchesIgnore []string `yaml:"branchesIgnore,omitempty"`
+	Tags           []string `yaml:"tags,omitempty"`
+	TagsIgnore     []string `yaml:"tagsIgnore,omitempty"`
+}
+
+type PathFilter struct {
+	Paths       []string `yaml:"paths,omitempty"`
+	PathsIgnore []string `yaml:"pathsIgnore,omitempty"`
+}
+
+type Concurrency struct {
+	Policy string `yaml:"policy,omitempty"`
+	Group  string `yaml:"group,omitempty"`
+}
+
+type Approval struct {
+	Roles             []types.Role `yaml:"roles,omitempty"`
+	RequiredApprovers int          `yaml:"requiredApprovers,omitempty"`
+}
+
+type Matrix struct {
+	Axes     map[string][]string `yaml:"axes,omitempty"`
+	FailFast bool                `yaml:"failFast,omitempty"`
+}
+
+// Task is a task of the file, tasks refer to each other by name
+type Task struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type,omitempty"`
+	// name of the task this one runs after, root tasks have none
+	Upstream    string            `yaml:"upstream,omitempty"`
+	AutoRun     bool              `yaml:"autoRun,omitempty"`
+	Timeout     int64             `yaml:"timeout,omitempty"` // minutes
+	ScheduledAt *time.Time        `yaml:"scheduledAt,omitempty"`
+	WebhookHost string            `yaml:"webhookHost,omitempty"`
+	AgentLabels map[string]string `yaml:"agentLabels,omitempty"`
+	LogUrl      string            `yaml:"logUrl,omitempty"`
+	Remarks     string            `yaml:"remarks,omitempty"`
+	Approval    *Approval         `yaml:"approval,omitempty"`
+	Matrix      *Matrix           `yaml:"matrix,omitempty"`
+	Config      Config            `yaml:"config,omitempty"`
+}
+
+// Config is a task config as stored, written with tags for the bson types yaml has none for, e.g.
+// !objectId, !datetime and !int64, so importing an exported config gives back the same values
+type Config struct {
+	Value interface{}
+}
+
+// File is the definition of a pipeline as code, what a pipeline is made of without its runtime state
+type File struct {
+	Version       int                `yaml:"version"`
+	Name          string             `yaml:"name"`
+	RepoWatched   string             `yaml:"repoWatched,omitempty"`
+	BranchWatched string             `yaml:"branchWatched,omitempty"`
+	AutoRun       bool               `yaml:"autoRun,omitempty"`
+	PullRequests  bool               `yaml:"pullRequests,omitempty"`
+	Environment   string             `yaml:"environment,omitempty"`
+	Arguments     []string           `yaml:"arguments,omitempty"`
+	Labels        map[string]*string `yaml:"labels,omitempty"`
+	Concurrency   Concurrency        `yaml:"concurrency,omitempty"`
+	RefFilter     RefFilter          `yaml:"refFilter,omitempty"`
+	PathFilter    PathFilter         `yaml:"pathFilter,omitempty"`
+	Tasks         []Task             `yaml:"tasks,omitempty"`
+}
+
+// Parse reads and validates a file, unknown fields are errors so typos do not silently drop settings
+func Parse(data []byte) (*File, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var f File
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid pipeline file: %w", err)
+	}
+
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// Marshal writes a file, map keys sorted so exports of the same pipeline are identical
+func Marshal(f *File) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (f *File) Validate() error {
+	if f.Version != Version {
+		return fmt.Errorf("unsupported pipeline file version %d, expected %d", f.Version, Version)
+	}
+
+	if f.Name == "" {
+		return errors.New("pipeline name is required")
+	}
+
+	concurrency := repository.ConcurrencyConfig{Policy: f.Concurrency.Policy, Group: f.Concurrency.Group}
+	if err := concurrency.Validate(); err != nil {
+		return err
+	}
+
+	upstream := map[string]string{}
+	for _, t := range f.Tasks {
+		if t.Name == "" {
+			return errors.New("task name is required")
+		}
+
+		if _, ok := upstream[t.Name]; ok {
+			return fmt.Errorf("task %s is defined twice", t.Name)
+		}
+		upstream[t.Name] = t.Upstream
+
+		if t.Timeout < 0 {
+			return fmt.Errorf("task %s has a negative timeout", t.Name)
+		}
+
+		if t.Approval != nil && t.Approval.RequiredApprovers < 0 {
+			return fmt.Errorf("task %s requires a negative number of approvers", t.Name)
+		}
+	}
+
+	for _, t := range f.Tasks {
+		if t.Upstream == "" {
+			continue
+		}
+
+		if _, ok := upstream[t.Upstream]; !ok {
+			return fmt.Errorf("task %s runs after %s, which is not defined", t.Name, t.Upstream)
+		}
+
+		// walking up from a task must reach a root task
+		seen := map[string]bool{t.Name: true}
+		for name := t.Upstream; name != ""; name = upstream[name] {
+			if seen[name] {
+				return fmt.Errorf("task %s is part of an upstream cycle", t.Name)
+			}
+			seen[name] = true
+		}
+	}
+
+	return nil
+}
+
+// FromPipeline returns the file of a pipeline, tasks in pipeline order
+func FromPipeline(pl *repository.Pipeline) (*File, error) {
+	if err := checkTaskNames(pl); err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Version:       Version,
+		Name:          pl.Name,
+		RepoWatched:   pl.RepoWatched,
+		BranchWatched: pl.BranchWatched,
+		AutoRun:       pl.AutoRun,
+		PullRequests:  pl.PullRequests,
+		Environment:   pl.Environment,
+		Arguments:     pl.Arguments,
+		Labels:        pl.Labels,
+		Concurrency:   Concurrency{Policy: pl.Concurrency.Policy, Group: pl.Concurrency.Group},
+		RefFilter:     RefFilter(pl.RefFilter),
+		PathFilter:    PathFilter(pl.PathFilter),
+	}
+
+	names := map[primitive.ObjectID]string{}
+	for _, t := range pl.Tasks {
+		names[t.Id] = t.Name
+	}
+
+	for _, t := range pl.Tasks {
+		f.Tasks = append(f.Tasks, fromTask(t, names[t.UpstreamTaskId]))
+	}
+
+	return f, nil
+}
+
+// checkTaskNames fails on stored tasks a file cannot tell apart, files refer to tasks by name
+func checkTaskNames(pl *repository.Pipeline) error {
+	seen := map[string]bool{}
+
+	for _, t := range pl.Tasks {
+		if t.Name == "" {
+			return fmt.Errorf("pipeline %s has a task without a name, name it first", pl.Name)
+		}
+
+		if seen[t.Name] {
+			return fmt.Errorf("pipeline %s has more than one task named %s, rename them first", pl.Name, t.Name)
+		}
+		seen[t.Name] = true
+	}
+
+	return nil
+}
+
+func fromTask(t repository.Task, upstream string) Task {
+	ft := Task{
+		Name:        t.Name,
+		Type:        t.Type,
+		Upstream:    upstream,
+		AutoRun:     t.AutoRun,
+		Timeout:     t.Timeout,
+		WebhookHost: t.WebhookHost,
+		AgentLabels: t.AgentLabels,
+		LogUrl:      t.LogUrl,
+		Remarks:     t.Remarks,
+		Config:      Config{Value: t.Config},
+	}
+
+	if t.ScheduledAt != 0 {
+		scheduledAt := t.ScheduledAt.Time().UTC()
+		ft.ScheduledAt = &scheduledAt
+	}
+
+	if t.Approval != nil {
+		ft.Approval = &Approval{Roles: t.Approval.Roles, RequiredApprovers: t.Approval.RequiredApprovers}
+	}
+
+	if t.Matrix != nil {
+		ft.Matrix = &Matrix{Axes: t.Matrix.Axes, FailFast: t.Matrix.FailFast}
+	}
+
+	return ft
+}
+
+func (c Config) IsZero() bool {
+	return c.Value == nil
+}
+
+func (c Config) MarshalYAML() (interface{}, error) {
+	return configNode(c.Value)
+}
+
+func (c *Config) UnmarshalYAML(n *yaml.Node) error {
+	v, err := configValue(n)
+	if err != nil {
+		return err
+	}
+
+	c.Value = v
+
+	return nil
+}
+
+// configNode writes a stored config value, map keys sorted so exports of the same pipeline are identical
+func configNode(v interface{}) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case bson.M:
+		return configNode(map[string]interface{}(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		d := make(bson.D, 0, len(v))
+		for _, k := range keys {
+			d = append(d, bson.E{Key: k, Value: v[k]})
+		}
+		return configNode(d)
+	case bson.D:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, e := range v {
+			value, err := configNode(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: e.Key}, value)
+		}
+		return n, nil
+	case bson.A:
+		return configNode([]interface{}(v))
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range v {
+			value, err := configNode(e)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, value)
+		}
+		return n, nil
+	case primitive.ObjectID:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: objectIdTag, Value: v.Hex()}, nil
+	case primitive.DateTime:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: dateTimeTag, Value: v.Time().UTC().Format(time.RFC3339Nano)}, nil
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: int64Tag, Value: strconv.FormatInt(v, 10)}, nil
+	case float64:
+		// whole numbers would read back as ints
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'f', 1, 64)}, nil
+		}
+	}
+
+	n := &yaml.Node{}
+	if err := n.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+const (
+	objectIdTag = "!objectId"
+	dateTimeTag = "!datetime"
+	int64Tag    = "!int64"
+)
+
+// configValue reads a config value back into the types the mongo client reads, documents as bson.M, arrays as
+// bson.A and untagged ints as int32 when they fit
+func configValue(n *yaml.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return configValue(n.Content[0])
+	case yaml.AliasNode:
+		return configValue(n.Alias)
+	case yaml.MappingNode:
+		m := bson.M{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v, err := configValue(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[n.Content[i].Value] = v
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		a := bson.A{}
+		for _, e := range n.Content {
+			v, err := configValue(e)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+
+	switch n.Tag {
+	case objectIdTag:
+		id, err := primitive.ObjectIDFromHex(n.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid object id %q", n.Line, n.Value)
+		}
+		return id, nil
+	case dateTimeTag:
+		t, err := time.Parse(time.RFC3339Nano, n.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid datetime %q", n.Line, n.Value)
+		}
+		return primitive.NewDateTimeFromTime(t), nil
+	case int64Tag:
+		i, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid int64 %q", n.Line, n.Value)
+		}
+		return i, nil
+	case "!!int":
+		var i int64
+		if err := n.Decode(&i); err != nil {
+			return nil, err
+		}
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return int32(i), nil
+		}
+		return i, nil
+	case "!!float":
+		var f float64
+		err := n.Decode(&f)
+		return f, err
+	}
+
+	var v interface{}
+	err := n.Decode(&v)
+
+	return v, err
+}
+
+// Change is a task an apply creates, updates or deletes
+type Change struct {
+	Action string `json:"action"`
+	Task   string `json:"task"`
+}
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Plan is what applying a file to a pipeline writes
+type Plan struct {
+	Pipeline repository.CreatePipelineInput `json:"-"`
+	// tasks of the pipeline after the apply, in file order
+	Tasks           []repository.Task `json:"-"`
+	PipelineChanged bool              `json:"pipelineChanged"`
+	Changes         []Change          `json:"changes"`
+}
+
+// NewPlan diffs a file against the pipeline it is applied to, nil for a new pipeline; tasks are matched by name,
+// matched tasks keep their id and runtime state so runs and their outputs stay linked
+func NewPlan(f *File, current *repository.Pipeline, projectId primitive.ObjectID, now time.Time) (*Plan, error) {
+	p := &Plan{
+		Pipeline: repository.CreatePipelineInput{
+			Name:          f.Name,
+			Arguments:     f.Arguments,
+			Labels:        f.Labels,
+			RepoWatched:   f.RepoWatched,
+			BranchWatched: f.BranchWatched,
+			AutoRun:       f.AutoRun,
+			ProjectId:     projectId,
+			Concurrency:   repository.ConcurrencyConfig{Policy: f.Concurrency.Policy, Group: f.Concurrency.Group},
+			RefFilter:     repository.RefFilter(f.RefFilter),
+			PathFilter:    repository.PathFilter(f.PathFilter),
+			PullRequests:  f.PullRequests,
+			Environment:   f.Environment,
+		},
+		Changes: []Change{},
+	}
+
+	existing := map[string]repository.Task{}
+	var currentFile *File
+	if current != nil {
+		// tasks are matched by name, a stored name shared by tasks would silently merge them
+		var err error
+		if currentFile, err = FromPipeline(current); err != nil {
+			return nil, err
+		}
+
+		for _, t := range current.Tasks {
+			existing[t.Name] = t
+		}
+
+		head, fileHead := *currentFile, *f
+		head.Tasks, fileHead.Tasks = nil, nil
+		p.PipelineChanged = !sameYaml(&head, &fileHead)
+	}
+
+	ids := map[string]primitive.ObjectID{}
+	for _, ft := range f.Tasks {
+		if t, ok := existing[ft.Name]; ok {
+			ids[ft.Name] = t.Id
+		} else {
+			ids[ft.Name] = primitive.NewObjectID()
+		}
+	}
+
+	currentTasks := map[string]Task{}
+	if currentFile != nil {
+		for _, t := range currentFile.Tasks {
+			currentTasks[t.Name] = t
+		}
+	}
+
+	stamp := primitive.NewDateTimeFromTime(now)
+
+	for _, ft := range f.Tasks {
+		t, ok := existing[ft.Name]
+
+		switch {
+		case !ok:
+			t = repository.Task{Id: ids[ft.Name], Status: types.TaskPending, CreatedAt: stamp}
+			p.Changes = append(p.Changes, Change{Action: ActionCreate, Task: ft.Name})
+		case !sameYaml(currentTasks[ft.Name], ft):
+			t.UpdatedAt = stamp
+			p.Changes = append(p.Changes, Change{Action: ActionUpdate, Task: ft.Name})
+		}
+
+		p.Tasks = append(p.Tasks, toTask(t, ft, ids[ft.Upstream]))
+	}
+
+	if current != nil {
+		for _, t := range current.Tasks {
+			if _, ok := ids[t.Name]; !ok {
+				p.Changes = append(p.Changes, Change{Action: ActionDelete, Task: t.Name})
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// toTask writes the definition of a file task over a task, keeping its id and runtime state
+func toTask(t repository.Task, ft Task, upstreamId primitive.ObjectID) repository.Task {
+	t.Name = ft.Name
+	t.Type = ft.Type
+	t.UpstreamTaskId = upstreamId
+	t.AutoRun = ft.AutoRun
+	t.Timeout = ft.Timeout
+	t.WebhookHost = ft.WebhookHost
+	t.AgentLabels = ft.AgentLabels
+	t.LogUrl = ft.LogUrl
+	t.Remarks = ft.Remarks
+	t.Config = ft.Config.Value
+	t.ScheduledAt = 0
+	t.Approval = nil
+	t.Matrix = nil
+
+	if ft.ScheduledAt != nil {
+		t.ScheduledAt = primitive.NewDateTimeFromTime(*ft.ScheduledAt)
+	}
+
+	if ft.Approval != nil {
+		t.Approval = &repository.ApprovalConfig{Roles: ft.Approval.Roles, RequiredApprovers: ft.Approval.RequiredApprovers}
+	}
+
+	if ft.Matrix != nil {
+		t.Matrix = &repository.MatrixConfig{Axes: ft.Matrix.Axes, FailFast: ft.Matrix.FailFast}
+	}
+
+	return t
+}
+
+// sameYaml compares two values as they are written, which ignores the bson or yaml origin of config values
+func sameYaml(a, b interface{}) bool {
+	ya, errA := yaml.Marshal(a)
+	yb, errB := yaml.Marshal(b)
+
+	return errA == nil && errB == nil && bytes.Equal(ya, yb)
+}
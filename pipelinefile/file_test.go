@@ -0,0 +1,214 @@
+package pipelinefile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"github.com/more-than-code/deploybot-service-api/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseInvalid(t *testing.T) {
+	cases := map[string]string{
+		"version":  "version: 2\nname: app\n",
+		"name":     "version: 1\n",
+		"field":    "version: 1\nname: app\nbranch: main\n",
+		"twice":    "version: 1\nname: app\ntasks:\n- name: build\n- name: build\n",
+		"upstream": "version: 1\nname: app\ntasks:\n- name: deploy\n  upstream: build\n",
+		"cycle":    "version: 1\nname: app\ntasks:\n- name: a\n  upstream: b\n- name: b\n  upstream: a\n",
+		"policy":   "version: 1\nname: app\nconcurrency:\n  policy: drop\n",
+	}
+
+	for name, data := range cases {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	build, deploy := primitive.NewObjectID(), primitive.NewObjectID()
+	pl := &repository.Pipeline{
+		Name:          "app",
+		BranchWatched: "main",
+		Tasks: []repository.Task{
+			{Id: build, Name: "build", Type: "build", Config: bson.M{"tags": bson.A{"latest"}, "retries": int32(2)}},
+			{Id: deploy, Name: "deploy", Type: "deploy", UpstreamTaskId: build, Config: bson.D{{Key: "image", Value: "app:latest"}}},
+		},
+	}
+
+	f, err := FromPipeline(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, _ := Marshal(f)
+	if string(again) != string(data) {
+		t.Errorf("expected\n%s\ngot\n%s", data, again)
+	}
+
+	if !strings.Contains(string(data), "upstream: build") {
+		t.Errorf("expected deploy to run after build:\n%s", data)
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	build, test := primitive.NewObjectID(), primitive.NewObjectID()
+	current := &repository.Pipeline{
+		Name: "app",
+		Tasks: []repository.Task{
+			{Id: build, Name: "build", Type: "build"},
+			{Id: test, Name: "test", Type: "test", UpstreamTaskId: build},
+		},
+	}
+
+	f, err := Parse([]byte("version: 1\nname: app\ntasks:\n- name: build\n  type: build\n  timeout: 10\n- name: deploy\n  upstream: build\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPlan(f, current, primitive.NewObjectID(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.PipelineChanged {
+		t.Error("expected the pipeline settings to be unchanged")
+	}
+
+	expected := []Change{{ActionUpdate, "build"}, {ActionCreate, "deploy"}, {ActionDelete, "test"}}
+	if len(p.Changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, p.Changes)
+	}
+	for i, c := range expected {
+		if p.Changes[i] != c {
+			t.Errorf("expected %v, got %v", c, p.Changes[i])
+		}
+	}
+
+	if p.Tasks[0].Id != build || p.Tasks[1].UpstreamTaskId != build {
+		t.Error("expected build to keep its id")
+	}
+
+	own, _ := FromPipeline(current)
+	if p, err := NewPlan(own, current, current.ProjectId, time.Now()); err != nil || len(p.Changes) != 0 {
+		t.Error("expected no changes applying the pipeline's own file")
+	}
+
+	current.Tasks = append(current.Tasks, repository.Task{Id: primitive.NewObjectID(), Name: "build"})
+	if _, err := NewPlan(f, current, current.ProjectId, time.Now()); err == nil {
+		t.Error("expected an error for tasks sharing a name")
+	}
+}
+
+func TestPipelineRoundTrip(t *testing.T) {
+	build, deploy := primitive.NewObjectID(), primitive.NewObjectID()
+	region := "eu"
+	built := primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 12, 30, 0, 123e6, time.UTC))
+
+	pl := &repository.Pipeline{
+		Name:          "app",
+		ProjectId:     primitive.NewObjectID(),
+		Arguments:     []string{"MODE=prod"},
+		Labels:        map[string]*string{"region": &region},
+		RepoWatched:   "org/app",
+		BranchWatched: "main",
+		AutoRun:       true,
+		PullRequests:  true,
+		Environment:   "production",
+		Concurrency:   repository.ConcurrencyConfig{Policy: "cancel", Group: "deploys"},
+		RefFilter:     repository.RefFilter{Branches: []string{"main", "release/*"}, TagsIgnore: []string{"*-rc"}},
+		PathFilter:    repository.PathFilter{Paths: []string{"src/**"}, PathsIgnore: []string{"docs/**"}},
+		Tasks: []repository.Task{
+			{
+				Id:          build,
+				Name:        "build",
+				Type:        "build",
+				Timeout:     30,
+				ScheduledAt: primitive.NewDateTimeFromTime(time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)),
+				AgentLabels: map[string]string{"arch": "arm64"},
+				Matrix:      &repository.MatrixConfig{Axes: map[string][]string{"arch": {"amd64", "arm64"}}, FailFast: true},
+				Config: bson.M{
+					"retries": int32(2),
+					"limit":   int64(5),
+					"big":     int64(1) << 40,
+					"ratio":   2.0,
+					"owner":   primitive.NewObjectID(),
+					"builtAt": built,
+					"tags":    bson.A{"latest", int32(1), bson.M{"pinned": true}},
+					"empty":   nil,
+				},
+			},
+			{
+				Id:             deploy,
+				Name:           "deploy",
+				Type:           "deploy",
+				UpstreamTaskId: build,
+				AutoRun:        true,
+				WebhookHost:    "agent.example.com",
+				Approval:       &repository.ApprovalConfig{Roles: []types.Role{types.RoleOwner, types.RoleAdmin}, RequiredApprovers: 2},
+				Config:         bson.M{"image": "app:${{ tasks.build.outputs.digest }}"},
+			},
+		},
+	}
+
+	f, err := FromPipeline(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPlan(f, pl, pl.ProjectId, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.PipelineChanged || len(p.Changes) != 0 {
+		t.Errorf("expected no changes, got %v\n%s", p.Changes, data)
+	}
+
+	expected := repository.CreatePipelineInput{
+		Name:          pl.Name,
+		Arguments:     pl.Arguments,
+		Labels:        pl.Labels,
+		RepoWatched:   pl.RepoWatched,
+		BranchWatched: pl.BranchWatched,
+		AutoRun:       pl.AutoRun,
+		ProjectId:     pl.ProjectId,
+		Concurrency:   pl.Concurrency,
+		RefFilter:     pl.RefFilter,
+		PathFilter:    pl.PathFilter,
+		PullRequests:  pl.PullRequests,
+		Environment:   pl.Environment,
+	}
+	if !reflect.DeepEqual(p.Pipeline, expected) {
+		t.Errorf("expected %+v, got %+v", expected, p.Pipeline)
+	}
+
+	if !reflect.DeepEqual(p.Tasks, pl.Tasks) {
+		t.Errorf("expected %+v, got %+v\n%s", pl.Tasks, p.Tasks, data)
+	}
+}
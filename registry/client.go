@@ -0,0 +1,253 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+var (
+	ErrNotFound          = errors.New("image not found in registry")
+	ErrUnauthorized      = errors.New("registry denied access")
+	ErrDeleteUnsupported = errors.New("registry does not support deleting images")
+)
+
+// manifest media types accepted, indexes first so multi-platform images resolve to the digest they are pushed with
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type Config struct {
+	TimeoutSecond int `envconfig:"REGISTRY_TIMEOUT_SECOND" default:"15"`
+}
+
+// Login is how the client reaches a registry, anonymous when Username is empty
+type Login struct {
+	Username string
+	Password string
+	// plain http, for registries on a private network
+	Insecure bool
+}
+
+// Client talks to registries through the distribution (v2) api
+type Client struct {
+	Client *http.Client
+}
+
+func NewClient() *Client {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Client{Client: &http.Client{Timeout: time.Duration(cfg.TimeoutSecond) * time.Second}}
+}
+
+// Digest resolves a reference to the digest of its manifest, ErrNotFound tells the image does not exist
+func (c *Client) Digest(ctx context.Context, ref Reference, login Login) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestTypes, ", ")}}
+
+	res, err := c.do(ctx, http.MethodHead, ref, "/manifests/"+ref.manifest(), header, "pull", login)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// registries may leave the header out, the digest is that of the manifest as served
+	res, err = c.do(ctx, http.MethodGet, ref, "/manifests/"+ref.manifest(), header, "pull", login)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, res.Body); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Delete deletes the manifest of a pinned reference, with every tag pointing to it; a missing manifest is not an error
+func (c *Client) Delete(ctx context.Context, ref Reference, login Login) error {
+	if ref.Digest == "" {
+		return fmt.Errorf("%s is not pinned to a digest", ref)
+	}
+
+	res, err := c.do(ctx, http.MethodDelete, ref, "/manifests/"+ref.Digest, nil, "delete", login)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// do sends a request to the repository's api, answering a token challenge once
+func (c *Client) do(ctx context.Context, method string, ref Reference, path string, header http.Header, action string, login Login) (*http.Response, error) {
+	scheme := "https"
+	if login.Insecure {
+		scheme = "http"
+	}
+
+	u := fmt.Sprintf("%s://%s/v2/%s%s", scheme, ref.apiHost(), ref.Repository, path)
+
+	res, err := c.send(ctx, method, u, header, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("Www-Authenticate")
+		res.Body.Close()
+
+		auth, err := c.authorize(ctx, challenge, fmt.Sprintf("repository:%s:%s", ref.Repository, action), login)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = c.send(ctx, method, u, header, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrUnauthorized
+	case http.StatusMethodNotAllowed:
+		return nil, ErrDeleteUnsupported
+	}
+
+	return nil, fmt.Errorf("registry responded %d to %s %s", res.StatusCode, method, path)
+}
+
+func (c *Client) send(ctx context.Context, method, u string, header http.Header, auth string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return c.Client.Do(req)
+}
+
+// authorize answers a Basic or Bearer challenge, fetching a token from the realm for the latter
+func (c *Client) authorize(ctx context.Context, challenge, scope string, login Login) (string, error) {
+	scheme, params := parseChallenge(challenge)
+
+	switch scheme {
+	case "basic":
+		if login.Username == "" {
+			return "", ErrUnauthorized
+		}
+
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(login.Username+":"+login.Password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid registry auth realm %q", params["realm"])
+	}
+
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if login.Username != "" {
+		req.SetBasicAuth(login.Username, login.Password)
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return "", ErrUnauthorized
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	return strings.ToLower(scheme), params
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// host image names without one resolve to
+	DefaultHost = "docker.io"
+	// api host of DefaultHost
+	dockerHubApiHost = "registry-1.docker.io"
+)
+
+var (
+	repositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRegex        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegex     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is an image reference, e.g. registry.example.com/app:1.2.0 or app@sha256:...
+type Reference struct {
+	// name as written, without tag and digest
+	Name       string
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference, names without a host are docker hub images and references without
+// a tag or digest point to latest
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegex.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest in image reference %q", s)
+		}
+	}
+
+	// a colon after the last slash separates the tag, one before it is the port of the host
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegex.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag in image reference %q", s)
+		}
+	}
+
+	ref.Name = name
+	ref.Host, ref.Repository = DefaultHost, name
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Host, ref.Repository = host, name[i+1:]
+		}
+	}
+
+	if ref.Host == DefaultHost && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	if !repositoryRegex.MatchString(ref.Repository) {
+		return ref, fmt.Errorf("invalid image name in reference %q", s)
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	return ref, nil
+}
+
+func (r Reference) String() string {
+	s := r.Name
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+
+	return s
+}
+
+// Pinned returns the reference with its tag kept for readability and pinned to the digest
+func (r Reference) Pinned(digest string) string {
+	r.Digest = digest
+	return r.String()
+}
+
+func (r Reference) apiHost() string {
+	if r.Host == DefaultHost {
+		return dockerHubApiHost
+	}
+
+	return r.Host
+}
+
+// manifest returns the digest of a pinned reference, the tag otherwise
+func (r Reference) manifest() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+
+	return r.Tag
+}
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+
+	cases := []struct {
+		ref                   string
+		host, repository, tag string
+	}{
+		{"nginx", DefaultHost, "library/nginx", "latest"},
+		{"acme/api:1.2.0", DefaultHost, "acme/api", "1.2.0"},
+		{"registry.example.com/acme/api:1.2.0", "registry.example.com", "acme/api", "1.2.0"},
+		{"localhost:5000/api", "localhost:5000", "api", "latest"},
+		{"localhost/api@" + digest, "localhost", "api", ""},
+	}
+
+	for _, c := range cases {
+		ref, err := ParseReference(c.ref)
+		if err != nil {
+			t.Fatal(c.ref, err)
+		}
+		if ref.Host != c.host || ref.Repository != c.repository || ref.Tag != c.tag {
+			t.Fatal(c.ref, ref)
+		}
+	}
+
+	ref, _ := ParseReference("registry.example.com/acme/api:1.2.0")
+	if pinned := ref.Pinned(digest); pinned != "registry.example.com/acme/api:1.2.0@"+digest {
+		t.Fatal(pinned)
+	}
+
+	for _, s := range []string{"Acme/api", "api:", "api@sha256:abc", "api:-1"} {
+		if _, err := ParseReference(s); err == nil {
+			t.Fatal(s)
+		}
+	}
+}
+
+// fakeRegistry serves the manifests of one repository behind token auth, as docker hub does
+func fakeRegistry(manifests map[string]string) *httptest.Server {
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, pass, _ := r.BasicAuth()
+			if user != "ci" || pass != "s3cret" || r.URL.Query().Get("service") != "fake" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"token": "t0ken-%s"}`, strings.Split(r.URL.Query().Get("scope"), ":")[2])
+			return
+		}
+
+		manifest := strings.TrimPrefix(r.URL.Path, "/v2/acme/api/manifests/")
+		action := map[string]string{http.MethodHead: "pull", http.MethodGet: "pull", http.MethodDelete: "delete"}[r.Method]
+
+		if r.Header.Get("Authorization") != "Bearer t0ken-"+action {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:acme/api:%s"`, srv.URL, action))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		digest, ok := manifests[manifest]
+		if !ok {
+			for _, d := range manifests {
+				ok = ok || d == manifest
+			}
+			digest = manifest
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			for tag, d := range manifests {
+				if d == digest {
+					delete(manifests, tag)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", digest)
+	}))
+
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	digest := "sha256:4d2c5f0b3f1a0e7c9b8a6d5e4f3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+	srv := fakeRegistry(map[string]string{"1.2.0": digest, "latest": digest})
+	defer srv.Close()
+
+	c := &Client{Client: srv.Client()}
+	ctx := context.Background()
+	login := Login{Username: "ci", Password: "s3cret", Insecure: true}
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	ref, _ := ParseReference(host + "/acme/api:1.2.0")
+	if d, err := c.Digest(ctx, ref, login); err != nil || d != digest {
+		t.Fatal(d, err)
+	}
+
+	if _, err := c.Digest(ctx, ref, Login{Insecure: true}); err != ErrUnauthorized {
+		t.Fatal(err)
+	}
+
+	missing, _ := ParseReference(host + "/acme/api:9.9.9")
+	if _, err := c.Digest(ctx, missing, login); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete(ctx, ref, login); err == nil {
+		t.Fatal("deleted a reference without digest")
+	}
+
+	pinned, _ := ParseReference(ref.Pinned(digest))
+	if err := c.Delete(ctx, pinned, login); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tags of the deleted manifest are gone, deleting again is a no-op
+	if _, err := c.Digest(ctx, ref, login); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, pinned, login); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`)
+	if scheme != "bearer" || params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:library/nginx:pull" {
+		t.Fatal(scheme, params)
+	}
+
+	if scheme, _ := parseChallenge(`Basic realm="Registry"`); scheme != "basic" {
+		t.Fatal(scheme)
+	}
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AgentOnline  = "ONLINE"
+	AgentOffline = "OFFLINE"
+)
+
+const (
+	// agents receiving stream webhooks
+	AgentPush = "push"
+	// agents polling for jobs, e.g. behind NAT
+	AgentPull = "pull"
+)
+
+// Agent is a build or deploy server that registered with the project's join token and reports through heartbeats
+type Agent struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId primitive.ObjectID `json:"projectId"`
+	Name      string             `json:"name"`
+	// host the agent receives stream webhooks on
+	Host    string            `json:"host"`
+	Labels  map[string]string `json:"labels"`
+	Version string            `json:"version"`
+	Mode    string            `json:"mode"`
+	// number of tasks the agent runs at once, and how many it is running
+	Capacity        int                `json:"capacity"`
+	Running         int                `json:"running"`
+	DiskInfo        types.DiskInfo     `json:"diskInfo"`
+	Status          string             `json:"status"`
+	TokenHash       string             `json:"-"`
+	RegisteredAt    primitive.DateTime `json:"registeredAt"`
+	LastHeartbeatAt primitive.DateTime `json:"lastHeartbeatAt"`
+}
+
+type RegisterAgentInput struct {
+	ProjectId primitive.ObjectID
+	Name      string
+	Host      string
+	Labels    map[string]string
+	Version   string
+	Mode      string
+	Capacity  int
+	TokenHash string
+	// token of the agent registered under the name, lets it register again while it is alive
+	CurrentTokenHash string
+	// agents of the name without a heartbeat since are taken over without their token
+	StaleBefore time.Time
+}
+
+var ErrAgentAlive = errors.New("an agent of this name is alive, register with its token or once it went offline")
+
+// agentIndex keeps agent names unique within a project, so a registration cannot add a second agent beside a live one
+var agentIndex = mongo.IndexModel{
+	Keys:    bson.D{{"projectid", 1}, {"name", 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+type AgentHeartbeatInput struct {
+	TokenHash string
+	Version   string
+	Capacity  int
+	Running   int
+	DiskInfo  types.DiskInfo
+}
+
+type GetAgentsInput struct {
+	ProjectId primitive.ObjectID
+	Status    string
+}
+
+// RegisterAgent creates the agent, or takes over the registration of an agent of the project with the same name when
+// it holds that agent's token or the agent went offline, its pending jobs would go to whoever takes it over
+func (r *Repository) RegisterAgent(ctx context.Context, input *RegisterAgentInput) (*Agent, error) {
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	takeover := bson.A{
+		bson.M{"status": AgentOffline},
+		bson.M{"lastheartbeatat": bson.M{"$lt": primitive.NewDateTimeFromTime(input.StaleBefore)}},
+	}
+	if input.CurrentTokenHash != "" {
+		takeover = append(takeover, bson.M{"tokenhash": input.CurrentTokenHash})
+	}
+
+	filter := bson.M{"projectid": input.ProjectId, "name": input.Name, "$or": takeover}
+	update := bson.M{
+		"$set": bson.M{
+			"host":            input.Host,
+			"labels":          input.Labels,
+			"version":         input.Version,
+			"mode":            input.Mode,
+			"capacity":        input.Capacity,
+			"running":         0,
+			"tokenhash":       input.TokenHash,
+			"status":          AgentOnline,
+			"lastheartbeatat": now,
+		},
+		"$setOnInsert": bson.M{"registeredat": now},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var agent Agent
+	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&agent)
+
+	// the name is taken by an agent that may not be taken over
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrAgentAlive
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent, nil
+}
+
+// UpdateAgentHeartbeat records a heartbeat of the agent holding the token and brings it back online
+func (r *Repository) UpdateAgentHeartbeat(ctx context.Context, input *AgentHeartbeatInput) (*Agent, error) {
+	filter := bson.M{"tokenhash": input.TokenHash}
+	update := bson.M{"$set": bson.M{
+		"version":         input.Version,
+		"capacity":        input.Capacity,
+		"running":         input.Running,
+		"diskinfo":        input.DiskInfo,
+		"status":          AgentOnline,
+		"lastheartbeatat": primitive.NewDateTimeFromTime(time.Now().UTC()),
+	}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var agent Agent
+	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&agent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent, nil
+}
+
+// AddAgentRunning counts a task handed to an agent until its next heartbeat reports the running tasks itself, so tasks
+// routed between two heartbeats spread over the agents instead of piling onto the one that looked least loaded
+func (r *Repository) AddAgentRunning(ctx context.Context, id primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"running": 1}})
+
+	return err
+}
+
+func (r *Repository) GetAgentByToken(ctx context.Context, tokenHash string) (*Agent, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+
+	var agent Agent
+	err := coll.FindOne(ctx, bson.M{"tokenhash": tokenHash}).Decode(&agent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent, nil
+}
+
+func (r *Repository) GetAgents(ctx context.Context, input GetAgentsInput) ([]Agent, error) {
+	filter := bson.M{"projectid": input.ProjectId}
+	if input.Status != "" {
+		filter["status"] = input.Status
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{"name", 1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []Agent
+	if err = cursor.All(ctx, &agents); err != nil {
+		return nil, err
+	}
+
+	return agents, nil
+}
+
+// MarkAgentsOffline sets online agents whose last heartbeat is older than the deadline offline
+func (r *Repository) MarkAgentsOffline(ctx context.Context, deadline time.Time) (int64, error) {
+	filter := bson.M{"status": AgentOnline, "lastheartbeatat": bson.M{"$lt": primitive.NewDateTimeFromTime(deadline)}}
+	update := bson.M{"$set": bson.M{"status": AgentOffline}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	result, err := coll.UpdateMany(ctx, filter, update)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func (r *Repository) DeleteAgent(ctx context.Context, projectId, id primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id, "projectid": projectId})
+
+	return err
+}
+
+// UpdateAgentJoinToken replaces the token agents register to the project with
+func (r *Repository) UpdateAgentJoinToken(ctx context.Context, projectId primitive.ObjectID, tokenHash string) error {
+	coll := r.mongoClient.Database("pipeline").Collection("projects")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": projectId}, bson.M{"$set": bson.M{"agentjointokenhash": tokenHash}})
+
+	return err
+}
+
+func (r *Repository) GetProjectByAgentJoinToken(ctx context.Context, tokenHash string) (*Project, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("projects")
+
+	var project Project
+	err := coll.FindOne(ctx, bson.M{"agentjointokenhash": tokenHash}).Decode(&project)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+func (r *Repository) GetAgent(ctx context.Context, id primitive.ObjectID) (*Agent, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+
+	var agent Agent
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&agent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent, nil
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRegisterAgent(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	defer coll.DeleteMany(ctx, bson.M{"projectid": pid})
+
+	staleBefore := time.Now().UTC().Add(-time.Minute)
+
+	first, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "builder", Mode: AgentPull, Capacity: 1, TokenHash: "first", StaleBefore: staleBefore})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a live agent cannot be taken over without its token
+	if _, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "builder", Mode: AgentPull, TokenHash: "intruder", StaleBefore: staleBefore}); err != ErrAgentAlive {
+		t.Fatalf("expected %v, got %v", ErrAgentAlive, err)
+	}
+
+	// registering again with its token takes the agent over instead of adding another one
+	second, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "builder", Mode: AgentPull, Capacity: 2, TokenHash: "second", CurrentTokenHash: "first", StaleBefore: staleBefore})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Id != first.Id || second.RegisteredAt != first.RegisteredAt {
+		t.Errorf("expected the registration of agent %s to be taken over, got agent %s", first.Id.Hex(), second.Id.Hex())
+	}
+
+	if second.Capacity != 2 || second.Status != AgentOnline {
+		t.Errorf("unexpected agent %+v", second)
+	}
+
+	if _, err := r.GetAgentByToken(ctx, "first"); err == nil {
+		t.Error("expected the replaced token to be rejected")
+	}
+
+	agents, err := r.GetAgents(ctx, GetAgentsInput{ProjectId: pid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agents) != 1 {
+		t.Errorf("expected 1 agent, got %d", len(agents))
+	}
+
+	// once the agent went offline its name may be taken over without the token
+	coll.UpdateByID(ctx, first.Id, bson.M{"$set": bson.M{"status": AgentOffline}})
+
+	third, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "builder", Mode: AgentPull, TokenHash: "third", StaleBefore: staleBefore})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.Id != first.Id || third.Status != AgentOnline {
+		t.Errorf("unexpected agent %+v", third)
+	}
+}
+
+func TestMarkAgentsOffline(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	coll := r.mongoClient.Database("pipeline").Collection("agents")
+	defer coll.DeleteMany(ctx, bson.M{"projectid": pid})
+
+	agent, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "deployer", Mode: AgentPush, Host: "deployer.local", TokenHash: primitive.NewObjectID().Hex(), StaleBefore: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// heartbeats far in the past keep the sweep away from agents of other tests and real projects
+	lastHeartbeat := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+	coll.UpdateByID(ctx, agent.Id, bson.M{"$set": bson.M{"lastheartbeatat": primitive.NewDateTimeFromTime(lastHeartbeat)}})
+
+	if _, err := r.MarkAgentsOffline(ctx, lastHeartbeat.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, _ := r.GetAgents(ctx, GetAgentsInput{ProjectId: pid, Status: AgentOnline})
+	if len(agents) != 1 {
+		t.Fatal("expected an agent with a heartbeat after the deadline to stay online")
+	}
+
+	marked, err := r.MarkAgentsOffline(ctx, lastHeartbeat.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if marked < 1 {
+		t.Errorf("expected the agent to be marked offline, %d were", marked)
+	}
+
+	agents, _ = r.GetAgents(ctx, GetAgentsInput{ProjectId: pid, Status: AgentOffline})
+	if len(agents) != 1 {
+		t.Fatal("expected an agent with a heartbeat before the deadline to go offline")
+	}
+
+	// the next heartbeat brings it back
+	updated, err := r.UpdateAgentHeartbeat(ctx, &AgentHeartbeatInput{TokenHash: agent.TokenHash, Capacity: 1, Running: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Status != AgentOnline || updated.Running != 1 || !updated.LastHeartbeatAt.Time().After(lastHeartbeat) {
+		t.Errorf("unexpected agent after heartbeat %+v", updated)
+	}
+}
+
+func TestAddAgentRunning(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	defer r.mongoClient.Database("pipeline").Collection("agents").DeleteMany(ctx, bson.M{"projectid": pid})
+
+	agent, err := r.RegisterAgent(ctx, &RegisterAgentInput{ProjectId: pid, Name: "builder", Mode: AgentPush, Host: "builder.local", Capacity: 4, TokenHash: primitive.NewObjectID().Hex(), StaleBefore: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tasks routed between two heartbeats count towards the agent's load
+	for i := 0; i < 3; i++ {
+		if err := r.AddAgentRunning(ctx, agent.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agents, _ := r.GetAgents(ctx, GetAgentsInput{ProjectId: pid})
+	if len(agents) != 1 || agents[0].Running != 3 {
+		t.Fatalf("expected 3 running tasks, got %+v", agents)
+	}
+
+	// the next heartbeat reports what the agent actually runs
+	updated, err := r.UpdateAgentHeartbeat(ctx, &AgentHeartbeatInput{TokenHash: agent.TokenHash, Capacity: 4, Running: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Running != 2 {
+		t.Errorf("expected the heartbeat to set 2 running tasks, got %d", updated.Running)
+	}
+}
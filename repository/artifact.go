@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ArtifactRetention configures which artifacts of a project garbage collection drops, zero values keep everything
+type ArtifactRetention struct {
+	// number of newest artifacts kept per image name
+	KeepLast int `json:"keepLast"`
+	// age after which artifacts are collected, only beyond the newest KeepLast when both are set
+	MaxAgeDays int `json:"maxAgeDays"`
+	// tags never collected, globs or /regex/ patterns
+	KeepTags []string `json:"keepTags"`
+	// also delete collected images from their registry
+	PruneRegistry bool `json:"pruneRegistry"`
+}
+
+// ArtifactProvenance tells how and where an artifact was built
+type ArtifactProvenance struct {
+	// agent or server that built the artifact
+	Builder    string `json:"builder"`
+	Dockerfile string `json:"dockerfile"`
+	Context    string `json:"context"`
+	BaseImage  string `json:"baseImage"`
+	Platform   string `json:"platform"`
+	Duration   int64  `json:"duration"` // milliseconds
+}
+
+// Artifact is an image a task built, linked to the run and commit it was built from
+type Artifact struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	PipelineId primitive.ObjectID `json:"pipelineId"`
+	TaskId     primitive.ObjectID `json:"taskId"`
+	RunId      primitive.ObjectID `json:"runId"`
+	MatrixKey  string             `json:"matrixKey" bson:",omitempty"`
+	// image name with the registry host, e.g. registry.example.com/app
+	Name       string             `json:"name"`
+	Tag        string             `json:"tag"`
+	Digest     string             `json:"digest"`
+	Size       int64              `json:"size"`
+	Provenance ArtifactProvenance `json:"provenance"`
+	CommitSha  string             `json:"commitSha"`
+	Ref        string             `json:"ref"`
+	CreatedAt  primitive.DateTime `json:"createdAt"`
+}
+
+type GetArtifactsInput struct {
+	ProjectId  primitive.ObjectID
+	PipelineId primitive.ObjectID
+	RunId      primitive.ObjectID
+	Name       string
+	Tag        string
+	Digest     string
+	CommitSha  string
+	Limit      int64
+}
+
+// SaveArtifact records an artifact, a task reporting the same image again updates its record
+func (r *Repository) SaveArtifact(ctx context.Context, a *Artifact) error {
+	filter := bson.M{"runid": a.RunId, "taskid": a.TaskId, "matrixkey": a.MatrixKey, "name": a.Name, "tag": a.Tag}
+	if a.MatrixKey == "" {
+		filter["matrixkey"] = nil
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"projectid":  a.ProjectId,
+			"pipelineid": a.PipelineId,
+			"digest":     a.Digest,
+			"size":       a.Size,
+			"provenance": a.Provenance,
+			"commitsha":  a.CommitSha,
+			"ref":        a.Ref,
+		},
+		"$setOnInsert": bson.M{"createdat": primitive.NewDateTimeFromTime(time.Now().UTC())},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("artifacts")
+	_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+
+	return err
+}
+
+func (r *Repository) GetArtifact(ctx context.Context, projectId, id primitive.ObjectID) (*Artifact, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("artifacts")
+
+	var a Artifact
+	err := coll.FindOne(ctx, bson.M{"_id": id, "projectid": projectId}).Decode(&a)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// GetArtifacts searches the artifacts of a project, newest first
+func (r *Repository) GetArtifacts(ctx context.Context, input GetArtifactsInput) ([]Artifact, error) {
+	filter := bson.M{"projectid": input.ProjectId}
+	if !input.PipelineId.IsZero() {
+		filter["pipelineid"] = input.PipelineId
+	}
+	if !input.RunId.IsZero() {
+		filter["runid"] = input.RunId
+	}
+	if input.Name != "" {
+		filter["name"] = input.Name
+	}
+	if input.Tag != "" {
+		filter["tag"] = input.Tag
+	}
+	if input.Digest != "" {
+		filter["digest"] = input.Digest
+	}
+	if input.CommitSha != "" {
+		filter["commitsha"] = input.CommitSha
+	}
+
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}, {"_id", -1}})
+	if input.Limit > 0 {
+		opts.SetLimit(input.Limit)
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("artifacts")
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []Artifact
+	if err = cursor.All(ctx, &artifacts); err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
+
+func (r *Repository) DeleteArtifacts(ctx context.Context, projectId primitive.ObjectID, ids []primitive.ObjectID) (int64, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("artifacts")
+	result, err := coll.DeleteMany(ctx, bson.M{"projectid": projectId, "_id": bson.M{"$in": ids}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+// GetArtifactRetentionProjects returns the projects with an artifact retention policy
+func (r *Repository) GetArtifactRetentionProjects(ctx context.Context) ([]Project, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"artifactretention.keeplast": bson.M{"$gt": 0}},
+		bson.M{"artifactretention.maxagedays": bson.M{"$gt": 0}},
+	}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("projects")
+	cursor, err := coll.Find(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []Project
+	if err = cursor.All(ctx, &projects); err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChangeEvent is a change stream event of the pipelines, runs or outbox collections
+type ChangeEvent struct {
+	OperationType     string   `bson:"operationType"`
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+	Ns struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+}
+
+// WatchStatusChanges opens a change stream over the collections status events are derived from, resuming after the token when set.
+// Every replica watches on its own, so events reach clients whichever replica they are connected to
+func (r *Repository) WatchStatusChanges(ctx context.Context, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.M{
+			"ns.coll":       bson.M{"$in": bson.A{"pipelines", "runs", "outbox"}},
+			"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+		}}},
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+
+	return r.mongoClient.Database("pipeline").Watch(ctx, pipeline, opts)
+}
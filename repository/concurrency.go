@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ConcurrencyQueue  = "queue"
+	ConcurrencyReject = "reject"
+	ConcurrencyCancel = "cancel"
+)
+
+type ConcurrencyConfig struct {
+	// queue (default), reject or cancel
+	Policy string `json:"policy"`
+	// pipelines of a project sharing a group never run at the same time
+	Group string `json:"group"`
+}
+
+// Validate rejects unknown policies, which would otherwise silently queue
+func (c *ConcurrencyConfig) Validate() error {
+	switch c.Policy {
+	case "", ConcurrencyQueue, ConcurrencyReject, ConcurrencyCancel:
+		return nil
+	}
+
+	return fmt.Errorf("unknown concurrency policy %q, expected %s, %s or %s", c.Policy, ConcurrencyQueue, ConcurrencyReject, ConcurrencyCancel)
+}
+
+type ConcurrencySlot struct {
+	Key        string             `json:"key" bson:"_id"`
+	RunId      primitive.ObjectID `json:"runId"`
+	PipelineId primitive.ObjectID `json:"pipelineId"`
+	CreatedAt  primitive.DateTime `json:"createdAt"`
+}
+
+func PipelineSlotKey(pipelineId primitive.ObjectID) string {
+	return fmt.Sprintf("pipeline:%s", pipelineId.Hex())
+}
+
+func GroupSlotKey(projectId primitive.ObjectID, group string) string {
+	return fmt.Sprintf("group:%s:%s", projectId.Hex(), group)
+}
+
+// AcquireConcurrencySlot takes the slot for a run and reports false when another run holds it
+func (r *Repository) AcquireConcurrencySlot(ctx context.Context, key string, runId, pipelineId primitive.ObjectID) (bool, error) {
+	doc := bson.M{"_id": key, "runid": runId, "pipelineid": pipelineId, "createdat": primitive.NewDateTimeFromTime(time.Now().UTC())}
+
+	coll := r.mongoClient.Database("pipeline").Collection("concurrency")
+	_, err := coll.InsertOne(ctx, doc)
+
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r *Repository) ReleaseConcurrencySlots(ctx context.Context, runId primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("concurrency")
+	_, err := coll.DeleteMany(ctx, bson.M{"runid": runId})
+
+	return err
+}
+
+func (r *Repository) GetConcurrencySlots(ctx context.Context, keys []string) ([]ConcurrencySlot, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("concurrency")
+
+	cursor, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return nil, err
+	}
+
+	var slots []ConcurrencySlot
+	if err = cursor.All(ctx, &slots); err != nil {
+		return nil, err
+	}
+
+	return slots, nil
+}
@@ -0,0 +1,163 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deployment is a successful run of a deploy task, what went where and why
+type Deployment struct {
+	Id            primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId     primitive.ObjectID `json:"projectId"`
+	PipelineId    primitive.ObjectID `json:"pipelineId"`
+	TaskId        primitive.ObjectID `json:"taskId"`
+	TaskName      string             `json:"taskName"`
+	MatrixKey     string             `json:"matrixKey" bson:",omitempty"`
+	Matrix        map[string]string  `json:"matrix" bson:",omitempty"`
+	EnvironmentId primitive.ObjectID `json:"environmentId" bson:",omitempty"`
+	Environment   string             `json:"environment"`
+	RunId         primitive.ObjectID `json:"runId"`
+	// server the task ran on
+	Server string `json:"server"`
+	// image or artifact reference reported in the task outputs
+	Image     string `json:"image"`
+	Artifact  string `json:"artifact"`
+	CommitSha string `json:"commitSha"`
+	Ref       string `json:"ref"`
+	// member who started the run, or the commit author for git triggers
+	TriggeredBy primitive.ObjectID `json:"triggeredBy" bson:",omitempty"`
+	Author      string             `json:"author"`
+	TriggerType string             `json:"triggerType"`
+	Outputs     map[string]string  `json:"outputs"`
+	// outputs of the run's tasks at deploy time, keyed by task id, rollbacks start from them
+	RunOutputs map[string]map[string]string `json:"runOutputs"`
+	// deployment a rollback restored
+	RollbackOf primitive.ObjectID `json:"rollbackOf" bson:",omitempty"`
+	CreatedAt  primitive.DateTime `json:"createdAt"`
+}
+
+type GetDeploymentsInput struct {
+	ProjectId     primitive.ObjectID
+	EnvironmentId *primitive.ObjectID
+	PipelineId    *primitive.ObjectID
+	Limit         int64
+}
+
+func (r *Repository) CreateDeployment(ctx context.Context, d *Deployment) (primitive.ObjectID, error) {
+	d.Id = primitive.NewObjectID()
+	d.CreatedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("deployments")
+	_, err := coll.InsertOne(ctx, d)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return d.Id, nil
+}
+
+func (r *Repository) GetDeployment(ctx context.Context, projectId, id primitive.ObjectID) (*Deployment, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("deployments")
+
+	var d Deployment
+	err := coll.FindOne(ctx, bson.M{"_id": id, "projectid": projectId}).Decode(&d)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func deploymentsFilter(input GetDeploymentsInput) bson.M {
+	filter := bson.M{"projectid": input.ProjectId}
+	if input.EnvironmentId != nil {
+		filter["environmentid"] = input.EnvironmentId
+		if input.EnvironmentId.IsZero() {
+			filter["environmentid"] = nil
+		}
+	}
+	if input.PipelineId != nil {
+		filter["pipelineid"] = input.PipelineId
+	}
+
+	return filter
+}
+
+// GetDeployments returns the deploy history, newest first
+func (r *Repository) GetDeployments(ctx context.Context, input GetDeploymentsInput) ([]Deployment, error) {
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}})
+	if input.Limit > 0 {
+		opts.SetLimit(input.Limit)
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("deployments")
+	cursor, err := coll.Find(ctx, deploymentsFilter(input), opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []Deployment
+	if err = cursor.All(ctx, &deployments); err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+}
+
+// GetCurrentDeployments returns the latest deployment of every deploy task, and matrix execution, per environment
+func (r *Repository) GetCurrentDeployments(ctx context.Context, input GetDeploymentsInput) ([]Deployment, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", deploymentsFilter(input)}},
+		{{"$sort", bson.D{{"createdat", -1}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"environmentid", "$environmentid"}, {"taskid", "$taskid"}, {"matrixkey", "$matrixkey"}}},
+			{"deployment", bson.D{{"$first", "$$ROOT"}}},
+		}}},
+		{{"$replaceRoot", bson.D{{"newRoot", "$deployment"}}}},
+		{{"$sort", bson.D{{"environment", 1}, {"taskname", 1}, {"matrixkey", 1}}}},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("deployments")
+	cursor, err := coll.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []Deployment
+	if err = cursor.All(ctx, &deployments); err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+}
+
+// GetDeployedRefs returns the distinct images and artifacts the deployments of a project name, current or not,
+// as any of them may be rolled back to
+func (r *Repository) GetDeployedRefs(ctx context.Context, projectId primitive.ObjectID) ([]string, []string, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("deployments")
+
+	var refs [2][]string
+	for i, field := range []string{"image", "artifact"} {
+		values, err := coll.Distinct(ctx, field, bson.M{"projectid": projectId})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, v := range values {
+			if ref, ok := v.(string); ok && ref != "" {
+				refs[i] = append(refs[i], ref)
+			}
+		}
+	}
+
+	return refs[0], refs[1], nil
+}
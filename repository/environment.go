@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnvironmentProtection restricts who and what may run against an environment
+type EnvironmentProtection struct {
+	// roles of the members allowed to start runs, any member when empty
+	Roles []types.Role `json:"roles"`
+	// branch patterns runs must build, the pushed branch of git triggers and the watched one otherwise; any when empty
+	Branches []string `json:"branches"`
+	// approvals needed before the first tasks of a run start, none when zero
+	RequiredApprovers int          `json:"requiredApprovers"`
+	ApproverRoles     []types.Role `json:"approverRoles"`
+}
+
+// Environment is a deploy target of a project, like staging or production, with its own variables and secrets
+type Environment struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId primitive.ObjectID `json:"projectId"`
+	Name      string             `json:"name"`
+	// merged over the pipeline arguments of runs targeting the environment
+	Variables  map[string]string     `json:"variables"`
+	Protection EnvironmentProtection `json:"protection"`
+	CreatedAt  primitive.DateTime    `json:"createdAt"`
+	UpdatedAt  primitive.DateTime    `json:"updatedAt"`
+}
+
+type CreateEnvironmentInput struct {
+	ProjectId  primitive.ObjectID
+	Name       string
+	Variables  map[string]string
+	Protection EnvironmentProtection
+}
+
+type UpdateEnvironment struct {
+	Name       *string                `json:"name" bson:",omitempty"`
+	Variables  map[string]string      `json:"variables" bson:",omitempty"`
+	Protection *EnvironmentProtection `json:"protection" bson:",omitempty"`
+}
+
+type UpdateEnvironmentInput struct {
+	Id          primitive.ObjectID
+	ProjectId   primitive.ObjectID
+	Environment UpdateEnvironment
+}
+
+func (r *Repository) CreateEnvironment(ctx context.Context, input *CreateEnvironmentInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["createdat"] = now
+	doc["updatedat"] = now
+
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+func (r *Repository) GetEnvironment(ctx context.Context, projectId, id primitive.ObjectID) (*Environment, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+
+	var env Environment
+	err := coll.FindOne(ctx, bson.M{"_id": id, "projectid": projectId}).Decode(&env)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &env, nil
+}
+
+func (r *Repository) GetEnvironmentByName(ctx context.Context, projectId primitive.ObjectID, name string) (*Environment, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+
+	var env Environment
+	err := coll.FindOne(ctx, bson.M{"projectid": projectId, "name": name}).Decode(&env)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &env, nil
+}
+
+func (r *Repository) GetEnvironments(ctx context.Context, projectId primitive.ObjectID) ([]Environment, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+	cursor, err := coll.Find(ctx, bson.M{"projectid": projectId}, options.Find().SetSort(bson.D{{"name", 1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var envs []Environment
+	if err = cursor.All(ctx, &envs); err != nil {
+		return nil, err
+	}
+
+	return envs, nil
+}
+
+func (r *Repository) UpdateEnvironment(ctx context.Context, input UpdateEnvironmentInput) error {
+	doc := StructToBsonDoc(input.Environment)
+	doc["updatedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": input.Id, "projectid": input.ProjectId}, bson.M{"$set": doc})
+
+	return err
+}
+
+// DeleteEnvironment removes the environment, the secrets scoped to it are deleted beforehand
+func (r *Repository) DeleteEnvironment(ctx context.Context, projectId, id primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("environments")
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id, "projectid": projectId})
+
+	return err
+}
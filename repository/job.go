@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ClaimJobInput struct {
+	ProjectId primitive.ObjectID
+	AgentId   primitive.ObjectID
+	Host      string
+	Labels    map[string]string
+	Lease     time.Duration
+	// jobs claimed this many times are no longer handed out
+	MaxAttempts int
+}
+
+// ClaimJob leases the next due pull message the agent may run: those pinned to its host and those
+// whose labels it carries, including messages whose lease ran out because their agent vanished
+func (r *Repository) ClaimJob(ctx context.Context, input ClaimJobInput) (*OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	labels := bson.A{}
+	for k, v := range input.Labels {
+		labels = append(labels, bson.D{{"k", k}, {"v", v}})
+	}
+
+	targets := bson.A{
+		bson.M{"host": "", "$expr": bson.M{"$setIsSubset": bson.A{
+			bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$agentlabels", bson.M{}}}},
+			bson.M{"$literal": labels},
+		}}},
+	}
+	if input.Host != "" {
+		targets = append(targets, bson.M{"host": input.Host})
+	}
+
+	filter := bson.M{
+		"projectid": input.ProjectId,
+		"pull":      true,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"status": OutboxPending, "nextattemptat": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+				bson.M{"status": OutboxInFlight, "lockeduntil": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+			}},
+			bson.M{"$or": targets},
+		},
+	}
+	if input.MaxAttempts > 0 {
+		filter["attemptcount"] = bson.M{"$lt": input.MaxAttempts}
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"status":      OutboxInFlight,
+			"claimedby":   input.AgentId,
+			"lockeduntil": primitive.NewDateTimeFromTime(now.Add(input.Lease)),
+			"updatedat":   primitive.NewDateTimeFromTime(now),
+		},
+		"$inc":  bson.M{"attemptcount": 1},
+		"$push": bson.M{"attempts": DeliveryAttempt{StartedAt: primitive.NewDateTimeFromTime(now), Host: input.Host}},
+	}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{ReturnDocument: &after, Sort: bson.D{{"nextattemptat", 1}}}
+
+	var msg OutboxMessage
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// DeadLetterJobs marks dead the pull jobs of a project whose lease ran out on their last attempt and returns them
+func (r *Repository) DeadLetterJobs(ctx context.Context, projectId primitive.ObjectID, maxAttempts int) ([]OutboxMessage, error) {
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	filter := bson.M{"projectid": projectId, "pull": true, "status": OutboxInFlight, "lockeduntil": bson.M{"$lte": now}, "attemptcount": bson.M{"$gte": maxAttempts}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []OutboxMessage
+	if err = cursor.All(ctx, &expired); err != nil {
+		return nil, err
+	}
+
+	// only the caller that moved a job reports it dead, concurrent claims see it gone
+	var dead []OutboxMessage
+	for _, msg := range expired {
+		filter := bson.M{"_id": msg.Id, "status": OutboxInFlight, "lockeduntil": bson.M{"$lte": now}}
+		update := bson.M{"$set": bson.M{"status": OutboxDead, "lockeduntil": nil, "updatedat": now}}
+
+		res, err := coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return dead, err
+		}
+
+		if res.ModifiedCount == 1 {
+			dead = append(dead, msg)
+		}
+	}
+
+	return dead, nil
+}
+
+// RenewJobLease extends the lease of a job the agent still holds, it reports false once the job was lost
+func (r *Repository) RenewJobLease(ctx context.Context, id, agentId primitive.ObjectID, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	filter := bson.M{"_id": id, "claimedby": agentId, "status": OutboxInFlight}
+	update := bson.M{"$set": bson.M{"lockeduntil": primitive.NewDateTimeFromTime(now.Add(lease)), "updatedat": primitive.NewDateTimeFromTime(now)}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.MatchedCount == 1, nil
+}
+
+// CompleteJob marks a job the agent holds delivered
+func (r *Repository) CompleteJob(ctx context.Context, id, agentId primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": id, "claimedby": agentId, "status": OutboxInFlight}
+	update := bson.M{"$set": bson.M{"status": OutboxDelivered, "lockeduntil": nil, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.MatchedCount == 1, nil
+}
+
+// CompleteTaskJobs marks the claimed jobs of a task delivered once the task reported a final status
+func (r *Repository) CompleteTaskJobs(ctx context.Context, runId, taskId primitive.ObjectID, matrixKey string) error {
+	filter := bson.M{"runid": runId, "taskid": taskId, "pull": true, "status": OutboxInFlight}
+	if matrixKey != "" {
+		filter["matrixkey"] = matrixKey
+	}
+
+	update := bson.M{"$set": bson.M{"status": OutboxDelivered, "lockeduntil": nil, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	_, err := coll.UpdateMany(ctx, filter, update)
+
+	return err
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestClaimJob(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	defer r.mongoClient.Database("pipeline").Collection("outbox").DeleteMany(ctx, bson.M{"projectid": pid})
+
+	pinned, _ := r.CreateOutboxMessage(ctx, &CreateOutboxMessageInput{ProjectId: pid, Pull: true, Host: "builder.local"})
+	labeled, _ := r.CreateOutboxMessage(ctx, &CreateOutboxMessageInput{ProjectId: pid, Pull: true, AgentLabels: map[string]string{"arch": "arm64"}})
+
+	agentId := primitive.NewObjectID()
+
+	// an agent without the labels only gets the job pinned to its host
+	msg, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: agentId, Host: "builder.local", Labels: map[string]string{"arch": "amd64"}, Lease: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Id != pinned || msg.Status != OutboxInFlight || msg.AttemptCount != 1 {
+		t.Errorf("unexpected claim %+v", msg)
+	}
+
+	if _, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: agentId, Host: "builder.local", Labels: map[string]string{"arch": "amd64"}, Lease: time.Minute}); err != mongo.ErrNoDocuments {
+		t.Errorf("expected a leased job not to be claimed twice, got %v", err)
+	}
+
+	msg, err = r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: primitive.NewObjectID(), Labels: map[string]string{"arch": "arm64", "os": "linux"}, Lease: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Id != labeled {
+		t.Errorf("expected job %s for an agent carrying its labels, got %s", labeled.Hex(), msg.Id.Hex())
+	}
+}
+
+func TestRenewJobLease(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	defer r.mongoClient.Database("pipeline").Collection("outbox").DeleteMany(ctx, bson.M{"projectid": pid})
+
+	r.CreateOutboxMessage(ctx, &CreateOutboxMessageInput{ProjectId: pid, Pull: true})
+
+	holder := primitive.NewObjectID()
+	msg, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: holder, Lease: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewed, _ := r.RenewJobLease(ctx, msg.Id, primitive.NewObjectID(), time.Minute); renewed {
+		t.Error("expected an agent not holding the job to be refused")
+	}
+
+	if renewed, _ := r.RenewJobLease(ctx, msg.Id, holder, time.Hour); !renewed {
+		t.Error("expected the holder to renew its lease")
+	}
+
+	renewedMsg, _ := r.GetOutboxMessage(ctx, msg.Id)
+	if !renewedMsg.LockedUntil.Time().After(msg.LockedUntil.Time()) {
+		t.Errorf("expected the lease to be extended past %s, got %s", msg.LockedUntil.Time(), renewedMsg.LockedUntil.Time())
+	}
+
+	if completed, _ := r.CompleteJob(ctx, msg.Id, holder); !completed {
+		t.Fatal("expected the holder to complete the job")
+	}
+
+	if renewed, _ := r.RenewJobLease(ctx, msg.Id, holder, time.Minute); renewed {
+		t.Error("expected a completed job not to be renewed")
+	}
+}
+
+func TestClaimJobRedelivery(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	defer r.mongoClient.Database("pipeline").Collection("outbox").DeleteMany(ctx, bson.M{"projectid": pid})
+
+	id, _ := r.CreateOutboxMessage(ctx, &CreateOutboxMessageInput{ProjectId: pid, Pull: true})
+
+	// the first agent vanishes, its lease runs out right away
+	vanished := primitive.NewObjectID()
+	if _, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: vanished, Lease: -time.Second, MaxAttempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if dead, _ := r.DeadLetterJobs(ctx, pid, 2); len(dead) != 0 {
+		t.Errorf("expected a job with attempts left not to be dead lettered, got %d", len(dead))
+	}
+
+	taker := primitive.NewObjectID()
+	msg, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: taker, Lease: -time.Second, MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Id != id || msg.AttemptCount != 2 {
+		t.Errorf("expected job %s to be redelivered on its second attempt, got %+v", id.Hex(), msg)
+	}
+
+	if renewed, _ := r.RenewJobLease(ctx, id, vanished, time.Minute); renewed {
+		t.Error("expected the agent that lost the job not to renew it")
+	}
+
+	if _, err := r.ClaimJob(ctx, ClaimJobInput{ProjectId: pid, AgentId: primitive.NewObjectID(), Lease: time.Minute, MaxAttempts: 2}); err != mongo.ErrNoDocuments {
+		t.Errorf("expected a job out of attempts not to be claimed, got %v", err)
+	}
+
+	dead, err := r.DeadLetterJobs(ctx, pid, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dead) != 1 || dead[0].Id != id {
+		t.Fatalf("expected job %s to be dead lettered, got %d jobs", id.Hex(), len(dead))
+	}
+
+	if dead, _ := r.DeadLetterJobs(ctx, pid, 2); len(dead) != 0 {
+		t.Errorf("expected a job to be dead lettered once, got it %d more times", len(dead))
+	}
+
+	msg, _ = r.GetOutboxMessage(ctx, id)
+	if msg.Status != OutboxDead {
+		t.Errorf("expected status %s, got %s", OutboxDead, msg.Status)
+	}
+}
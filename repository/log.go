@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LogChunk locates a stored piece of a task log, Offset and End are byte positions within the whole log
+type LogChunk struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	RunId     primitive.ObjectID `json:"runId"`
+	TaskId    primitive.ObjectID `json:"taskId"`
+	MatrixKey string             `json:"matrixKey"`
+	Seq       int64              `json:"seq"`
+	Offset    int64              `json:"offset"`
+	End       int64              `json:"end"`
+	Lines     int                `json:"lines"`
+	// key of the chunk in the log store
+	Key       string             `json:"key"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+}
+
+// LogRef names the log of a task in a run, or of one execution of a matrix task
+type LogRef struct {
+	RunId     primitive.ObjectID
+	TaskId    primitive.ObjectID
+	MatrixKey string
+}
+
+type logCursor struct {
+	Seq  int64 `bson:"seq"`
+	Size int64 `bson:"size"`
+	// masking block rule left open by the last chunk
+	MaskBlock string `bson:"maskblock"`
+}
+
+func (ref LogRef) filter() bson.M {
+	return bson.M{"runid": ref.RunId, "taskid": ref.TaskId, "matrixkey": ref.MatrixKey}
+}
+
+// LogBucket is the GridFS bucket of the GridFS log store
+func (r *Repository) LogBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(r.mongoClient.Database("pipeline"), options.GridFSBucket().SetName("logs"))
+}
+
+// ReserveLogChunk atomically takes the next sequence number and byte range of a log for a chunk of the size
+func (r *Repository) ReserveLogChunk(ctx context.Context, ref LogRef, size int64) (seq, offset int64, err error) {
+	coll := r.mongoClient.Database("pipeline").Collection("logcursors")
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var cursor logCursor
+	err = coll.FindOneAndUpdate(ctx, ref.filter(), bson.M{"$inc": bson.M{"seq": 1, "size": size}}, opts).Decode(&cursor)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return cursor.Seq, cursor.Size - size, nil
+}
+
+func (r *Repository) CreateLogChunk(ctx context.Context, chunk *LogChunk) error {
+	chunk.Id = primitive.NewObjectID()
+	chunk.CreatedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("logchunks")
+	_, err := coll.InsertOne(ctx, chunk)
+
+	return err
+}
+
+// GetLogChunks returns the chunks of a log ending after the offset in order
+func (r *Repository) GetLogChunks(ctx context.Context, ref LogRef, offset int64) ([]LogChunk, error) {
+	filter := ref.filter()
+	filter["end"] = bson.M{"$gt": offset}
+
+	coll := r.mongoClient.Database("pipeline").Collection("logchunks")
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{"seq", 1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []LogChunk
+	if err = cursor.All(ctx, &chunks); err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// GetLastLogChunks returns the last chunks of a log holding at least the number of lines, in order
+func (r *Repository) GetLastLogChunks(ctx context.Context, ref LogRef, lines int) ([]LogChunk, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("logchunks")
+	cursor, err := coll.Find(ctx, ref.filter(), options.Find().SetSort(bson.D{{"seq", -1}}))
+
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var chunks []LogChunk
+	count := 0
+
+	for count < lines && cursor.Next(ctx) {
+		var chunk LogChunk
+		if err = cursor.Decode(&chunk); err != nil {
+			return nil, err
+		}
+
+		chunks = append([]LogChunk{chunk}, chunks...)
+		count += chunk.Lines
+	}
+
+	return chunks, cursor.Err()
+}
+
+// GetLogSize returns the number of bytes written to a log so far
+func (r *Repository) GetLogSize(ctx context.Context, ref LogRef) (int64, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("logcursors")
+
+	var cursor logCursor
+	err := coll.FindOne(ctx, ref.filter()).Decode(&cursor)
+
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return cursor.Size, nil
+}
+
+// GetLogMaskBlock returns the masking block rule the log's last chunk left open, if any
+func (r *Repository) GetLogMaskBlock(ctx context.Context, ref LogRef) (string, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("logcursors")
+
+	var cursor logCursor
+	err := coll.FindOne(ctx, ref.filter()).Decode(&cursor)
+
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return cursor.MaskBlock, nil
+}
+
+func (r *Repository) SetLogMaskBlock(ctx context.Context, ref LogRef, block string) error {
+	coll := r.mongoClient.Database("pipeline").Collection("logcursors")
+	_, err := coll.UpdateOne(ctx, ref.filter(), bson.M{"$set": bson.M{"maskblock": block}}, options.Update().SetUpsert(true))
+
+	return err
+}
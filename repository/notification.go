@@ -0,0 +1,326 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// run outcomes subscriptions can be notified of
+const (
+	NotifyFailed           = "FAILED"
+	NotifyRecovered        = "RECOVERED"
+	NotifySucceeded        = "SUCCEEDED"
+	NotifyCanceled         = "CANCELED"
+	NotifyAwaitingApproval = "AWAITING_APPROVAL"
+)
+
+const (
+	NotificationPending  = "PENDING"
+	NotificationInFlight = "IN_FLIGHT"
+	NotificationSent     = "SENT"
+	NotificationDead     = "DEAD"
+)
+
+// NotificationChannel is a slack or teams incoming webhook, a generic json webhook or a list of email recipients
+type NotificationChannel struct {
+	Type string `json:"type"`
+	// endpoint of webhook based channels
+	Url string `json:"url"`
+	// extra headers of generic webhooks, e.g. for authorization
+	Headers map[string]string `json:"headers"`
+	To      []string          `json:"to"`
+}
+
+// NotificationTemplate overrides the default text/template of the messages, empty fields keep the defaults
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// NotificationSubscription sends run outcomes of a project, or of one of its pipelines, to a channel
+type NotificationSubscription struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId primitive.ObjectID `json:"projectId"`
+	// zero for all pipelines of the project
+	PipelineId primitive.ObjectID   `json:"pipelineId"`
+	Name       string               `json:"name"`
+	Channel    NotificationChannel  `json:"channel"`
+	Events     []string             `json:"events"`
+	Template   NotificationTemplate `json:"template"`
+	Disabled   bool                 `json:"disabled"`
+	CreatedAt  primitive.DateTime   `json:"createdAt"`
+	UpdatedAt  primitive.DateTime   `json:"updatedAt"`
+}
+
+type CreateNotificationSubscriptionInput struct {
+	ProjectId  primitive.ObjectID
+	PipelineId primitive.ObjectID `bson:",omitempty"`
+	Name       string
+	Channel    NotificationChannel
+	Events     []string
+	Template   NotificationTemplate
+}
+
+type UpdateNotificationSubscription struct {
+	Name     *string               `json:"name" bson:",omitempty"`
+	Channel  *NotificationChannel  `json:"channel" bson:",omitempty"`
+	Events   []string              `json:"events" bson:",omitempty"`
+	Template *NotificationTemplate `json:"template" bson:",omitempty"`
+	Disabled *bool                 `json:"disabled" bson:",omitempty"`
+}
+
+type UpdateNotificationSubscriptionInput struct {
+	Id           primitive.ObjectID
+	ProjectId    primitive.ObjectID
+	Subscription UpdateNotificationSubscription
+}
+
+type GetNotificationSubscriptionsInput struct {
+	ProjectId  primitive.ObjectID
+	PipelineId *primitive.ObjectID
+}
+
+// Notification is a rendered message queued for delivery, retried with backoff like outbox messages
+type Notification struct {
+	Id             primitive.ObjectID  `json:"id" bson:"_id"`
+	ProjectId      primitive.ObjectID  `json:"projectId"`
+	SubscriptionId primitive.ObjectID  `json:"subscriptionId"`
+	RunId          primitive.ObjectID  `json:"runId"`
+	Event          string              `json:"event"`
+	Channel        NotificationChannel `json:"channel"`
+	Subject        string              `json:"subject"`
+	Body           string              `json:"body"`
+	Status         string              `json:"status"`
+	AttemptCount   int                 `json:"attemptCount"`
+	Attempts       []DeliveryAttempt   `json:"attempts"`
+	NextAttemptAt  primitive.DateTime  `json:"nextAttemptAt"`
+	LockedUntil    primitive.DateTime  `json:"lockedUntil"`
+	CreatedAt      primitive.DateTime  `json:"createdAt"`
+	UpdatedAt      primitive.DateTime  `json:"updatedAt"`
+}
+
+type CreateNotificationInput struct {
+	ProjectId      primitive.ObjectID
+	SubscriptionId primitive.ObjectID
+	RunId          primitive.ObjectID `bson:",omitempty"`
+	Event          string
+	Channel        NotificationChannel
+	Subject        string
+	Body           string
+}
+
+type GetNotificationsInput struct {
+	ProjectId primitive.ObjectID
+	RunId     *primitive.ObjectID `bson:",omitempty"`
+	Status    *string             `bson:",omitempty"`
+}
+
+type UpdateNotificationAttemptInput struct {
+	Id      primitive.ObjectID
+	Attempt DeliveryAttempt
+	// status after the attempt, PENDING schedules a retry at NextAttemptAt
+	Status        string
+	NextAttemptAt primitive.DateTime
+}
+
+func (r *Repository) CreateNotificationSubscription(ctx context.Context, input *CreateNotificationSubscriptionInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["disabled"] = false
+	doc["createdat"] = now
+	doc["updatedat"] = now
+
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+func (r *Repository) GetNotificationSubscription(ctx context.Context, projectId, id primitive.ObjectID) (*NotificationSubscription, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+
+	var sub NotificationSubscription
+	err := coll.FindOne(ctx, bson.M{"_id": id, "projectid": projectId}).Decode(&sub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+func (r *Repository) GetNotificationSubscriptions(ctx context.Context, input GetNotificationSubscriptionsInput) ([]NotificationSubscription, error) {
+	filter := bson.M{"projectid": input.ProjectId}
+	if input.PipelineId != nil {
+		filter["pipelineid"] = input.PipelineId
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{"createdat", 1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []NotificationSubscription
+	if err = cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// GetEventSubscriptions returns the enabled subscriptions of the project or the pipeline to any of the events
+func (r *Repository) GetEventSubscriptions(ctx context.Context, projectId, pipelineId primitive.ObjectID, events []string) ([]NotificationSubscription, error) {
+	filter := bson.M{
+		"projectid":  projectId,
+		"pipelineid": bson.M{"$in": bson.A{nil, pipelineId}},
+		"events":     bson.M{"$in": events},
+		"disabled":   bson.M{"$ne": true},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+	cursor, err := coll.Find(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []NotificationSubscription
+	if err = cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+func (r *Repository) UpdateNotificationSubscription(ctx context.Context, input UpdateNotificationSubscriptionInput) error {
+	doc := StructToBsonDoc(input.Subscription)
+	doc["updatedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": input.Id, "projectid": input.ProjectId}, bson.M{"$set": doc})
+
+	return err
+}
+
+func (r *Repository) DeleteNotificationSubscription(ctx context.Context, projectId, id primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("notificationsubscriptions")
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id, "projectid": projectId})
+
+	return err
+}
+
+func (r *Repository) CreateNotification(ctx context.Context, input *CreateNotificationInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["status"] = NotificationPending
+	doc["attemptcount"] = 0
+	doc["attempts"] = bson.A{}
+	doc["nextattemptat"] = now
+	doc["createdat"] = now
+
+	coll := r.mongoClient.Database("pipeline").Collection("notifications")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// ClaimNotification leases the next due notification, including in-flight ones whose lease ran out
+func (r *Repository) ClaimNotification(ctx context.Context, lease time.Duration) (*Notification, error) {
+	now := time.Now().UTC()
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": NotificationPending, "nextattemptat": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+		bson.M{"status": NotificationInFlight, "lockeduntil": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"status":      NotificationInFlight,
+		"lockeduntil": primitive.NewDateTimeFromTime(now.Add(lease)),
+		"updatedat":   primitive.NewDateTimeFromTime(now),
+	}}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{ReturnDocument: &after, Sort: bson.D{{"nextattemptat", 1}}}
+
+	var n Notification
+	coll := r.mongoClient.Database("pipeline").Collection("notifications")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+func (r *Repository) UpdateNotificationAttempt(ctx context.Context, input UpdateNotificationAttemptInput) error {
+	doc := bson.M{"status": input.Status, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC()), "lockeduntil": nil}
+	if input.Status == NotificationPending {
+		doc["nextattemptat"] = input.NextAttemptAt
+	}
+
+	update := bson.M{
+		"$set":  doc,
+		"$inc":  bson.M{"attemptcount": 1},
+		"$push": bson.M{"attempts": input.Attempt},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("notifications")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": input.Id}, update)
+
+	return err
+}
+
+func (r *Repository) GetNotifications(ctx context.Context, input GetNotificationsInput) ([]Notification, error) {
+	filter := StructToBsonDoc(input)
+
+	coll := r.mongoClient.Database("pipeline").Collection("notifications")
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{"createdat", -1}}).SetLimit(100))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []Notification
+	if err = cursor.All(ctx, &notifications); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// GetPreviousFinishedRun returns the latest run of the pipeline created before the given one that succeeded or failed
+func (r *Repository) GetPreviousFinishedRun(ctx context.Context, run *Run) (*Run, error) {
+	filter := bson.M{
+		"pipelineid": run.PipelineId,
+		"_id":        bson.M{"$ne": run.Id},
+		"createdat":  bson.M{"$lte": run.CreatedAt},
+		"status":     bson.M{"$in": bson.A{RunDone, RunFailed}},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	var prev Run
+	err := coll.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{"createdat", -1}})).Decode(&prev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &prev, nil
+}
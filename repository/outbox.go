@@ -0,0 +1,246 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	OutboxPending   = "PENDING"
+	OutboxInFlight  = "IN_FLIGHT"
+	OutboxDelivered = "DELIVERED"
+	OutboxDead      = "DEAD"
+	OutboxCanceled  = "CANCELED"
+)
+
+type DeliveryAttempt struct {
+	StartedAt  primitive.DateTime `json:"startedAt"`
+	Duration   int64              `json:"duration"` // milliseconds
+	StatusCode int                `json:"statusCode"`
+	// agent host the attempt was sent to
+	Host  string `json:"host"`
+	Error string `json:"error"`
+}
+
+type OutboxMessage struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId   primitive.ObjectID `json:"projectId"`
+	Host        string             `json:"host"`
+	AgentLabels map[string]string  `json:"agentLabels"`
+	// claimed by pull agents instead of being pushed
+	Pull          bool               `json:"pull"`
+	ClaimedBy     primitive.ObjectID `json:"claimedBy" bson:",omitempty"`
+	RunId         primitive.ObjectID `json:"runId"`
+	PipelineId    primitive.ObjectID `json:"pipelineId"`
+	TaskId        primitive.ObjectID `json:"taskId"`
+	MatrixKey     string             `json:"matrixKey"`
+	EnvironmentId primitive.ObjectID `json:"environmentId" bson:",omitempty"`
+	Url           string             `json:"url"`
+	Body          string             `json:"body"`
+	// marks the secret references of Body that are resolved on delivery
+	SecretNonce   string             `json:"-"`
+	Status        string             `json:"status"`
+	AttemptCount  int                `json:"attemptCount"`
+	Attempts      []DeliveryAttempt  `json:"attempts"`
+	NextAttemptAt primitive.DateTime `json:"nextAttemptAt"`
+	LockedUntil   primitive.DateTime `json:"lockedUntil"`
+	CreatedAt     primitive.DateTime `json:"createdAt"`
+	UpdatedAt     primitive.DateTime `json:"updatedAt"`
+}
+
+type CreateOutboxMessageInput struct {
+	ProjectId primitive.ObjectID
+	// agent host, selects the server's signing secrets; empty to route to an agent matching AgentLabels on every attempt
+	Host        string
+	AgentLabels map[string]string `bson:",omitempty"`
+	Pull        bool
+	RunId       primitive.ObjectID
+	PipelineId  primitive.ObjectID
+	TaskId      primitive.ObjectID
+	MatrixKey   string `bson:",omitempty"`
+	// scope secret references are resolved in
+	EnvironmentId primitive.ObjectID `bson:",omitempty"`
+	Url           string
+	Body          string
+	SecretNonce   string `bson:",omitempty"`
+}
+
+type GetOutboxMessagesInput struct {
+	ProjectId  primitive.ObjectID
+	Status     *string             `bson:",omitempty"`
+	RunId      *primitive.ObjectID `bson:",omitempty"`
+	PipelineId *primitive.ObjectID `bson:",omitempty"`
+}
+
+type GetOutboxMessagesOutput struct {
+	TotalCount int             `json:"totalCount"`
+	Items      []OutboxMessage `json:"items"`
+}
+
+type UpdateOutboxAttemptInput struct {
+	Id      primitive.ObjectID
+	Attempt DeliveryAttempt
+	// status after the attempt, PENDING schedules a retry at NextAttemptAt
+	Status        string
+	NextAttemptAt primitive.DateTime
+}
+
+func (r *Repository) CreateOutboxMessage(ctx context.Context, input *CreateOutboxMessageInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["status"] = OutboxPending
+	doc["attemptcount"] = 0
+	doc["attempts"] = bson.A{}
+	doc["nextattemptat"] = now
+	doc["createdat"] = now
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// ClaimOutboxMessage leases the next due push message, including in-flight ones whose lease ran out because their worker died
+func (r *Repository) ClaimOutboxMessage(ctx context.Context, lease time.Duration) (*OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	filter := bson.M{"pull": bson.M{"$ne": true}, "$or": bson.A{
+		bson.M{"status": OutboxPending, "nextattemptat": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+		bson.M{"status": OutboxInFlight, "lockeduntil": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"status":      OutboxInFlight,
+		"lockeduntil": primitive.NewDateTimeFromTime(now.Add(lease)),
+		"updatedat":   primitive.NewDateTimeFromTime(now),
+	}}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{ReturnDocument: &after, Sort: bson.D{{"nextattemptat", 1}}}
+
+	var msg OutboxMessage
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (r *Repository) UpdateOutboxAttempt(ctx context.Context, input UpdateOutboxAttemptInput) error {
+	// a message canceled while it was being sent stays canceled
+	filter := bson.M{"_id": input.Id, "status": bson.M{"$ne": OutboxCanceled}}
+
+	doc := bson.M{"status": input.Status, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC()), "lockeduntil": nil}
+	if input.Status == OutboxPending {
+		doc["nextattemptat"] = input.NextAttemptAt
+	}
+
+	update := bson.M{
+		"$set":  doc,
+		"$inc":  bson.M{"attemptcount": 1},
+		"$push": bson.M{"attempts": input.Attempt},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) GetOutboxMessage(ctx context.Context, id primitive.ObjectID) (*OutboxMessage, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+
+	var msg OutboxMessage
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (r *Repository) GetOutboxMessages(ctx context.Context, input GetOutboxMessagesInput) (*GetOutboxMessagesOutput, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+
+	filter := StructToBsonDoc(input)
+
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var output GetOutboxMessagesOutput
+	if err = cursor.All(ctx, &output.Items); err != nil {
+		return nil, err
+	}
+
+	output.TotalCount = len(output.Items)
+
+	return &output, nil
+}
+
+// RedriveOutboxMessage puts a dead message back in the queue with a fresh attempt budget, keeping its attempt history
+func (r *Repository) RedriveOutboxMessage(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	filter := bson.M{"_id": id, "status": OutboxDead}
+	update := bson.M{"$set": bson.M{"status": OutboxPending, "attemptcount": 0, "nextattemptat": now, "updatedat": now}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// GetTaskDelivery returns the latest outbox message of a task in a run
+func (r *Repository) GetTaskDelivery(ctx context.Context, runId, taskId primitive.ObjectID, matrixKey string) (*OutboxMessage, error) {
+	filter := bson.M{"runid": runId, "taskid": taskId}
+	if matrixKey != "" {
+		filter["matrixkey"] = matrixKey
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+
+	var msg OutboxMessage
+	err := coll.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{"createdat", -1}})).Decode(&msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// CancelOutboxMessages cancels the undelivered messages of a run, or of one of its tasks when taskId is set,
+// so neither the dispatcher nor pull agents act on them; pull agents holding one lose it on their next lease renewal
+func (r *Repository) CancelOutboxMessages(ctx context.Context, runId, taskId primitive.ObjectID) error {
+	filter := bson.M{"runid": runId, "status": bson.M{"$in": bson.A{OutboxPending, OutboxInFlight}}}
+	if !taskId.IsZero() {
+		filter["taskid"] = taskId
+	}
+
+	update := bson.M{"$set": bson.M{"status": OutboxCanceled, "lockeduntil": nil, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("outbox")
+	_, err := coll.UpdateMany(ctx, filter, update)
+
+	return err
+}
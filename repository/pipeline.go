@@ -11,11 +11,27 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// RefFilter selects the branches and tags a pipeline reacts to with glob or /regex/ patterns
+type RefFilter struct {
+	Branches       []string `json:"branches"`
+	BranchesIgnore []string `json:"branchesIgnore"`
+	Tags           []string `json:"tags"`
+	TagsIgnore     []string `json:"tagsIgnore"`
+}
+
+// PathFilter selects the changed files a push must touch for a pipeline to run, with glob or /regex/ patterns
+type PathFilter struct {
+	Paths       []string `json:"paths"`
+	PathsIgnore []string `json:"pathsIgnore"`
+}
+
 type Pipeline struct {
-	Id            primitive.ObjectID `json:"id" bson:"_id"`
-	Name          string             `json:"name"`
-	CreatedAt     primitive.DateTime `json:"createAt"`
-	UpdatedAt     primitive.DateTime `json:"updateAt"`
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Name      string             `json:"name"`
+	CreatedAt primitive.DateTime `json:"createAt"`
+	UpdatedAt primitive.DateTime `json:"updateAt"`
+	// bumped by every change to the definition or the tasks, imports only replace a pipeline they read unchanged
+	Revision      int64              `json:"revision"`
 	ExecutedAt    primitive.DateTime `json:"executedAt"`
 	StoppedAt     primitive.DateTime `json:"stoppedAt"`
 	ScheduledAt   primitive.DateTime `json:"scheduledAt"`
@@ -27,6 +43,13 @@ type Pipeline struct {
 	BranchWatched string             `json:"branchWatched"`
 	AutoRun       bool               `json:"autoRun"`
 	ProjectId     primitive.ObjectID `json:"projectId"`
+	Concurrency   ConcurrencyConfig  `json:"concurrency"`
+	RefFilter     RefFilter          `json:"refFilter"`
+	PathFilter    PathFilter         `json:"pathFilter"`
+	// also run on pull and merge requests targeting a watched branch
+	PullRequests bool `json:"pullRequests"`
+	// name of the environment runs target unless the run names another
+	Environment string `json:"environment"`
 }
 
 type CreatePipelineInput struct {
@@ -37,6 +60,11 @@ type CreatePipelineInput struct {
 	BranchWatched string
 	AutoRun       bool
 	ProjectId     primitive.ObjectID
+	Concurrency   ConcurrencyConfig
+	RefFilter     RefFilter
+	PathFilter    PathFilter
+	PullRequests  bool
+	Environment   string
 }
 
 type TaskFilter struct {
@@ -71,6 +99,11 @@ type PipelineUpdate struct {
 	BranchWatched *string             `bson:",omitempty"`
 	AutoRun       *bool               `bson:",omitempty"`
 	ProjectId     *primitive.ObjectID `bson:",omitempty"`
+	Concurrency   *ConcurrencyConfig  `bson:",omitempty"`
+	RefFilter     *RefFilter          `bson:",omitempty"`
+	PathFilter    *PathFilter         `bson:",omitempty"`
+	PullRequests  *bool               `bson:",omitempty"`
+	Environment   *string             `bson:",omitempty"`
 }
 
 type UpdatePipelineInput struct {
@@ -86,10 +119,18 @@ type UpdatePipelineStatusInput struct {
 }
 
 func (r *Repository) CreatePipeline(ctx context.Context, input *CreatePipelineInput) (primitive.ObjectID, error) {
+	return r.ImportPipeline(ctx, input, nil)
+}
+
+// ImportPipeline creates a pipeline with its tasks in a single write
+func (r *Repository) ImportPipeline(ctx context.Context, input *CreatePipelineInput, tasks []Task) (primitive.ObjectID, error) {
 	doc := StructToBsonDoc(input)
 
 	doc["createdat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
 	doc["status"] = types.PipelineIdle
+	if tasks != nil {
+		doc["tasks"] = tasks
+	}
 
 	coll := r.mongoClient.Database("pipeline").Collection("pipelines")
 	result, err := coll.InsertOne(ctx, doc)
@@ -171,7 +212,7 @@ func (r *Repository) UpdatePipeline(ctx context.Context, input UpdatePipelineInp
 	doc := StructToBsonDoc(input.Pipeline)
 	doc["updatedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
 
-	update := bson.M{"$set": doc}
+	update := bson.M{"$set": doc, "$inc": bson.M{"revision": 1}}
 
 	coll := r.mongoClient.Database("pipeline").Collection("pipelines")
 	_, err := coll.UpdateOne(ctx, filter, update)
@@ -199,3 +240,28 @@ func (r *Repository) UpdatePipelineStatus(ctx context.Context, input UpdatePipel
 
 	return err
 }
+
+// ReplacePipelineDefinition overwrites every definition field and the tasks of a pipeline at once, as long as
+// the pipeline is still at the revision it was read at; it reports false otherwise, so changes made meanwhile are kept
+func (r *Repository) ReplacePipelineDefinition(ctx context.Context, id primitive.ObjectID, revision int64, input *CreatePipelineInput, tasks []Task) (bool, error) {
+	filter := bson.M{"_id": id, "revision": revision}
+	if revision == 0 {
+		// never changed since it was created, or before revisions were kept
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	doc := StructToBsonDoc(input)
+	doc["tasks"] = tasks
+	doc["updatedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	update := bson.M{"$set": doc, "$inc": bson.M{"revision": 1}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("pipelines")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.MatchedCount == 1, nil
+}
@@ -16,6 +16,16 @@ type Server struct {
 	Networks map[string]string `json:"networks"`
 }
 
+// Registry is a container registry the project's images live in, logged in to with project secrets
+type Registry struct {
+	Host string `json:"host"`
+	// names of the secrets holding the login, anonymous when empty
+	UsernameSecret string `json:"usernameSecret"`
+	PasswordSecret string `json:"passwordSecret"`
+	// plain http, for registries on a private network
+	Insecure bool `json:"insecure"`
+}
+
 type Project struct {
 	Id          primitive.ObjectID `json:"id" bson:"_id"`
 	Name        string             `json:"name"`
@@ -27,6 +37,31 @@ type Project struct {
 	UpdatedAt     primitive.DateTime `json:"updatedAt"`
 	BuildServers  []Server           `json:"buildServers"`
 	DeployServers []Server           `json:"deployServers"`
+	// shared with git providers to authenticate their webhooks, sealed like project secrets
+	GitWebhookKeyId      string `json:"-"`
+	GitWebhookWrappedKey []byte `json:"-"`
+	GitWebhookCiphertext []byte `json:"-"`
+	// plaintext of a git webhook secret set before it was sealed, until a rewrap seals it
+	GitWebhookSecret string `json:"-"`
+	// name of the project secret holding the token the commit statuses of git triggered runs are reported with
+	GitApiTokenSecret string `json:"gitApiTokenSecret"`
+	// api base url of a self-hosted git provider, the server default otherwise
+	GitApiUrl string `json:"gitApiUrl"`
+	// sha256 of the token agents register with
+	AgentJoinTokenHash string            `json:"-"`
+	LogMasking         LogMasking        `json:"logMasking"`
+	ArtifactRetention  ArtifactRetention `json:"artifactRetention"`
+	Registries         []Registry        `json:"registries"`
+}
+
+// LogMasking configures the redaction of secrets from task logs, the builtin rules and secret names apply unless overridden
+type LogMasking struct {
+	// names of builtin rules not applied, e.g. jwt
+	DisabledRules []string `json:"disabledRules"`
+	// extra regular expressions whose matches are masked
+	Patterns []string `json:"patterns"`
+	// substrings of argument and config names whose values are masked, replacing the defaults when set
+	SecretNames []string `json:"secretNames"`
 }
 
 type CreateProjectInput struct {
@@ -37,10 +72,15 @@ type CreateProjectInput struct {
 }
 
 type UpdateProject struct {
-	Name          *string  `json:"name" bson:",omitempty"`
-	AvatarUrl     *string  `json:"avatarUrl" bson:",omitempty"`
-	BuildServers  []Server `json:"buildServers" bson:",omitempty"`
-	DeployServers []Server `json:"deployServers" bson:",omitempty"`
+	Name              *string            `json:"name" bson:",omitempty"`
+	AvatarUrl         *string            `json:"avatarUrl" bson:",omitempty"`
+	BuildServers      []Server           `json:"buildServers" bson:",omitempty"`
+	DeployServers     []Server           `json:"deployServers" bson:",omitempty"`
+	GitApiTokenSecret *string            `json:"gitApiTokenSecret" bson:",omitempty"`
+	GitApiUrl         *string            `json:"gitApiUrl" bson:",omitempty"`
+	LogMasking        *LogMasking        `json:"logMasking" bson:",omitempty"`
+	ArtifactRetention *ArtifactRetention `json:"artifactRetention" bson:",omitempty"`
+	Registries        []Registry         `json:"registries" bson:",omitempty"`
 }
 
 type UpdateProjectInput struct {
@@ -108,6 +148,19 @@ func (r *Repository) UpdateProject(ctx context.Context, input UpdateProjectInput
 	return nil
 }
 
+// SealGitWebhookSecret stores the sealed git webhook secret of a project, dropping the plaintext of an older one
+func (r *Repository) SealGitWebhookSecret(ctx context.Context, projectId primitive.ObjectID, keyId string, wrappedKey, ciphertext []byte) error {
+	update := bson.M{
+		"$set":   bson.M{"gitwebhookkeyid": keyId, "gitwebhookwrappedkey": wrappedKey, "gitwebhookciphertext": ciphertext},
+		"$unset": bson.M{"gitwebhooksecret": ""},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("projects")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": projectId}, update)
+
+	return err
+}
+
 func (r *Repository) DeleteProject(ctx context.Context, input DeleteProjectInput) error {
 	coll := r.mongoClient.Database("pipeline").Collection("projects")
 	filter := bson.M{"_id": input.Id, "owneruserid": input.UserId}
@@ -136,6 +189,20 @@ func (r *Repository) GetProject(ctx context.Context, input GetProjectInput) (*Pr
 	return &project, nil
 }
 
+// GetProjectById looks a project up without checking membership, for callers authenticated by other means
+func (r *Repository) GetProjectById(ctx context.Context, id primitive.ObjectID) (*Project, error) {
+	var project Project
+
+	coll := r.mongoClient.Database("pipeline").Collection("projects")
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&project)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
 func (r *Repository) GetProjects(ctx context.Context, input GetProjectsInput) (*GetProjectsOutput, error) {
 	filter := bson.M{"members.userid": bson.M{"$in": bson.A{input.UserId}}}
 
@@ -37,6 +37,16 @@ func NewRepository() (*Repository, error) {
 		panic(err)
 	}
 
+	_, err = mongoClient.Database("pipeline").Collection("secrets").Indexes().CreateOne(context.TODO(), secretIndex)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = mongoClient.Database("pipeline").Collection("agents").Indexes().CreateOne(context.TODO(), agentIndex)
+	if err != nil {
+		panic(err)
+	}
+
 	return &Repository{mongoClient: mongoClient}, nil
 }
 
@@ -0,0 +1,637 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RunQueued           = "QUEUED"
+	RunInProgress       = types.TaskInProgress
+	RunAwaitingApproval = "AWAITING_APPROVAL"
+	RunDone             = types.TaskDone
+	RunFailed           = types.TaskFailed
+	RunCanceled         = types.TaskCanceled
+)
+
+const (
+	RunEventTaskStatus        = "TASK_STATUS"
+	RunEventApprovalRequested = "APPROVAL_REQUESTED"
+	RunEventApproved          = "APPROVED"
+	RunEventRejected          = "REJECTED"
+	RunEventApprovalExpired   = "APPROVAL_EXPIRED"
+	RunEventQueued            = "QUEUED"
+	RunEventStarted           = "STARTED"
+	RunEventCanceled          = "CANCELED"
+	RunEventDispatchFailed    = "DISPATCH_FAILED"
+	RunEventDispatchRedriven  = "DISPATCH_REDRIVEN"
+	RunEventTimedOut          = "TIMED_OUT"
+)
+
+const (
+	ApprovalPending  = "PENDING"
+	ApprovalApproved = "APPROVED"
+	ApprovalRejected = "REJECTED"
+	ApprovalExpired  = "EXPIRED"
+	// the run finished while the approval was pending
+	ApprovalCanceled = "CANCELED"
+)
+
+type RunEvent struct {
+	Type      string             `json:"type"`
+	TaskId    primitive.ObjectID `json:"taskId" bson:",omitempty"`
+	MatrixKey string             `json:"matrixKey" bson:",omitempty"`
+	UserId    primitive.ObjectID `json:"userId" bson:",omitempty"`
+	Status    string             `json:"status" bson:",omitempty"`
+	Comment   string             `json:"comment" bson:",omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+}
+
+type ApprovalDecision struct {
+	UserId    primitive.ObjectID `json:"userId"`
+	Approved  bool               `json:"approved"`
+	Comment   string             `json:"comment"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+}
+
+type Approval struct {
+	TaskId            primitive.ObjectID `json:"taskId"`
+	Status            string             `json:"status"`
+	Roles             []types.Role       `json:"roles"`
+	RequiredApprovers int                `json:"requiredApprovers"`
+	RequestedAt       primitive.DateTime `json:"requestedAt"`
+	ExpiresAt         primitive.DateTime `json:"expiresAt" bson:",omitempty"`
+	Decisions         []ApprovalDecision `json:"decisions"`
+}
+
+const (
+	RunTriggerManual   = "manual"
+	RunTriggerGit      = "git"
+	RunTriggerRollback = "rollback"
+)
+
+// RunTrigger tells what started a run, with the commit metadata of git triggers
+type RunTrigger struct {
+	Type      string             `json:"type"`
+	UserId    primitive.ObjectID `json:"userId" bson:",omitempty"`
+	Provider  string             `json:"provider" bson:",omitempty"`
+	Kind      string             `json:"kind" bson:",omitempty"`
+	Repo      string             `json:"repo" bson:",omitempty"`
+	Ref       string             `json:"ref" bson:",omitempty"`
+	Branch    string             `json:"branch" bson:",omitempty"`
+	Tag       string             `json:"tag" bson:",omitempty"`
+	CommitSha string             `json:"commitSha" bson:",omitempty"`
+	Author    string             `json:"author" bson:",omitempty"`
+	Message   string             `json:"message" bson:",omitempty"`
+	// pull or merge request number and target branch of pull request triggers
+	PullRequest  int    `json:"pullRequest" bson:",omitempty"`
+	TargetBranch string `json:"targetBranch" bson:",omitempty"`
+	// deployment a rollback run restores
+	DeploymentId primitive.ObjectID `json:"deploymentId" bson:",omitempty"`
+}
+
+// TaskDeadline is when an open task of a run times out
+type TaskDeadline struct {
+	TaskId   primitive.ObjectID `json:"taskId"`
+	Deadline primitive.DateTime `json:"deadline"`
+}
+
+type MatrixExecution struct {
+	TaskId     primitive.ObjectID `json:"taskId"`
+	Key        string             `json:"key"`
+	Values     map[string]string  `json:"values"`
+	Status     string             `json:"status"`
+	ExecutedAt primitive.DateTime `json:"executedAt"`
+	StoppedAt  primitive.DateTime `json:"stoppedAt"`
+	Outputs    map[string]string  `json:"outputs" bson:",omitempty"`
+}
+
+type Run struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	PipelineId primitive.ObjectID `json:"pipelineId"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	Status     string             `json:"status"`
+	Trigger    *RunTrigger        `json:"trigger"`
+	// concurrency group the run was started in, if any
+	ConcurrencyGroup string             `json:"concurrencyGroup"`
+	CreatedAt        primitive.DateTime `json:"createdAt"`
+	UpdatedAt        primitive.DateTime `json:"updatedAt"`
+	StoppedAt        primitive.DateTime `json:"stoppedAt"`
+	History          []RunEvent         `json:"history"`
+	Approvals        []Approval         `json:"approvals"`
+	// task outputs keyed by task id
+	Outputs       map[string]map[string]string `json:"outputs"`
+	Matrix        []MatrixExecution            `json:"matrix"`
+	MatrixSettled []primitive.ObjectID         `json:"-"`
+	// tasks started and not finished yet, the run is done once the last one finishes
+	OpenTasks []primitive.ObjectID `json:"-"`
+	// deadlines of the open tasks that time out, a run with one past due is canceled
+	TaskDeadlines []TaskDeadline `json:"taskDeadlines" bson:",omitempty"`
+	// environment the run targets, if any
+	EnvironmentId primitive.ObjectID `json:"environmentId" bson:",omitempty"`
+	Environment   string             `json:"environment" bson:",omitempty"`
+}
+
+type CreateRunInput struct {
+	PipelineId       primitive.ObjectID
+	ProjectId        primitive.ObjectID
+	Status           string             `bson:",omitempty"`
+	ConcurrencyGroup string             `bson:",omitempty"`
+	EnvironmentId    primitive.ObjectID `bson:",omitempty"`
+	Environment      string             `bson:",omitempty"`
+	Trigger          *RunTrigger        `bson:",omitempty"`
+}
+
+type GetRunsInput struct {
+	PipelineId primitive.ObjectID `bson:",omitempty"`
+	ProjectId  primitive.ObjectID `bson:",omitempty"`
+	Status     *string            `bson:",omitempty"`
+}
+
+type GetRunsOutput struct {
+	TotalCount int   `json:"totalCount"`
+	Items      []Run `json:"items"`
+}
+
+type UpdateRunStatusInput struct {
+	RunId primitive.ObjectID
+	Run   struct {
+		Status string
+	}
+}
+
+type UpdateMatrixExecutionStatusInput struct {
+	RunId     primitive.ObjectID
+	TaskId    primitive.ObjectID
+	MatrixKey string
+	Task      UpdateTaskStatusInputTask
+}
+
+type CreateApprovalInput struct {
+	RunId    primitive.ObjectID
+	Approval Approval
+}
+
+type CreateApprovalDecisionInput struct {
+	RunId    primitive.ObjectID
+	TaskId   primitive.ObjectID
+	Decision ApprovalDecision
+}
+
+type UpdateApprovalStatusInput struct {
+	RunId  primitive.ObjectID
+	TaskId primitive.ObjectID
+	Status string
+}
+
+func IsRunFinished(status string) bool {
+	return status == RunDone || status == RunFailed || status == RunCanceled
+}
+
+func (r *Repository) CreateRun(ctx context.Context, input *CreateRunInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+
+	if input.Status == "" {
+		doc["status"] = RunInProgress
+	}
+	doc["createdat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["history"] = bson.A{}
+	doc["approvals"] = bson.A{}
+	doc["matrix"] = bson.A{}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+func (r *Repository) GetRun(ctx context.Context, id primitive.ObjectID) (*Run, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	var run Run
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// GetActiveRun returns the latest unfinished run of a pipeline
+func (r *Repository) GetActiveRun(ctx context.Context, pipelineId primitive.ObjectID) (*Run, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	filter := bson.M{"pipelineid": pipelineId, "status": bson.M{"$nin": bson.A{RunQueued, RunDone, RunFailed, RunCanceled}}}
+	opts := options.FindOne().SetSort(bson.D{{"createdat", -1}})
+
+	var run Run
+	err := coll.FindOne(ctx, filter, opts).Decode(&run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+func (r *Repository) GetRuns(ctx context.Context, input GetRunsInput) (*GetRunsOutput, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	filter := StructToBsonDoc(input)
+
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var output GetRunsOutput
+	if err = cursor.All(ctx, &output.Items); err != nil {
+		return nil, err
+	}
+
+	output.TotalCount = len(output.Items)
+
+	return &output, nil
+}
+
+type GetRunQueueInput struct {
+	PipelineId       primitive.ObjectID
+	ProjectId        primitive.ObjectID
+	ConcurrencyGroup string
+}
+
+// GetRunQueue returns the queued runs of a pipeline or of its concurrency group, oldest first
+func (r *Repository) GetRunQueue(ctx context.Context, input GetRunQueueInput) ([]Run, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	or := bson.A{bson.M{"pipelineid": input.PipelineId}}
+	if input.ConcurrencyGroup != "" {
+		or = append(or, bson.M{"projectid": input.ProjectId, "concurrencygroup": input.ConcurrencyGroup})
+	}
+
+	filter := bson.M{"status": RunQueued, "$or": or}
+
+	opts := options.Find().SetSort(bson.D{{"createdat", 1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	if err = cursor.All(ctx, &runs); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// StartQueuedRun moves a queued run to in progress and reports whether this call was the one that moved it
+func (r *Repository) StartQueuedRun(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": id, "status": RunQueued}
+	update := bson.M{"$set": bson.M{"status": RunInProgress, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+func (r *Repository) UpdateRunStatus(ctx context.Context, input UpdateRunStatusInput) error {
+	filter := bson.M{"_id": input.RunId}
+
+	doc := bson.M{"status": input.Run.Status, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}
+
+	if IsRunFinished(input.Run.Status) {
+		doc["stoppedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+	}
+
+	update := bson.M{"$set": doc}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+// FinishRun moves an unfinished run to a final status and reports whether this call was the one that moved it
+func (r *Repository) FinishRun(ctx context.Context, id primitive.ObjectID, status string) (bool, error) {
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	filter := bson.M{"_id": id, "status": bson.M{"$nin": bson.A{RunDone, RunFailed, RunCanceled}}}
+	update := bson.M{"$set": bson.M{"status": status, "updatedat": now, "stoppedat": now}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// OpenRunTasks records tasks of a run as started, before they are dispatched, replacing the deadlines of tasks
+// started again
+func (r *Repository) OpenRunTasks(ctx context.Context, runId primitive.ObjectID, taskIds []primitive.ObjectID, deadlines []TaskDeadline) error {
+	filter := bson.M{"_id": runId}
+	update := bson.M{
+		"$addToSet": bson.M{"opentasks": bson.M{"$each": taskIds}},
+		"$pull":     bson.M{"taskdeadlines": bson.M{"taskid": bson.M{"$in": taskIds}}},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil || len(deadlines) == 0 {
+		return err
+	}
+
+	_, err = coll.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"taskdeadlines": bson.M{"$each": deadlines}}})
+
+	return err
+}
+
+// CloseRunTask records a task of a run as finished and returns the updated run, whose OpenTasks tells what still runs
+func (r *Repository) CloseRunTask(ctx context.Context, runId, taskId primitive.ObjectID) (*Run, error) {
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$pull": bson.M{"opentasks": taskId, "taskdeadlines": bson.M{"taskid": taskId}}}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{ReturnDocument: &after}
+
+	var run Run
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+func (r *Repository) CreateRunEvent(ctx context.Context, runId primitive.ObjectID, event RunEvent) error {
+	event.CreatedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$push": bson.M{"history": event}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) UpdateRunOutputs(ctx context.Context, runId, taskId primitive.ObjectID, outputs map[string]string) error {
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$set": bson.M{"outputs." + taskId.Hex(): outputs, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) CreateMatrixExecutions(ctx context.Context, runId primitive.ObjectID, executions []MatrixExecution) error {
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$push": bson.M{"matrix": bson.M{"$each": executions}}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+// UpdateMatrixExecutionStatus sets the status of a single matrix execution and returns the updated run
+func (r *Repository) UpdateMatrixExecutionStatus(ctx context.Context, input UpdateMatrixExecutionStatusInput) (*Run, error) {
+	filter := bson.M{"_id": input.RunId}
+
+	doc := bson.M{"matrix.$[e].status": input.Task.Status}
+
+	switch input.Task.Status {
+	case types.TaskInProgress:
+		doc["matrix.$[e].executedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+	case types.TaskDone, types.TaskFailed, types.TaskCanceled:
+		doc["matrix.$[e].stoppedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+	}
+
+	if len(input.Task.Outputs) > 0 {
+		doc["matrix.$[e].outputs"] = input.Task.Outputs
+	}
+
+	update := bson.M{"$set": doc}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+		ArrayFilters:   &options.ArrayFilters{Filters: bson.A{bson.M{"e.taskid": input.TaskId, "e.key": input.MatrixKey, "e.status": bson.M{"$ne": types.TaskCanceled}}}},
+	}
+
+	var run Run
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// CancelMatrixExecutions cancels the executions of a matrix task that have not finished yet
+func (r *Repository) CancelMatrixExecutions(ctx context.Context, runId, taskId primitive.ObjectID) error {
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$set": bson.M{
+		"matrix.$[e].status":    types.TaskCanceled,
+		"matrix.$[e].stoppedat": primitive.NewDateTimeFromTime(time.Now().UTC()),
+	}}
+
+	opts := options.UpdateOptions{
+		ArrayFilters: &options.ArrayFilters{Filters: bson.A{bson.M{"e.taskid": taskId, "e.status": bson.M{"$in": bson.A{types.TaskPending, types.TaskInProgress}}}}},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update, &opts)
+
+	return err
+}
+
+// SettleMatrix marks a matrix task as settled and reports whether this call was the one that settled it
+func (r *Repository) SettleMatrix(ctx context.Context, runId, taskId primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": runId, "matrixsettled": bson.M{"$ne": taskId}}
+	update := bson.M{"$push": bson.M{"matrixsettled": taskId}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// CreateApproval holds a run until the approval is given, it reports false and leaves the run as it is when the run
+// finished meanwhile or already has an approval of the task
+func (r *Repository) CreateApproval(ctx context.Context, input CreateApprovalInput) (bool, error) {
+	input.Approval.Status = ApprovalPending
+	input.Approval.RequestedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+	input.Approval.Decisions = []ApprovalDecision{}
+
+	filter := bson.M{
+		"_id":              input.RunId,
+		"status":           bson.M{"$nin": bson.A{RunDone, RunFailed, RunCanceled}},
+		"approvals.taskid": bson.M{"$ne": input.Approval.TaskId},
+	}
+	update := bson.M{
+		"$push": bson.M{"approvals": input.Approval},
+		"$set":  bson.M{"status": RunAwaitingApproval, "updatedat": input.Approval.RequestedAt},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// CreateApprovalDecision records a decision on a pending approval, rejecting a second decision by the same user
+func (r *Repository) CreateApprovalDecision(ctx context.Context, input CreateApprovalDecisionInput) (*Approval, error) {
+	input.Decision.CreatedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	filter := bson.M{"_id": input.RunId, "status": RunAwaitingApproval, "approvals": bson.M{"$elemMatch": bson.M{
+		"taskid":           input.TaskId,
+		"status":           ApprovalPending,
+		"decisions.userid": bson.M{"$ne": input.Decision.UserId},
+	}}}
+	update := bson.M{"$push": bson.M{"approvals.$.decisions": input.Decision}}
+
+	after := options.After
+	opts := options.FindOneAndUpdateOptions{ReturnDocument: &after}
+
+	var run Run
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	err := coll.FindOneAndUpdate(ctx, filter, update, &opts).Decode(&run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range run.Approvals {
+		if a.TaskId == input.TaskId {
+			return &a, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UpdateApprovalStatus settles a pending approval and reports whether this call was the one that settled it
+func (r *Repository) UpdateApprovalStatus(ctx context.Context, input UpdateApprovalStatusInput) (bool, error) {
+	filter := bson.M{"_id": input.RunId, "status": RunAwaitingApproval, "approvals": bson.M{"$elemMatch": bson.M{"taskid": input.TaskId, "status": ApprovalPending}}}
+	update := bson.M{"$set": bson.M{"approvals.$.status": input.Status, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// ResumeApprovedRun moves a run awaiting approval back in progress once none of its approvals is pending,
+// it reports whether this call moved it
+func (r *Repository) ResumeApprovedRun(ctx context.Context, runId primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": runId, "status": RunAwaitingApproval, "approvals.status": bson.M{"$ne": ApprovalPending}}
+	update := bson.M{"$set": bson.M{"status": RunInProgress, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	res, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// CancelApprovals cancels the pending approvals of a finished run, so they can neither be decided nor expire
+func (r *Repository) CancelApprovals(ctx context.Context, runId primitive.ObjectID) error {
+	filter := bson.M{"_id": runId}
+	update := bson.M{"$set": bson.M{"approvals.$[a].status": ApprovalCanceled}}
+
+	opts := options.UpdateOptions{
+		ArrayFilters: &options.ArrayFilters{Filters: bson.A{bson.M{"a.status": ApprovalPending}}},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+	_, err := coll.UpdateOne(ctx, filter, update, &opts)
+
+	return err
+}
+
+// GetTimedOutRuns returns the runs with an open task past its deadline, including runs awaiting approval whose
+// other branches keep running
+func (r *Repository) GetTimedOutRuns(ctx context.Context) ([]Run, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	filter := bson.M{
+		"status":                 bson.M{"$in": bson.A{RunInProgress, RunAwaitingApproval}},
+		"taskdeadlines.deadline": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now().UTC())},
+	}
+	cursor, err := coll.Find(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	if err = cursor.All(ctx, &runs); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// GetExpiredApprovalRuns returns runs holding a pending approval whose deadline has passed
+func (r *Repository) GetExpiredApprovalRuns(ctx context.Context) ([]Run, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("runs")
+
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+	filter := bson.M{"approvals": bson.M{"$elemMatch": bson.M{"status": ApprovalPending, "expiresat": bson.M{"$lte": now}}}}
+
+	cursor, err := coll.Find(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	if err = cursor.All(ctx, &runs); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
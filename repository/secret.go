@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SecretAuditCreated   = "CREATED"
+	SecretAuditRotated   = "ROTATED"
+	SecretAuditDeleted   = "DELETED"
+	SecretAuditResolved  = "RESOLVED"
+	SecretAuditRewrapped = "REWRAPPED"
+)
+
+// SecretVersion is one value of a secret, encrypted with its own data key which is wrapped by master key KeyId
+type SecretVersion struct {
+	Version    int                `json:"version"`
+	KeyId      string             `json:"keyId"`
+	WrappedKey []byte             `json:"-"`
+	Ciphertext []byte             `json:"-"`
+	CreatedBy  primitive.ObjectID `json:"createdBy"`
+	CreatedAt  primitive.DateTime `json:"createdAt"`
+}
+
+// Secret is a named project secret, its values are never returned through the api
+type Secret struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId primitive.ObjectID `json:"projectId"`
+	// zero for project secrets, environment secrets take precedence over them in runs targeting the environment
+	EnvironmentId primitive.ObjectID `json:"environmentId" bson:",omitempty"`
+	Name          string             `json:"name"`
+	Description   string             `json:"description"`
+	// current version, the one references resolve to
+	Version   int                `json:"version"`
+	Versions  []SecretVersion    `json:"versions"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+	UpdatedAt primitive.DateTime `json:"updatedAt"`
+}
+
+type CreateSecretInput struct {
+	ProjectId     primitive.ObjectID
+	EnvironmentId primitive.ObjectID
+	Name          string
+	Description   string
+	Version       SecretVersion
+}
+
+type AddSecretVersionInput struct {
+	ProjectId     primitive.ObjectID
+	EnvironmentId primitive.ObjectID
+	Name          string
+	Description   *string
+	// Version.Version must follow the current version
+	Version SecretVersion
+}
+
+// SecretAudit records every write and every read of a secret
+type SecretAudit struct {
+	Id            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ProjectId     primitive.ObjectID `json:"projectId"`
+	EnvironmentId primitive.ObjectID `json:"environmentId" bson:",omitempty"`
+	SecretName    string             `json:"secretName"`
+	Version       int                `json:"version"`
+	Action        string             `json:"action"`
+	UserId        primitive.ObjectID `json:"userId" bson:",omitempty"`
+	RunId         primitive.ObjectID `json:"runId" bson:",omitempty"`
+	TaskId        primitive.ObjectID `json:"taskId" bson:",omitempty"`
+	// agent host a resolved value was sent to
+	Host      string             `json:"host" bson:",omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+}
+
+type GetSecretsInput struct {
+	ProjectId     primitive.ObjectID
+	EnvironmentId primitive.ObjectID
+	// with encrypted versions when set, as metadata otherwise
+	Names []string
+}
+
+type GetSecretAuditInput struct {
+	ProjectId  primitive.ObjectID
+	SecretName string
+	Limit      int64
+}
+
+// secret listings leave out the encrypted material
+var secretMetadataProjection = bson.M{"versions.wrappedkey": 0, "versions.ciphertext": 0}
+
+// secretScope selects the secrets of an environment, or those of the project when the environment id is zero
+func secretScope(projectId, environmentId primitive.ObjectID) bson.M {
+	filter := bson.M{"projectid": projectId, "environmentid": nil}
+	if !environmentId.IsZero() {
+		filter["environmentid"] = environmentId
+	}
+
+	return filter
+}
+
+// CreateSecret stores the first version of a secret, it reports false when the secret was created in the meantime
+func (r *Repository) CreateSecret(ctx context.Context, input *CreateSecretInput) (bool, error) {
+	now := primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	doc := bson.M{
+		"projectid":   input.ProjectId,
+		"name":        input.Name,
+		"description": input.Description,
+		"version":     input.Version.Version,
+		"versions":    bson.A{input.Version},
+		"createdat":   now,
+		"updatedat":   now,
+	}
+	if !input.EnvironmentId.IsZero() {
+		doc["environmentid"] = input.EnvironmentId
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+	_, err := coll.InsertOne(ctx, doc)
+
+	// the unique index on the secret scope and name rejects the second of two concurrent creations
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// secretIndex keeps the name of a secret unique within its scope, project secrets have no environmentid and share null
+var secretIndex = mongo.IndexModel{
+	Keys:    bson.D{{"projectid", 1}, {"environmentid", 1}, {"name", 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+// AddSecretVersion makes a new version current, it reports false when another version was added in the meantime
+func (r *Repository) AddSecretVersion(ctx context.Context, input *AddSecretVersionInput) (bool, error) {
+	filter := secretScope(input.ProjectId, input.EnvironmentId)
+	filter["name"] = input.Name
+	filter["version"] = input.Version.Version - 1
+
+	set := bson.M{"version": input.Version.Version, "updatedat": primitive.NewDateTimeFromTime(time.Now().UTC())}
+	if input.Description != nil {
+		set["description"] = *input.Description
+	}
+
+	update := bson.M{"$set": set, "$push": bson.M{"versions": input.Version}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+	result, err := coll.UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.MatchedCount == 1, nil
+}
+
+// GetSecret returns a secret with its encrypted versions
+func (r *Repository) GetSecret(ctx context.Context, projectId, environmentId primitive.ObjectID, name string) (*Secret, error) {
+	filter := secretScope(projectId, environmentId)
+	filter["name"] = name
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+
+	var secret Secret
+	err := coll.FindOne(ctx, filter).Decode(&secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &secret, nil
+}
+
+// GetSecrets returns the secrets of a project or environment, with encrypted versions when names are given and as metadata otherwise
+func (r *Repository) GetSecrets(ctx context.Context, input GetSecretsInput) ([]Secret, error) {
+	filter := secretScope(input.ProjectId, input.EnvironmentId)
+	opts := options.Find().SetSort(bson.D{{"name", 1}})
+
+	if input.Names != nil {
+		filter["name"] = bson.M{"$in": input.Names}
+	} else {
+		opts.SetProjection(secretMetadataProjection)
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []Secret
+	if err = cursor.All(ctx, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+func (r *Repository) DeleteSecret(ctx context.Context, projectId, environmentId primitive.ObjectID, name string) (bool, error) {
+	filter := secretScope(projectId, environmentId)
+	filter["name"] = name
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+	result, err := coll.DeleteOne(ctx, filter)
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount == 1, nil
+}
+
+// UpdateSecretVersionKey replaces the wrapped data key of a version after a master key rotation
+func (r *Repository) UpdateSecretVersionKey(ctx context.Context, id primitive.ObjectID, version int, keyId string, wrappedKey []byte) error {
+	filter := bson.M{"_id": id, "versions.version": version}
+	update := bson.M{"$set": bson.M{"versions.$.keyid": keyId, "versions.$.wrappedkey": wrappedKey}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("secrets")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) CreateSecretAudit(ctx context.Context, audit *SecretAudit) error {
+	audit.CreatedAt = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("secretaudit")
+	_, err := coll.InsertOne(ctx, audit)
+
+	return err
+}
+
+// GetSecretAudit returns the audit trail of a project, or of one of its secrets, newest first
+func (r *Repository) GetSecretAudit(ctx context.Context, input GetSecretAuditInput) ([]SecretAudit, error) {
+	filter := bson.M{"projectid": input.ProjectId}
+	if input.SecretName != "" {
+		filter["secretname"] = input.SecretName
+	}
+
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}})
+	if input.Limit > 0 {
+		opts.SetLimit(input.Limit)
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("secretaudit")
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var audit []SecretAudit
+	if err = cursor.All(ctx, &audit); err != nil {
+		return nil, err
+	}
+
+	return audit, nil
+}
@@ -10,6 +10,22 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// TaskTypeApproval marks a task that is not dispatched to an agent but holds the run until it is approved
+const TaskTypeApproval = "approval"
+
+// TaskTypeDeploy marks a task whose successful runs are recorded as deployments
+const TaskTypeDeploy = "deploy"
+
+type ApprovalConfig struct {
+	Roles             []types.Role `json:"roles"`
+	RequiredApprovers int          `json:"requiredApprovers"`
+}
+
+type MatrixConfig struct {
+	Axes     map[string][]string `json:"axes"`
+	FailFast bool                `json:"failFast"`
+}
+
 type Task struct {
 	Id             primitive.ObjectID `json:"id"`
 	Name           string             `json:"name"`
@@ -27,6 +43,10 @@ type Task struct {
 	AutoRun        bool               `json:"autoRun"`
 	Timeout        int64              `json:"timeout"` // minutes
 	Type           string             `json:"type"`
+	Approval       *ApprovalConfig    `json:"approval" bson:",omitempty"`
+	Matrix         *MatrixConfig      `json:"matrix" bson:",omitempty"`
+	// labels an agent must carry to run the task when no WebhookHost is set
+	AgentLabels map[string]string `json:"agentLabels" bson:",omitempty"`
 }
 
 type UpdateTaskInputTask struct {
@@ -40,6 +60,9 @@ type UpdateTaskInputTask struct {
 	AutoRun        *bool
 	Timeout        *int64
 	Type           *string
+	Approval       *ApprovalConfig
+	Matrix         *MatrixConfig
+	AgentLabels    map[string]string
 }
 
 type UpdateTaskInput struct {
@@ -48,12 +71,19 @@ type UpdateTaskInput struct {
 	Task       UpdateTaskInputTask
 }
 
+type UpdateTaskStatusInputTask struct {
+	Status  string
+	Outputs map[string]string `bson:",omitempty"`
+}
+
 type UpdateTaskStatusInput struct {
 	PipelineId primitive.ObjectID
 	TaskId     primitive.ObjectID
-	Task       struct {
-		Status string
-	}
+	// run the status belongs to, the pipeline's active run is assumed when empty
+	RunId primitive.ObjectID
+	// set by agents reporting on a single execution of a matrix task
+	MatrixKey string
+	Task      UpdateTaskStatusInputTask
 }
 
 type CreateTaskInputTask struct {
@@ -67,6 +97,9 @@ type CreateTaskInputTask struct {
 	AutoRun        bool
 	Timeout        int64
 	Type           string
+	Approval       *ApprovalConfig   `bson:",omitempty"`
+	Matrix         *MatrixConfig     `bson:",omitempty"`
+	AgentLabels    map[string]string `bson:",omitempty"`
 }
 type CreateTaskInput struct {
 	PipelineId primitive.ObjectID
@@ -100,7 +133,7 @@ func (r *Repository) CreateTask(ctx context.Context, input *CreateTaskInput) (pr
 	doc["status"] = types.TaskPending
 	doc["createdat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
 
-	update := bson.M{"$push": bson.M{"tasks": doc}}
+	update := bson.M{"$push": bson.M{"tasks": doc}, "$inc": bson.M{"revision": 1}}
 	_, err := coll.UpdateOne(ctx, filter, update)
 
 	return doc["id"].(primitive.ObjectID), err
@@ -142,7 +175,7 @@ func (r *Repository) GetTasks(ctx context.Context, input GetTasksInput) ([]Task,
 func (r *Repository) DeleteTask(ctx context.Context, input *DeleteTaskInput) error {
 	coll := r.mongoClient.Database("pipeline").Collection("pipelines")
 	filter := bson.M{"_id": input.PipelineId}
-	update := bson.M{"$pull": bson.M{"tasks": bson.M{"id": input.Id}}}
+	update := bson.M{"$pull": bson.M{"tasks": bson.M{"id": input.Id}}, "$inc": bson.M{"revision": 1}}
 	_, err := coll.UpdateOne(ctx, filter, update)
 
 	return err
@@ -184,8 +217,18 @@ func (r *Repository) UpdateTask(ctx context.Context, input UpdateTaskInput) erro
 	if input.Task.Type != nil {
 		doc["tasks.$.type"] = input.Task.Type
 	}
+	if input.Task.Approval != nil {
+		doc["tasks.$.approval"] = input.Task.Approval
+	}
+	if input.Task.Matrix != nil {
+		doc["tasks.$.matrix"] = input.Task.Matrix
+	}
+	if input.Task.AgentLabels != nil {
+		doc["tasks.$.agentlabels"] = input.Task.AgentLabels
+	}
 
-	update := bson.M{"$set": doc}
+	// the pipeline's revision moves with its tasks
+	update := bson.M{"$set": doc, "$inc": bson.M{"revision": 1}}
 
 	coll := r.mongoClient.Database("pipeline").Collection("pipelines")
 	_, err := coll.UpdateOne(ctx, filter, update)
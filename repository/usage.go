@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	types "github.com/more-than-code/deploybot-service-api/deploybot-types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ServerAlertDiskFull = "DISK_FULL"
+
+type MemoryInfo struct {
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+	Free  uint64 `json:"free"`
+}
+
+// ImageCacheInfo is the docker image cache of a server
+type ImageCacheInfo struct {
+	Images int    `json:"images"`
+	Size   uint64 `json:"size"`
+	// space held by dangling and unused images
+	Reclaimable uint64 `json:"reclaimable"`
+}
+
+// ServerUsage is one sample of the resource usage time series of a build or deploy server
+type ServerUsage struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	ServerHost string             `json:"serverHost"`
+	AgentId    primitive.ObjectID `json:"agentId"`
+	DiskInfo   types.DiskInfo     `json:"diskInfo"`
+	Memory     MemoryInfo         `json:"memory"`
+	ImageCache ImageCacheInfo     `json:"imageCache"`
+	ReportedAt primitive.DateTime `json:"reportedAt"`
+}
+
+type CreateServerUsageInput struct {
+	ProjectId  primitive.ObjectID
+	ServerHost string
+	AgentId    primitive.ObjectID
+	DiskInfo   types.DiskInfo
+	Memory     MemoryInfo
+	ImageCache ImageCacheInfo
+}
+
+// GetServerUsageInput selects the samples of one agent, or of every agent of a server when AgentId is zero
+type GetServerUsageInput struct {
+	ProjectId  primitive.ObjectID
+	AgentId    primitive.ObjectID
+	ServerHost string
+	From       *time.Time
+	To         *time.Time
+	Limit      int64
+}
+
+// ServerAlert is raised when the server of an agent crosses a usage threshold and resolved once it is back under it,
+// alerts are kept per agent since pull agents have no host
+type ServerAlert struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	AgentId    primitive.ObjectID `json:"agentId"`
+	ServerHost string             `json:"serverHost"`
+	Type       string             `json:"type"`
+	Percent    float64            `json:"percent"`
+	Threshold  float64            `json:"threshold"`
+	CreatedAt  primitive.DateTime `json:"createdAt"`
+	ResolvedAt primitive.DateTime `json:"resolvedAt"`
+}
+
+type GetServerAlertsInput struct {
+	ProjectId  primitive.ObjectID
+	AgentId    primitive.ObjectID
+	ServerHost string
+	ActiveOnly bool
+}
+
+func (r *Repository) CreateServerUsage(ctx context.Context, input *CreateServerUsageInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+	doc["reportedat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+
+	coll := r.mongoClient.Database("pipeline").Collection("serverusage")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+// GetServerUsage returns the samples of an agent or server, newest first
+func (r *Repository) GetServerUsage(ctx context.Context, input GetServerUsageInput) ([]ServerUsage, error) {
+	filter := bson.M{"projectid": input.ProjectId, "serverhost": input.ServerHost}
+	if !input.AgentId.IsZero() {
+		filter = bson.M{"projectid": input.ProjectId, "agentid": input.AgentId}
+	}
+
+	reportedAt := bson.M{}
+	if input.From != nil {
+		reportedAt["$gte"] = primitive.NewDateTimeFromTime(*input.From)
+	}
+	if input.To != nil {
+		reportedAt["$lte"] = primitive.NewDateTimeFromTime(*input.To)
+	}
+	if len(reportedAt) > 0 {
+		filter["reportedat"] = reportedAt
+	}
+
+	opts := options.Find().SetSort(bson.D{{"reportedat", -1}})
+	if input.Limit > 0 {
+		opts.SetLimit(input.Limit)
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("serverusage")
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []ServerUsage
+	if err = cursor.All(ctx, &usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// DeleteServerUsage removes the samples reported before the cutoff
+func (r *Repository) DeleteServerUsage(ctx context.Context, before time.Time) error {
+	coll := r.mongoClient.Database("pipeline").Collection("serverusage")
+	_, err := coll.DeleteMany(ctx, bson.M{"reportedat": bson.M{"$lt": primitive.NewDateTimeFromTime(before)}})
+
+	return err
+}
+
+// OpenServerAlert raises an alert unless one of the type is still active for the agent, it reports whether one was raised
+func (r *Repository) OpenServerAlert(ctx context.Context, alert *ServerAlert) (bool, error) {
+	filter := bson.M{"projectid": alert.ProjectId, "agentid": alert.AgentId, "type": alert.Type, "resolvedat": nil}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"serverhost": alert.ServerHost,
+			"percent":    alert.Percent,
+			"threshold":  alert.Threshold,
+			"createdat":  primitive.NewDateTimeFromTime(time.Now().UTC()),
+		},
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("serveralerts")
+	result, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.UpsertedCount > 0, nil
+}
+
+func (r *Repository) ResolveServerAlerts(ctx context.Context, projectId, agentId primitive.ObjectID, alertType string) error {
+	filter := bson.M{"projectid": projectId, "agentid": agentId, "type": alertType, "resolvedat": nil}
+	update := bson.M{"$set": bson.M{"resolvedat": primitive.NewDateTimeFromTime(time.Now().UTC())}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("serveralerts")
+	_, err := coll.UpdateMany(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) GetServerAlerts(ctx context.Context, input GetServerAlertsInput) ([]ServerAlert, error) {
+	filter := bson.M{"projectid": input.ProjectId}
+	if !input.AgentId.IsZero() {
+		filter["agentid"] = input.AgentId
+	}
+	if input.ServerHost != "" {
+		filter["serverhost"] = input.ServerHost
+	}
+	if input.ActiveOnly {
+		filter["resolvedat"] = nil
+	}
+
+	coll := r.mongoClient.Database("pipeline").Collection("serveralerts")
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{"createdat", -1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []ServerAlert
+	if err = cursor.All(ctx, &alerts); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
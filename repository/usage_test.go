@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDeleteServerUsage(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	agentId := primitive.NewObjectID()
+	coll := r.mongoClient.Database("pipeline").Collection("serverusage")
+	defer coll.DeleteMany(ctx, bson.M{"projectid": pid})
+
+	// samples far in the past keep the cutoff away from samples of real projects
+	cutoff := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, reportedAt := range []time.Time{cutoff.Add(-time.Hour), cutoff.Add(time.Hour)} {
+		coll.InsertOne(ctx, bson.M{"projectid": pid, "agentid": agentId, "reportedat": primitive.NewDateTimeFromTime(reportedAt)})
+	}
+
+	if _, err := r.CreateServerUsage(ctx, &CreateServerUsageInput{ProjectId: pid, AgentId: agentId}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.DeleteServerUsage(ctx, cutoff); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := r.GetServerUsage(ctx, GetServerUsageInput{ProjectId: pid, AgentId: agentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usage) != 2 {
+		t.Fatalf("expected 2 samples to be kept, got %d", len(usage))
+	}
+
+	for _, u := range usage {
+		if u.ReportedAt.Time().Before(cutoff) {
+			t.Errorf("expected the sample of %s to be pruned", u.ReportedAt.Time())
+		}
+	}
+}
+
+func TestOpenServerAlert(t *testing.T) {
+	r, _ := NewRepository()
+	ctx := context.TODO()
+
+	pid := primitive.NewObjectID()
+	defer r.mongoClient.Database("pipeline").Collection("serveralerts").DeleteMany(ctx, bson.M{"projectid": pid})
+
+	// pull agents have no host, their alerts must still be told apart
+	first := ServerAlert{ProjectId: pid, AgentId: primitive.NewObjectID(), Type: "disk", Percent: 95, Threshold: 90}
+	second := ServerAlert{ProjectId: pid, AgentId: primitive.NewObjectID(), Type: "disk", Percent: 92, Threshold: 90}
+
+	for _, alert := range []ServerAlert{first, second, first} {
+		if _, err := r.OpenServerAlert(ctx, &alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alerts, _ := r.GetServerAlerts(ctx, GetServerAlertsInput{ProjectId: pid, ActiveOnly: true})
+	if len(alerts) != 2 {
+		t.Fatalf("expected 1 active alert per agent, got %d", len(alerts))
+	}
+
+	if err := r.ResolveServerAlerts(ctx, pid, first.AgentId, "disk"); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts, _ = r.GetServerAlerts(ctx, GetServerAlertsInput{ProjectId: pid, ActiveOnly: true})
+	if len(alerts) != 1 || alerts[0].AgentId != second.AgentId {
+		t.Errorf("expected only the alert of agent %s to stay active, got %+v", second.AgentId.Hex(), alerts)
+	}
+
+	raised, _ := r.OpenServerAlert(ctx, &first)
+	if !raised {
+		t.Error("expected a new alert once the previous one was resolved")
+	}
+}
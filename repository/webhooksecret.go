@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookSecret signs stream webhooks of a project, or only those sent to one server when ServerHost is set;
+// the secret rests sealed like project secrets
+type WebhookSecret struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	ProjectId  primitive.ObjectID `json:"projectId"`
+	ServerHost string             `json:"serverHost"`
+	KeyId      string             `json:"keyId"`
+	WrappedKey []byte             `json:"-"`
+	Ciphertext []byte             `json:"-"`
+	// plaintext of secrets created before they were sealed, until a rewrap seals them
+	Secret    string             `json:"-" bson:",omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt"`
+	ExpiresAt primitive.DateTime `json:"expiresAt"`
+}
+
+type CreateWebhookSecretInput struct {
+	Id         primitive.ObjectID `bson:"_id"`
+	ProjectId  primitive.ObjectID
+	ServerHost string
+	KeyId      string
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+type GetWebhookSecretsInput struct {
+	ProjectId  primitive.ObjectID
+	ServerHost string
+	// leave out secrets past their overlap window
+	ActiveOnly bool
+}
+
+type ExpireWebhookSecretsInput struct {
+	ProjectId  primitive.ObjectID
+	ServerHost string
+	ExpiresAt  primitive.DateTime
+}
+
+func (r *Repository) CreateWebhookSecret(ctx context.Context, input *CreateWebhookSecretInput) (primitive.ObjectID, error) {
+	doc := StructToBsonDoc(input)
+	doc["createdat"] = primitive.NewDateTimeFromTime(time.Now().UTC())
+	doc["expiresat"] = nil
+
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+	result, err := coll.InsertOne(ctx, doc)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return result.InsertedID.(primitive.ObjectID), nil
+}
+
+func (r *Repository) GetWebhookSecrets(ctx context.Context, input GetWebhookSecretsInput) ([]WebhookSecret, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+
+	filter := bson.M{"projectid": input.ProjectId, "serverhost": input.ServerHost}
+	if input.ActiveOnly {
+		filter["$or"] = bson.A{
+			bson.M{"expiresat": nil},
+			bson.M{"expiresat": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now().UTC())}},
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{"createdat", -1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []WebhookSecret
+	if err = cursor.All(ctx, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// GetProjectWebhookSecrets returns the webhook secrets of a project for every server, expired ones included
+func (r *Repository) GetProjectWebhookSecrets(ctx context.Context, projectId primitive.ObjectID) ([]WebhookSecret, error) {
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+	cursor, err := coll.Find(ctx, bson.M{"projectid": projectId})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []WebhookSecret
+	if err = cursor.All(ctx, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// SealWebhookSecret stores a webhook secret sealed under a master key, dropping the plaintext of older secrets
+func (r *Repository) SealWebhookSecret(ctx context.Context, id primitive.ObjectID, keyId string, wrappedKey, ciphertext []byte) error {
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{"keyid": keyId, "wrappedkey": wrappedKey, "ciphertext": ciphertext}, "$unset": bson.M{"secret": ""}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+	_, err := coll.UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+// ExpireWebhookSecrets sets the end of the overlap window on secrets that do not expire yet
+func (r *Repository) ExpireWebhookSecrets(ctx context.Context, input ExpireWebhookSecretsInput) error {
+	filter := bson.M{"projectid": input.ProjectId, "serverhost": input.ServerHost, "expiresat": nil}
+	update := bson.M{"$set": bson.M{"expiresat": input.ExpiresAt}}
+
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+	_, err := coll.UpdateMany(ctx, filter, update)
+
+	return err
+}
+
+func (r *Repository) DeleteWebhookSecret(ctx context.Context, projectId, id primitive.ObjectID) error {
+	coll := r.mongoClient.Database("pipeline").Collection("webhooksecrets")
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id, "projectid": projectId})
+
+	return err
+}
@@ -0,0 +1,173 @@
+// Package signature signs the stream webhooks sent to agents and lets agents verify them.
+//
+// A signed request carries a unix timestamp, a random nonce and one v1 signature per active
+// secret. Each signature is the hex HMAC-SHA256 of "<timestamp>.<nonce>.<body>", so an agent
+// keeps accepting requests while a secret is rotated and both secrets are active.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "X-Deploybot-Timestamp"
+	HeaderNonce     = "X-Deploybot-Nonce"
+	HeaderSignature = "X-Deploybot-Signature"
+
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingHeaders   = errors.New("signature headers missing")
+	ErrExpiredTimestamp = errors.New("timestamp outside tolerance")
+	ErrReplayedNonce    = errors.New("nonce already used")
+	ErrNoMatch          = errors.New("no matching signature")
+)
+
+// Sign returns the hex signature of a body for the given timestamp and nonce
+func Sign(secret []byte, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.%s.", timestamp, nonce)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers on an outgoing request, signing once with each secret
+func SignRequest(req *http.Request, body []byte, secrets ...[]byte) error {
+	nonce, err := NewNonce()
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+
+	sigs := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		sigs = append(sigs, "v1="+Sign(s, timestamp, nonce, body))
+	}
+
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, strings.Join(sigs, ","))
+
+	return nil
+}
+
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// NonceStore remembers nonces for as long as their timestamp is acceptable
+type NonceStore interface {
+	// Use records a nonce and reports false if it was seen before
+	Use(nonce string, expiresAt time.Time) bool
+}
+
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+func (s *MemoryNonceStore) Use(nonce string, expiresAt time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for n, exp := range s.nonces {
+		if exp.Before(now) {
+			delete(s.nonces, n)
+		}
+	}
+
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+
+	s.nonces[nonce] = expiresAt
+
+	return true
+}
+
+type Verifier struct {
+	// every secret currently accepted, old and new ones during a rotation
+	Secrets   [][]byte
+	Tolerance time.Duration
+	Nonces    NonceStore
+}
+
+func NewVerifier(secrets ...string) *Verifier {
+	v := &Verifier{Tolerance: DefaultTolerance, Nonces: NewMemoryNonceStore()}
+	for _, s := range secrets {
+		v.Secrets = append(v.Secrets, []byte(s))
+	}
+
+	return v
+}
+
+// Verify checks the signature headers of a request against its body
+func (v *Verifier) Verify(header http.Header, body []byte) error {
+	tsStr := header.Get(HeaderTimestamp)
+	nonce := header.Get(HeaderNonce)
+	sigHeader := header.Get(HeaderSignature)
+
+	if tsStr == "" || nonce == "" || sigHeader == "" {
+		return ErrMissingHeaders
+	}
+
+	timestamp, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return ErrMissingHeaders
+	}
+
+	tolerance := v.Tolerance
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+
+	signedAt := time.Unix(timestamp, 0)
+	if d := time.Since(signedAt); d > tolerance || d < -tolerance {
+		return ErrExpiredTimestamp
+	}
+
+	matched := false
+	for _, s := range v.Secrets {
+		expected := Sign(s, timestamp, nonce, body)
+
+		for _, sig := range strings.Split(sigHeader, ",") {
+			sig = strings.TrimPrefix(strings.TrimSpace(sig), "v1=")
+			if hmac.Equal([]byte(sig), []byte(expected)) {
+				matched = true
+			}
+		}
+	}
+
+	if !matched {
+		return ErrNoMatch
+	}
+
+	if v.Nonces != nil && !v.Nonces.Use(nonce, signedAt.Add(tolerance)) {
+		return ErrReplayedNonce
+	}
+
+	return nil
+}
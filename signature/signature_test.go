@@ -0,0 +1,49 @@
+package signature
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"payload":{}}`)
+
+	req, _ := http.NewRequest("POST", "https://agent/streamWebhook", nil)
+	if err := SignRequest(req, body, []byte("old-secret"), []byte("new-secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// an agent that only knows the new secret accepts the request during the rotation
+	v := NewVerifier("new-secret")
+	if err := v.Verify(req.Header, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Verify(req.Header, body); err != ErrReplayedNonce {
+		t.Fatal(err)
+	}
+
+	if err := NewVerifier("new-secret").Verify(req.Header, []byte(`{}`)); err != ErrNoMatch {
+		t.Fatal(err)
+	}
+
+	if err := NewVerifier("other-secret").Verify(req.Header, body); err != ErrNoMatch {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	body := []byte(`{}`)
+	timestamp := time.Now().Add(-time.Hour).Unix()
+
+	header := http.Header{}
+	header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	header.Set(HeaderNonce, "abc")
+	header.Set(HeaderSignature, "v1="+Sign([]byte("secret"), timestamp, "abc", body))
+
+	if err := NewVerifier("secret").Verify(header, body); err != ErrExpiredTimestamp {
+		t.Fatal(err)
+	}
+}